@@ -12,6 +12,7 @@ import (
 
 	decision "github.com/ipfs/go-bitswap/decision"
 	bsgetter "github.com/ipfs/go-bitswap/getter"
+	bsiq "github.com/ipfs/go-bitswap/inboundqueue"
 	bsmsg "github.com/ipfs/go-bitswap/message"
 	bsmq "github.com/ipfs/go-bitswap/messagequeue"
 	bsnet "github.com/ipfs/go-bitswap/network"
@@ -20,9 +21,11 @@ import (
 	bssession "github.com/ipfs/go-bitswap/session"
 	bssm "github.com/ipfs/go-bitswap/sessionmanager"
 	bsspm "github.com/ipfs/go-bitswap/sessionpeermanager"
+	bsul "github.com/ipfs/go-bitswap/uploadlimiter"
 	bswm "github.com/ipfs/go-bitswap/wantmanager"
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	delay "github.com/ipfs/go-ipfs-delay"
 	exchange "github.com/ipfs/go-ipfs-exchange-interface"
@@ -30,7 +33,7 @@ import (
 	logging "github.com/ipfs/go-log"
 	metrics "github.com/ipfs/go-metrics-interface"
 	process "github.com/jbenet/goprocess"
-	procctx "github.com/jbenet/goprocess/context"
+	ci "github.com/libp2p/go-libp2p-crypto"
 	peer "github.com/libp2p/go-libp2p-peer"
 )
 
@@ -51,31 +54,284 @@ const (
 	sizeBatchRequestChan = 32
 )
 
+// defaults for the options of the same name
 var (
 	HasBlockBufferSize    = 256
 	provideKeysBufferSize = 2048
 	provideWorkerMax      = 6
 
+	// maxQueuedMessagesPerPeer bounds how many received messages from a
+	// single peer may wait to be processed before further ones are dropped
+	maxQueuedMessagesPerPeer = 64
+
+	receiptInterval = 30 * time.Second
+
 	// the 1<<18+15 is to observe old file chunks that are 1<<18 + 14 in size
 	metricsBuckets = []float64{1 << 6, 1 << 10, 1 << 14, 1 << 18, 1<<18 + 15, 1 << 22}
 )
 
-func init() {
-	if flags.LowMemMode {
-		HasBlockBufferSize = 64
-		provideKeysBufferSize = 512
-		provideWorkerMax = 16
+// the defaults of the same options in low memory mode
+var (
+	lowMemHasBlockBufferSize    = 64
+	lowMemProvideKeysBufferSize = 512
+	lowMemProvideWorkerMax      = 16
+)
+
+// Option defines the functional option type that can be used to configure
+// bitswap instances
+type Option func(*Bitswap)
+
+// TaskWorkers sets the number of workers sending blocks to other peers.
+func TaskWorkers(n int) Option {
+	return func(bs *Bitswap) {
+		bs.taskWorkerCount = n
+	}
+}
+
+// InboundWorkers sets the number of workers processing messages received
+// from peers.
+func InboundWorkers(n int) Option {
+	return func(bs *Bitswap) {
+		bs.inboundWorkerCount = n
+	}
+}
+
+// ReceiveBlockWorkers sets the number of workers handling blocks received
+// from peers.
+func ReceiveBlockWorkers(n int) Option {
+	return func(bs *Bitswap) {
+		bs.receiveBlockWorkerCount = n
+	}
+}
+
+// ProvideWorkers sets the maximum number of provide announcements in flight.
+func ProvideWorkers(n int) Option {
+	return func(bs *Bitswap) {
+		bs.provideWorkerMax = n
+	}
+}
+
+// HasBlockBuffer sets how many added blocks may wait to be provided before
+// HasBlock blocks.
+func HasBlockBuffer(size int) Option {
+	return func(bs *Bitswap) {
+		bs.hasBlockBufferSize = size
+	}
+}
+
+// ProvideKeysBuffer sets how many keys may wait for a provide worker.
+func ProvideKeysBuffer(size int) Option {
+	return func(bs *Bitswap) {
+		bs.provideKeysBufferSize = size
+	}
+}
+
+// LowMemMode sets the added block and provide buffers and the provide
+// workers to their low memory defaults, or to the usual defaults if disabled.
+// It defaults to flags.LowMemMode, and the options after it override the
+// values it sets.
+func LowMemMode(enabled bool) Option {
+	return func(bs *Bitswap) {
+		if enabled {
+			bs.hasBlockBufferSize = lowMemHasBlockBufferSize
+			bs.provideKeysBufferSize = lowMemProvideKeysBufferSize
+			bs.provideWorkerMax = lowMemProvideWorkerMax
+		} else {
+			bs.hasBlockBufferSize = HasBlockBufferSize
+			bs.provideKeysBufferSize = provideKeysBufferSize
+			bs.provideWorkerMax = provideWorkerMax
+		}
+	}
+}
+
+// MaxQueuedMessagesPerPeer sets how many received messages from a single peer
+// may wait to be processed before further ones are dropped.
+func MaxQueuedMessagesPerPeer(n int) Option {
+	return func(bs *Bitswap) {
+		bs.maxQueuedMessagesPerPeer = n
+	}
+}
+
+// ProvideEnabled is an option for enabling/disabling provide announcements
+func ProvideEnabled(enabled bool) Option {
+	return func(bs *Bitswap) {
+		bs.provideEnabled = enabled
+	}
+}
+
+// RebroadcastDelay sets the interval on which the full wantlist is sent to
+// each peer again. It is read whenever a connection to a peer is set up.
+func RebroadcastDelay(newRebroadcastDelay delay.D) Option {
+	return func(bs *Bitswap) {
+		bs.rebroadcastDelay = newRebroadcastDelay
+	}
+}
+
+// ProviderSearchDelay overwrites the global provider search delay for the
+// sessions of this instance
+func ProviderSearchDelay(newProvSearchDelay time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.sessionOptions = append(bs.sessionOptions, bssession.ProviderSearchDelay(newProvSearchDelay))
+	}
+}
+
+// BroadcastLiveWantsLimit sets how many wants a session keeps live while it
+// has no peers to target.
+func BroadcastLiveWantsLimit(limit int) Option {
+	return func(bs *Bitswap) {
+		bs.sessionOptions = append(bs.sessionOptions, bssession.BroadcastLiveWantsLimit(limit))
+	}
+}
+
+// TargetedLiveWantsLimit sets how many wants a session keeps live once it has
+// peers to target.
+func TargetedLiveWantsLimit(limit int) Option {
+	return func(bs *Bitswap) {
+		bs.sessionOptions = append(bs.sessionOptions, bssession.TargetedLiveWantsLimit(limit))
+	}
+}
+
+// EngineMaxMessageSize sets the maximum size of the blocks the decision
+// engine batches into a single message.
+func EngineMaxMessageSize(size int) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.MaxMessageSize(size))
+	}
+}
+
+// EngineMaxWantlistEntries bounds the number of wants the decision engine
+// holds for each peer, evicting the lowest priority wants once it is full.
+// The default, zero, is unbounded.
+func EngineMaxWantlistEntries(n int) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.MaxWantlistEntries(n))
+	}
+}
+
+// EngineMaxWantlistBytes bounds the total size of the blocks the decision
+// engine holds wants for from each peer. The default, zero, is unbounded.
+func EngineMaxWantlistBytes(n int) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.MaxWantlistBytes(n))
+	}
+}
+
+// EngineServeFrom makes the decision engine serve the blocks of src rather
+// than those of the blockstore.
+func EngineServeFrom(src decision.BlockSource) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.ServeFrom(src))
+	}
+}
+
+// EngineBlockFetchWorkers sets the number of blocks the decision engine reads
+// from the blockstore concurrently.
+func EngineBlockFetchWorkers(n int) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.BlockFetchWorkers(n))
+	}
+}
+
+// EngineBlockReadAhead sets the number of tasks whose blocks the decision
+// engine reads from the blockstore before they are sent.
+func EngineBlockReadAhead(n int) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.BlockReadAhead(n))
+	}
+}
+
+// EngineSentBlockTTL sets how long the decision engine doesn't send a peer a
+// block again after sending it. The default, zero, disables the check.
+func EngineSentBlockTTL(ttl time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.SentBlockTTL(ttl))
+	}
+}
+
+// EngineLedgerStore persists the decision engine's ledgers in the given
+// datastore, so the accounting with peers survives reconnects and restarts.
+func EngineLedgerStore(d ds.Datastore) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.LedgerStore(d))
+	}
+}
+
+// EngineLedgerHalfLife makes the bytes exchanged with peers lose half their
+// weight in the decision engine's ledgers in the given time.
+func EngineLedgerHalfLife(halfLife time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.LedgerHalfLife(halfLife))
+	}
+}
+
+// ReceiptKey makes bitswap exchange signed receipts with its peers: it
+// periodically sends every peer that sent it data a receipt signed with the
+// given key, which must be the key of the local peer, and keeps the receipts
+// its peers send it.
+func ReceiptKey(sk ci.PrivKey) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.ReceiptKey(sk))
+		bs.receiptsEnabled = true
+	}
+}
+
+// ReceiptInterval sets how often receipts are sent to the peers that sent us
+// data since their last one.
+func ReceiptInterval(interval time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.receiptInterval = interval
+	}
+}
+
+// UploadLimit limits the bandwidth used to send blocks to all peers to
+// bytesPerSecond, letting up to burst bytes go out at once.
+func UploadLimit(bytesPerSecond, burst int) Option {
+	return func(bs *Bitswap) {
+		bs.uploadLimit = bsul.Limit{Rate: bytesPerSecond, Burst: burst}
+	}
+}
+
+// PeerUploadLimit limits the bandwidth used to send blocks to each peer to
+// bytesPerSecond, letting up to burst bytes go out at once.
+func PeerUploadLimit(bytesPerSecond, burst int) Option {
+	return func(bs *Bitswap) {
+		bs.peerUploadLimit = bsul.Limit{Rate: bytesPerSecond, Burst: burst}
+	}
+}
+
+// PeerUploadLimitFor replaces the PeerUploadLimit of a specific peer. A zero
+// bytesPerSecond exempts the peer.
+func PeerUploadLimitFor(p peer.ID, bytesPerSecond, burst int) Option {
+	return func(bs *Bitswap) {
+		if bs.peerUploadLimits == nil {
+			bs.peerUploadLimits = make(map[peer.ID]bsul.Limit)
+		}
+		bs.peerUploadLimits[p] = bsul.Limit{Rate: bytesPerSecond, Burst: burst}
+	}
+}
+
+// EngineAccessControl makes the decision engine only serve the blocks the
+// filter permits, answering the wants it denies as mode says.
+func EngineAccessControl(f decision.PeerFilter, mode decision.DenyMode) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.AccessControl(f, mode))
 	}
 }
 
-var rebroadcastDelay = delay.Fixed(time.Minute)
+// EngineStrategy sets the strategy the decision engine uses to decide which
+// peers to serve and in which order.
+func EngineStrategy(s decision.Strategy) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.ServingStrategy(s))
+	}
+}
 
 // New initializes a BitSwap instance that communicates over the provided
 // BitSwapNetwork. This function registers the returned instance as the network
 // delegate.
 // Runs until context is cancelled.
 func New(parent context.Context, network bsnet.BitSwapNetwork,
-	bstore blockstore.Blockstore) exchange.Interface {
+	bstore blockstore.Blockstore, options ...Option) exchange.Interface {
 
 	// important to use provided parent context (since it may include important
 	// loggable data). It's probably not a good idea to allow bitswap to be
@@ -94,47 +350,72 @@ func New(parent context.Context, network bsnet.BitSwapNetwork,
 	sentHistogram := metrics.NewCtx(ctx, "sent_all_blocks_bytes", "Histogram of blocks sent by"+
 		" this bitswap").Histogram(metricsBuckets)
 
-	px := process.WithTeardown(func() error {
-		return nil
-	})
+	bs := &Bitswap{
+		blockstore:               bstore,
+		network:                  network,
+		receivedBlocks:           make(chan receivedBlock),
+		counters:                 new(counters),
+		dupMetric:                dupHist,
+		allMetric:                allHist,
+		sentHistogram:            sentHistogram,
+		taskWorkerCount:          TaskWorkerCount,
+		inboundWorkerCount:       InboundWorkerCount,
+		receiveBlockWorkerCount:  ReceiveBlockWorkerCount,
+		maxQueuedMessagesPerPeer: maxQueuedMessagesPerPeer,
+		provideEnabled:           true,
+		receiptInterval:          receiptInterval,
+	}
+	LowMemMode(flags.LowMemMode)(bs)
+	for _, option := range options {
+		option(bs)
+	}
 
 	peerQueueFactory := func(ctx context.Context, p peer.ID) bspm.PeerQueue {
-		return bsmq.New(ctx, p, network)
+		mq := bsmq.New(ctx, p, network)
+		if bs.rebroadcastDelay != nil {
+			mq.SetRebroadcastInterval(bs.rebroadcastDelay.Get())
+		}
+		return mq
 	}
 
 	wm := bswm.New(ctx)
 	pqm := bspqm.New(ctx, network)
 
 	sessionFactory := func(ctx context.Context, id uint64, pm bssession.PeerManager, srs bssession.RequestSplitter) bssm.Session {
-		return bssession.New(ctx, id, wm, pm, srs)
+		return bssession.New(ctx, id, wm, pm, srs, bs.sessionOptions...)
 	}
 	sessionPeerManagerFactory := func(ctx context.Context, id uint64) bssession.PeerManager {
-		return bsspm.New(ctx, id, network.ConnectionManager(), pqm)
+		return bsspm.New(ctx, id, network.ConnectionManager(), pqm, bsspm.Connector(network))
 	}
 	sessionRequestSplitterFactory := func(ctx context.Context) bssession.RequestSplitter {
 		return bssrs.New(ctx)
 	}
 
-	bs := &Bitswap{
-		blockstore:    bstore,
-		engine:        decision.NewEngine(ctx, bstore), // TODO close the engine with Close() method
-		network:       network,
-		process:       px,
-		newBlocks:     make(chan cid.Cid, HasBlockBufferSize),
-		provideKeys:   make(chan cid.Cid, provideKeysBufferSize),
-		wm:            wm,
-		pqm:           pqm,
-		pm:            bspm.New(ctx, peerQueueFactory),
-		sm:            bssm.New(ctx, sessionFactory, sessionPeerManagerFactory, sessionRequestSplitterFactory),
-		counters:      new(counters),
-		dupMetric:     dupHist,
-		allMetric:     allHist,
-		sentHistogram: sentHistogram,
-	}
+	bs.uploadLimiter = bsul.New(bs.uploadLimit, bs.peerUploadLimit, bs.peerUploadLimits)
+	// peers over their upload limit are skipped rather than waited for
+	bs.engineOptions = append(bs.engineOptions, decision.Throttle(bs.uploadLimiter))
+	bs.engine = decision.NewEngine(ctx, bstore, bs.engineOptions...)
+	bs.newBlocks = make(chan cid.Cid, bs.hasBlockBufferSize)
+	bs.provideKeys = make(chan cid.Cid, bs.provideKeysBufferSize)
+	bs.wm = wm
+	bs.pqm = pqm
+	bs.pm = bspm.New(ctx, peerQueueFactory)
+	bs.sm = bssm.New(ctx, sessionFactory, sessionPeerManagerFactory, sessionRequestSplitterFactory)
+	bs.iq = bsiq.New(ctx, bs.receiveMessage, bs.inboundWorkerCount, bs.maxQueuedMessagesPerPeer)
+
+	// the workers started below stop when the process starts closing, after
+	// which the teardown shuts down the rest of bitswap
+	px := process.WithTeardown(func() error {
+		bs.shutdown()
+		cancelFunc()
+		return nil
+	})
+	bs.process = px
 
 	bs.wm.SetDelegate(bs.pm)
 	bs.wm.Startup()
 	bs.pqm.Startup()
+	bs.iq.Startup()
 	network.SetDelegate(bs)
 
 	// Start up bitswaps async worker routines
@@ -143,10 +424,12 @@ func New(parent context.Context, network bsnet.BitSwapNetwork,
 	// bind the context and process.
 	// do it over here to avoid closing before all setup is done.
 	go func() {
-		<-px.Closing() // process closes first
-		cancelFunc()
+		select {
+		case <-ctx.Done(): // parent cancelled first
+			px.Close()
+		case <-px.Closing(): // process closes first
+		}
 	}()
-	procctx.CloseAfterContext(px, ctx) // parent cancelled first
 
 	return bs
 }
@@ -166,6 +449,10 @@ type Bitswap struct {
 	// the engine is the bit of logic that decides who to send which blocks to
 	engine *decision.Engine
 
+	// the inbound queue buffers messages received from the network and
+	// processes them fairly across peers
+	iq *bsiq.InboundQueue
+
 	// network delivers messages on behalf of the session
 	network bsnet.BitSwapNetwork
 
@@ -180,6 +467,9 @@ type Bitswap struct {
 	// provideKeys directly feeds provide workers
 	provideKeys chan cid.Cid
 
+	// receivedBlocks feeds the workers handling blocks received from peers
+	receivedBlocks chan receivedBlock
+
 	process process.Process
 
 	// Counters for various statistics
@@ -193,6 +483,28 @@ type Bitswap struct {
 
 	// the sessionmanager manages tracking sessions
 	sm *bssm.SessionManager
+
+	// uploadLimiter holds back the blocks we send to stay within the upload
+	// bandwidth limits
+	uploadLimiter *bsul.UploadLimiter
+
+	// configuration, set by options
+	taskWorkerCount          int
+	inboundWorkerCount       int
+	receiveBlockWorkerCount  int
+	provideWorkerMax         int
+	hasBlockBufferSize       int
+	provideKeysBufferSize    int
+	maxQueuedMessagesPerPeer int
+	provideEnabled           bool
+	rebroadcastDelay         delay.D
+	receiptsEnabled          bool
+	receiptInterval          time.Duration
+	uploadLimit              bsul.Limit
+	peerUploadLimit          bsul.Limit
+	peerUploadLimits         map[peer.ID]bsul.Limit
+	sessionOptions           []bssession.Option
+	engineOptions            []decision.Option
 }
 
 type counters struct {
@@ -205,6 +517,13 @@ type counters struct {
 	messagesRecvd  uint64
 }
 
+type receivedBlock struct {
+	ctx  context.Context
+	from peer.ID
+	blk  blocks.Block
+	wg   *sync.WaitGroup
+}
+
 type blockRequest struct {
 	Cid cid.Cid
 	Ctx context.Context
@@ -228,6 +547,12 @@ func (bs *Bitswap) LedgerForPeer(p peer.ID) *decision.Receipt {
 	return bs.engine.LedgerForPeer(p)
 }
 
+// ReceiptFromPeer returns the latest receipt the peer signed for the data
+// it exchanged with us, nil if it never sent one.
+func (bs *Bitswap) ReceiptFromPeer(p peer.ID) *decision.PeerReceipt {
+	return bs.engine.ReceiptFromPeer(p)
+}
+
 // GetBlocks returns a channel where the caller may receive blocks that
 // correspond to the provided |keys|. Returns an error if BitSwap is unable to
 // begin this request within the deadline enforced by the context.
@@ -240,6 +565,36 @@ func (bs *Bitswap) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks
 	return session.GetBlocks(ctx, keys)
 }
 
+// FetchBlocks is like GetBlocks, but returns a channel with a result for
+// each of the keys, repeats included: the block, or why it could not be
+// fetched by the time ctx ended.
+func (bs *Bitswap) FetchBlocks(ctx context.Context, keys []cid.Cid) (<-chan bsgetter.Result, error) {
+	// the session outlives ctx until it told why the blocks weren't fetched
+	sesctx, cancel := context.WithCancel(context.Background())
+	session := bs.sm.NewSession(sesctx).(*bssession.Session)
+	results, err := session.FetchBlocks(ctx, keys)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	out := make(chan bsgetter.Result, len(keys))
+	go func() {
+		defer cancel()
+		defer close(out)
+		for r := range results {
+			out <- r
+		}
+	}()
+	return out, nil
+}
+
+// GetBlocksFrom is like GetBlocks, but the blocks are asked of the given
+// providers right away, without waiting to discover them.
+func (bs *Bitswap) GetBlocksFrom(ctx context.Context, keys []cid.Cid, providers []peer.ID) (<-chan blocks.Block, error) {
+	session := bs.sm.NewSessionWithPeers(ctx, providers)
+	return session.GetBlocks(ctx, keys)
+}
+
 // HasBlock announces the existence of a block to this bitswap service. The
 // service will potentially notify its peers.
 func (bs *Bitswap) HasBlock(blk blocks.Block) error {
@@ -273,6 +628,10 @@ func (bs *Bitswap) receiveBlockFrom(blk blocks.Block, from peer.ID) error {
 
 	bs.engine.AddBlock(blk)
 
+	if !bs.provideEnabled {
+		return nil
+	}
+
 	select {
 	case bs.newBlocks <- blk.Cid():
 		// send block off to be reprovided
@@ -282,7 +641,12 @@ func (bs *Bitswap) receiveBlockFrom(blk blocks.Block, from peer.ID) error {
 	return nil
 }
 
+// ReceiveMessage queues a message received from the network for processing.
 func (bs *Bitswap) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage) {
+	bs.iq.Enqueue(ctx, p, incoming)
+}
+
+func (bs *Bitswap) receiveMessage(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage) {
 	bs.counterLk.Lock()
 	bs.counters.messagesRecvd++
 	bs.counterLk.Unlock()
@@ -293,35 +657,47 @@ func (bs *Bitswap) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg
 	// TODO: this is bad, and could be easily abused.
 	// Should only track *useful* messages in ledger
 
+	haves := incoming.Haves()
+	dontHaves := incoming.DontHaves()
+	notPermitted := incoming.NotPermitted()
+	if len(haves) > 0 || len(dontHaves) > 0 || len(notPermitted) > 0 {
+		bs.sm.ReceivePresencesFrom(p, haves, dontHaves, notPermitted)
+	}
+
 	iblocks := incoming.Blocks()
 
 	if len(iblocks) == 0 {
 		return
 	}
 
+	// hand the blocks to the block workers, and wait for them to be handled
+	// before taking on the next message
 	wg := sync.WaitGroup{}
 	for _, block := range iblocks {
-
 		wg.Add(1)
-		go func(b blocks.Block) { // TODO: this probably doesnt need to be a goroutine...
-			defer wg.Done()
+		select {
+		case bs.receivedBlocks <- receivedBlock{ctx, p, block, &wg}:
+		case <-bs.process.Closing():
+			wg.Done()
+		}
+	}
+	wg.Wait()
+}
 
-			bs.updateReceiveCounters(b)
-			bs.sm.UpdateReceiveCounters(b)
-			log.Debugf("got block %s from %s", b, p)
+func (bs *Bitswap) handleReceivedBlock(ctx context.Context, p peer.ID, b blocks.Block) {
+	bs.updateReceiveCounters(b)
+	bs.sm.UpdateReceiveCounters(b)
+	log.Debugf("got block %s from %s", b, p)
 
-			// skip received blocks that are not in the wantlist
-			if !bs.wm.IsWanted(b.Cid()) {
-				return
-			}
+	// skip received blocks that are not in the wantlist
+	if !bs.wm.IsWanted(b.Cid()) {
+		return
+	}
 
-			if err := bs.receiveBlockFrom(b, p); err != nil {
-				log.Warningf("ReceiveMessage recvBlockFrom error: %s", err)
-			}
-			log.Event(ctx, "Bitswap.GetBlockRequest.End", b.Cid())
-		}(block)
+	if err := bs.receiveBlockFrom(b, p); err != nil {
+		log.Warningf("ReceiveMessage recvBlockFrom error: %s", err)
 	}
-	wg.Wait()
+	log.Event(ctx, "Bitswap.GetBlockRequest.End", b.Cid())
 }
 
 var ErrAlreadyHaveBlock = errors.New("already have block")
@@ -361,6 +737,7 @@ func (bs *Bitswap) PeerConnected(p peer.ID) {
 func (bs *Bitswap) PeerDisconnected(p peer.ID) {
 	bs.wm.Disconnected(p)
 	bs.engine.PeerDisconnected(p)
+	bs.uploadLimiter.PeerGone(p)
 }
 
 func (bs *Bitswap) ReceiveError(err error) {
@@ -369,10 +746,26 @@ func (bs *Bitswap) ReceiveError(err error) {
 	// TODO bubble the network error up to the parent context/error logger
 }
 
+// Close shuts bitswap down and returns once all of its goroutines have
+// exited. Workers finish the message they are sending, sessions cancel their
+// outstanding wants and the peer queues send those cancels before closing
+// their streams.
 func (bs *Bitswap) Close() error {
 	return bs.process.Close()
 }
 
+// shutdown stops the components of bitswap, in the order that lets the
+// cancels for outstanding wants reach the peers. It runs once the workers
+// have stopped.
+func (bs *Bitswap) shutdown() {
+	bs.iq.Shutdown()
+	bs.sm.Shutdown()
+	bs.wm.Shutdown()
+	bs.pm.Shutdown()
+	bs.engine.Close()
+	bs.pqm.Shutdown()
+}
+
 func (bs *Bitswap) GetWantlist() []cid.Cid {
 	entries := bs.wm.CurrentWants()
 	out := make([]cid.Cid, 0, len(entries))
@@ -389,3 +782,9 @@ func (bs *Bitswap) IsOnline() bool {
 func (bs *Bitswap) NewSession(ctx context.Context) exchange.Fetcher {
 	return bs.sm.NewSession(ctx)
 }
+
+// NewSessionWithPeers creates a session that asks the given peers, known to
+// have the blocks it will fetch, for them right away.
+func (bs *Bitswap) NewSessionWithPeers(ctx context.Context, peers []peer.ID) exchange.Fetcher {
+	return bs.sm.NewSessionWithPeers(ctx, peers)
+}
@@ -3,13 +3,19 @@ package bitswap
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	decision "github.com/ipfs/go-bitswap/decision"
+	bsgetter "github.com/ipfs/go-bitswap/getter"
 	"github.com/ipfs/go-bitswap/message"
+	bsnet "github.com/ipfs/go-bitswap/network"
 	tn "github.com/ipfs/go-bitswap/testnet"
 
 	blocks "github.com/ipfs/go-block-format"
@@ -19,7 +25,9 @@ import (
 	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
 	delay "github.com/ipfs/go-ipfs-delay"
 	mockrouting "github.com/ipfs/go-ipfs-routing/mock"
+	ci "github.com/libp2p/go-libp2p-crypto"
 	p2ptestutil "github.com/libp2p/go-libp2p-netutil"
+	peer "github.com/libp2p/go-libp2p-peer"
 	tu "github.com/libp2p/go-testutil"
 	travis "github.com/libp2p/go-testutil/ci/travis"
 )
@@ -45,6 +53,119 @@ func TestClose(t *testing.T) {
 	bitswap.Exchange.GetBlock(context.Background(), block.Cid())
 }
 
+// bitswapGoroutines returns the stacks of the goroutines running bitswap code
+// outside of tests and the test network, by goroutine header.
+func bitswapGoroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	out := make(map[string]string)
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "testing.tRunner") {
+			continue
+		}
+		lines := strings.Split(g, "\n")
+		for _, l := range lines[1:] {
+			if strings.HasPrefix(l, "github.com/ipfs/go-bitswap") &&
+				!strings.HasPrefix(l, "github.com/ipfs/go-bitswap/testnet") {
+				// the header holds the goroutine id and its state, only
+				// keep the id
+				out[strings.SplitN(lines[0], " [", 2)[0]] = g
+				break
+			}
+		}
+	}
+	return out
+}
+
+func TestCloseStopsAllGoroutines(t *testing.T) {
+	before := bitswapGoroutines()
+
+	vnet := getVirtualNetwork()
+	sesgen := NewTestSessionGenerator(vnet)
+	defer sesgen.Close()
+	bgen := blocksutil.NewBlockGenerator()
+
+	instances := sesgen.Instances(2)
+	blks := bgen.Blocks(2)
+	if err := instances[0].Exchange.HasBlock(blks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := instances[1].Exchange.GetBlock(ctx, blks[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	// leave a want outstanding, in a session of its own
+	if _, err := instances[1].Exchange.NewSession(ctx).GetBlocks(ctx, []cid.Cid{blks[1].Cid()}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inst := range instances {
+		if err := inst.Exchange.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// goroutines may still be returning after signalling they are done
+	var leaked []string
+	for i := 0; i < 50; i++ {
+		leaked = nil
+		for id, g := range bitswapGoroutines() {
+			if _, ok := before[id]; !ok {
+				leaked = append(leaked, g)
+			}
+		}
+		if len(leaked) == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%d goroutines still running after close:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+}
+
+func TestCloseCancelsWants(t *testing.T) {
+	vnet := getVirtualNetwork()
+	sesgen := NewTestSessionGenerator(vnet)
+	defer sesgen.Close()
+	bgen := blocksutil.NewBlockGenerator()
+
+	instances := sesgen.Instances(2)
+	a, b := instances[0], instances[1]
+	defer a.Exchange.Close()
+
+	blk := bgen.Next()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := b.Exchange.GetBlocks(ctx, []cid.Cid{blk.Cid()}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForWantlist := func(n int) {
+		for i := 0; i < 100; i++ {
+			if len(a.Exchange.WantlistForPeer(b.Peer)) == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %d wants from peer, got %d", n, len(a.Exchange.WantlistForPeer(b.Peer)))
+	}
+
+	waitForWantlist(1)
+	if err := b.Exchange.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitForWantlist(0)
+}
+
 func TestProviderForKeyButNetworkCannotFind(t *testing.T) { // TODO revisit this
 
 	rs := mockrouting.NewServer()
@@ -99,6 +220,37 @@ func TestGetBlockFromPeerAfterPeerAnnounces(t *testing.T) {
 	}
 }
 
+func TestGetBlockOverTCP(t *testing.T) {
+
+	net := tn.TCPNet()
+	block := blocks.NewBlock([]byte("block"))
+	g := NewTestSessionGenerator(net)
+	defer g.Close()
+
+	peers := g.Instances(2)
+	hasBlock := peers[0]
+	defer hasBlock.Exchange.Close()
+
+	if err := hasBlock.Exchange.HasBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	wantsBlock := peers[1]
+	defer wantsBlock.Exchange.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	received, err := wantsBlock.Exchange.GetBlock(ctx, block.Cid())
+	if err != nil {
+		t.Log(err)
+		t.Fatal("Expected to succeed")
+	}
+
+	if !bytes.Equal(block.RawData(), received.RawData()) {
+		t.Fatal("Data doesn't match")
+	}
+}
+
 func TestUnwantedBlockNotAdded(t *testing.T) {
 
 	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
@@ -164,15 +316,13 @@ func TestLargeFile(t *testing.T) {
 }
 
 func TestLargeFileNoRebroadcast(t *testing.T) {
-	rbd := rebroadcastDelay.Get()
-	rebroadcastDelay.Set(time.Hour * 24 * 365 * 10) // ten years should be long enough
 	if testing.Short() {
 		t.SkipNow()
 	}
 	numInstances := 10
 	numBlocks := 100
-	PerformDistributionTest(t, numInstances, numBlocks)
-	rebroadcastDelay.Set(rbd)
+	// ten years should be long enough
+	PerformDistributionTest(t, numInstances, numBlocks, RebroadcastDelay(delay.Fixed(time.Hour*24*365*10)))
 }
 
 func TestLargeFileTwoPeers(t *testing.T) {
@@ -184,13 +334,13 @@ func TestLargeFileTwoPeers(t *testing.T) {
 	PerformDistributionTest(t, numInstances, numBlocks)
 }
 
-func PerformDistributionTest(t *testing.T, numInstances, numBlocks int) {
+func PerformDistributionTest(t *testing.T, numInstances, numBlocks int, bsOptions ...Option) {
 	ctx := context.Background()
 	if testing.Short() {
 		t.SkipNow()
 	}
 	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
-	sg := NewTestSessionGenerator(net)
+	sg := NewTestSessionGenerator(net, bsOptions...)
 	defer sg.Close()
 	bg := blocksutil.NewBlockGenerator()
 
@@ -266,13 +416,10 @@ func TestSendToWantingPeer(t *testing.T) {
 	}
 
 	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
-	sg := NewTestSessionGenerator(net)
+	sg := NewTestSessionGenerator(net, RebroadcastDelay(delay.Fixed(time.Second/2)))
 	defer sg.Close()
 	bg := blocksutil.NewBlockGenerator()
 
-	prev := rebroadcastDelay.Set(time.Second / 2)
-	defer func() { rebroadcastDelay.Set(prev) }()
-
 	peers := sg.Instances(2)
 	peerA := peers[0]
 	peerB := peers[1]
@@ -309,6 +456,149 @@ func TestSendToWantingPeer(t *testing.T) {
 
 }
 
+// failingNetwork fails the first sends of blocks.
+type failingNetwork struct {
+	bsnet.BitSwapNetwork
+	failures int32
+}
+
+func (n *failingNetwork) SendMessage(ctx context.Context, p peer.ID, m message.BitSwapMessage) error {
+	if len(m.Blocks()) > 0 && atomic.AddInt32(&n.failures, -1) >= 0 {
+		return errors.New("send failed")
+	}
+	return n.BitSwapNetwork.SendMessage(ctx, p, m)
+}
+
+func TestFailedSendNotSuppressed(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net, RebroadcastDelay(delay.Fixed(100*time.Millisecond)),
+		EngineSentBlockTTL(time.Minute))
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	peers := sg.Instances(2)
+	a, b := peers[0], peers[1]
+	a.Exchange.network = &failingNetwork{BitSwapNetwork: a.Exchange.network, failures: 1}
+
+	block := bg.Next()
+	if err := a.Exchange.HasBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	// the block the failed send didn't deliver is sent again when b
+	// rebroadcasts its want, well within the sent block TTL
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := b.Exchange.GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := a.Exchange.Stat(); err != nil {
+		t.Fatal(err)
+	} else if st.BlocksSent != 1 {
+		t.Fatal("expected only the delivered block to count as sent, got", st.BlocksSent)
+	}
+}
+
+func TestLowMemModePerInstance(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	lowMem := NewTestSessionGenerator(net, LowMemMode(true))
+	defer lowMem.Close()
+	usual := NewTestSessionGenerator(net, LowMemMode(false))
+	defer usual.Close()
+
+	a := lowMem.Next().Exchange
+	b := usual.Next().Exchange
+	if cap(a.newBlocks) != lowMemHasBlockBufferSize || a.provideWorkerMax != lowMemProvideWorkerMax {
+		t.Fatal("expected low memory defaults")
+	}
+	if cap(b.newBlocks) != HasBlockBufferSize || b.provideWorkerMax != provideWorkerMax {
+		t.Fatal("expected low memory mode of another instance not to apply")
+	}
+}
+
+func TestProvideDisabled(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net, ProvideEnabled(false), ProviderSearchDelay(10*time.Millisecond))
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	// the instances are not connected, so the block can only be found
+	// through a provider record
+	a := sg.Next()
+	b := sg.Next()
+
+	blk := bg.Next()
+	if err := a.Exchange.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := b.Exchange.GetBlock(ctx, blk.Cid()); err != context.DeadlineExceeded {
+		t.Fatalf("expected block not to be found, got %v", err)
+	}
+}
+
+func TestGetBlocksFromProviders(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net, ProvideEnabled(false))
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	// the instances are not connected and there is no provider record, the
+	// block is only found by asking the given provider
+	a := sg.Next()
+	b := sg.Next()
+
+	blk := bg.Next()
+	if err := a.Exchange.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	out, err := b.Exchange.GetBlocksFrom(ctx, []cid.Cid{blk.Cid()}, []peer.ID{a.Peer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case received := <-out:
+		if received == nil || !received.Cid().Equals(blk.Cid()) {
+			t.Fatal("got wrong block")
+		}
+	case <-ctx.Done():
+		t.Fatal("block was not fetched from the provider")
+	}
+}
+
+func TestFetchBlocksReportsRejection(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	deny := decision.PeerFilterFunc(func(peer.ID, cid.Cid) bool { return false })
+	sg := NewTestSessionGenerator(net, EngineAccessControl(deny, decision.DenyNotPermitted))
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	instances := sg.Instances(2)
+	blk := bg.Next()
+	if err := instances[0].Exchange.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results, err := instances[1].Exchange.FetchBlocks(ctx, []cid.Cid{blk.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := <-results
+	if !ok {
+		t.Fatal("expected a result")
+	}
+	if r.Err == nil || !errors.Is(r.Err, bsgetter.ErrRejected) {
+		t.Fatal("expected the block to be rejected, got", r.Err)
+	}
+}
+
 func TestEmptyKey(t *testing.T) {
 	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
 	sg := NewTestSessionGenerator(net)
@@ -705,3 +995,90 @@ func TestBitswapLedgerTwoWay(t *testing.T) {
 		}
 	}
 }
+
+func TestReceiptsSentForReceivedData(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	mkInstance := func() Instance {
+		sk, pk, err := ci.GenerateKeyPair(ci.Ed25519, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := peer.IDFromPrivateKey(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ident := tu.NewIdentity(p, tu.RandLocalTCPAddress(), sk, pk)
+		return MkSession(ctx, net, ident, ReceiptKey(sk), ReceiptInterval(20*time.Millisecond))
+	}
+	provider := mkInstance()
+	defer provider.Exchange.Close()
+	fetcher := mkInstance()
+	defer fetcher.Exchange.Close()
+	if err := fetcher.Exchange.network.ConnectTo(ctx, provider.Peer); err != nil {
+		t.Fatal(err)
+	}
+
+	blk := blocks.NewBlock([]byte("paid for"))
+	if err := provider.Exchange.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+	getCtx, getCancel := context.WithTimeout(ctx, time.Second)
+	defer getCancel()
+	if _, err := fetcher.Exchange.GetBlock(getCtx, blk.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		r := provider.Exchange.ReceiptFromPeer(fetcher.Peer)
+		if r != nil && r.Received == uint64(len(blk.RawData())) {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("expected the fetcher to acknowledge the block, got", r)
+		}
+	}
+	if fetcher.Exchange.ReceiptFromPeer(provider.Peer) != nil {
+		t.Fatal("expected no receipt from a peer that received nothing")
+	}
+}
+
+func TestPeerUploadLimit(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net, PeerUploadLimit(10000, 1000))
+	defer sg.Close()
+	instances := sg.Instances(2)
+	provider, fetcher := instances[0], instances[1]
+
+	var keys []cid.Cid
+	for i := 0; i < 3; i++ {
+		blk := blocks.NewBlock(bytes.Repeat([]byte{byte(i)}, 2000))
+		if err := provider.Exchange.HasBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, blk.Cid())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	for _, k := range keys {
+		if _, err := fetcher.Exchange.GetBlock(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every block puts the provider 1000 bytes over the burst, so the second
+	// block waits 0.1s and the third 0.2s more
+	if elapsed := time.Since(start); elapsed < 280*time.Millisecond {
+		t.Fatal("expected blocks to be sent within the upload limit, took", elapsed)
+	}
+
+	st, err := provider.Exchange.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.UploadThrottledSends == 0 || st.UploadThrottled == 0 {
+		t.Fatal("expected throttled sends to show in stats")
+	}
+}
@@ -160,9 +160,8 @@ func TestFetchNotConnected(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	bssession.SetProviderSearchDelay(10 * time.Millisecond)
 	vnet := getVirtualNetwork()
-	sesgen := NewTestSessionGenerator(vnet)
+	sesgen := NewTestSessionGenerator(vnet, ProviderSearchDelay(10*time.Millisecond))
 	defer sesgen.Close()
 	bgen := blocksutil.NewBlockGenerator()
 
@@ -15,7 +15,7 @@ import (
 // FWIW: At the time of this commit, including a timestamp in task increases
 // time cost of Push by 3%.
 func BenchmarkTaskQueuePush(b *testing.B) {
-	q := newPRQ()
+	q := newPRQ(WantlistPriority)
 	peers := []peer.ID{
 		testutil.RandPeerIDFatal(b),
 		testutil.RandPeerIDFatal(b),
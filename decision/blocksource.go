@@ -0,0 +1,79 @@
+package decision
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// BlockSource provides the blocks the engine serves. The blocks may be held
+// locally or produced on demand. Methods return bstore.ErrNotFound for the
+// blocks the source can't provide, and must be safe for concurrent use.
+type BlockSource interface {
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+	GetSize(ctx context.Context, c cid.Cid) (int, error)
+	Get(ctx context.Context, c cid.Cid) (blocks.Block, error)
+}
+
+// FromBlockstore returns a BlockSource serving the blocks of a blockstore.
+func FromBlockstore(bs bstore.Blockstore) BlockSource {
+	return blockstoreSource{bs}
+}
+
+type blockstoreSource struct {
+	bs bstore.Blockstore
+}
+
+func (s blockstoreSource) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return s.bs.Has(c)
+}
+
+func (s blockstoreSource) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	return s.bs.GetSize(c)
+}
+
+func (s blockstoreSource) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return s.bs.Get(c)
+}
+
+// Tiered returns a BlockSource looking blocks up in each of the given
+// sources in turn, typically a fast cache before slower storage. A block is
+// taken from the first source that has it, errors other than
+// bstore.ErrNotFound stop the lookup.
+func Tiered(tiers ...BlockSource) BlockSource {
+	return tiered(tiers)
+}
+
+type tiered []BlockSource
+
+func (t tiered) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	for _, s := range t {
+		has, err := s.Has(ctx, c)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+func (t tiered) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	for _, s := range t {
+		size, err := s.GetSize(ctx, c)
+		if err != bstore.ErrNotFound {
+			return size, err
+		}
+	}
+	return -1, bstore.ErrNotFound
+}
+
+func (t tiered) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	for _, s := range t {
+		block, err := s.Get(ctx, c)
+		if err != bstore.ErrNotFound {
+			return block, err
+		}
+	}
+	return nil, bstore.ErrNotFound
+}
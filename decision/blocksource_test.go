@@ -0,0 +1,92 @@
+package decision
+
+import (
+	"context"
+	"testing"
+
+	message "github.com/ipfs/go-bitswap/message"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	testutil "github.com/libp2p/go-testutil"
+)
+
+// generatedSource produces the blocks it knows the data of on demand.
+type generatedSource map[cid.Cid][]byte
+
+func (s generatedSource) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	_, ok := s[c]
+	return ok, nil
+}
+
+func (s generatedSource) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	data, ok := s[c]
+	if !ok {
+		return -1, blockstore.ErrNotFound
+	}
+	return len(data), nil
+}
+
+func (s generatedSource) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	data, ok := s[c]
+	if !ok {
+		return nil, blockstore.ErrNotFound
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func TestTieredSource(t *testing.T) {
+	ctx := context.Background()
+	hot := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	cached := blocks.NewBlock([]byte("cached"))
+	if err := hot.Put(cached); err != nil {
+		t.Fatal(err)
+	}
+	stored := blocks.NewBlock([]byte("stored"))
+	cold := generatedSource{stored.Cid(): stored.RawData()}
+	src := Tiered(FromBlockstore(hot), cold)
+
+	for _, b := range []blocks.Block{cached, stored} {
+		if has, err := src.Has(ctx, b.Cid()); err != nil || !has {
+			t.Fatal("expected tiered source to have", b.Cid(), err)
+		}
+		if size, err := src.GetSize(ctx, b.Cid()); err != nil || size != len(b.RawData()) {
+			t.Fatal("expected size of", b.Cid(), size, err)
+		}
+		if got, err := src.Get(ctx, b.Cid()); err != nil || !got.Cid().Equals(b.Cid()) {
+			t.Fatal("expected to get", b.Cid(), err)
+		}
+	}
+
+	missing := blocks.NewBlock([]byte("missing")).Cid()
+	if has, err := src.Has(ctx, missing); err != nil || has {
+		t.Fatal("expected tiered source not to have missing block", err)
+	}
+	if _, err := src.GetSize(ctx, missing); err != blockstore.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got", err)
+	}
+	if _, err := src.Get(ctx, missing); err != blockstore.ErrNotFound {
+		t.Fatal("expected ErrNotFound, got", err)
+	}
+}
+
+func TestServeFromSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	block := blocks.NewBlock([]byte("generated"))
+	e := NewEngine(ctx, nil, ServeFrom(generatedSource{block.Cid(): block.RawData()}))
+	partner := testutil.RandPeerIDFatal(t)
+
+	m := message.New(false)
+	m.AddEntry(block.Cid(), 1)
+	e.MessageReceived(partner, m)
+
+	envelope := nextEnvelope(t, e)
+	received := envelope.Message.Blocks()
+	if len(received) != 1 || !received[0].Cid().Equals(block.Cid()) {
+		t.Fatal("expected the generated block to be sent")
+	}
+}
@@ -3,15 +3,22 @@ package decision
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	wl "github.com/ipfs/go-bitswap/wantlist"
 
 	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	namespace "github.com/ipfs/go-datastore/namespace"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log"
+	ci "github.com/libp2p/go-libp2p-crypto"
 	peer "github.com/libp2p/go-libp2p-peer"
 )
 
@@ -52,8 +59,15 @@ var log = logging.Logger("engine")
 const (
 	// outboxChanBuffer must be 0 to prevent stale messages from being sent
 	outboxChanBuffer = 0
-	// maxMessageSize is the maximum size of the batched payload
+	// maxMessageSize is the default maximum size of the batched payload
 	maxMessageSize = 512 * 1024
+	// ledgerFlushInterval is the default interval between ledger flushes
+	ledgerFlushInterval = time.Minute
+	// blockFetchWorkers is the default number of concurrent block reads
+	blockFetchWorkers = 8
+	// blockReadAhead is the default number of tasks prefetched ahead of the
+	// outbox
+	blockReadAhead = 4
 )
 
 // Envelope contains a message for a Peer.
@@ -85,28 +99,284 @@ type Engine struct {
 	// taskWorker goroutine
 	outbox chan (<-chan *Envelope)
 
-	bs bstore.Blockstore
+	// bs provides the blocks we serve
+	bs BlockSource
+
+	// prefetched hands the tasks popped by the prefetchWorker to the
+	// taskWorker, its buffer is the read-ahead. fetches hands the blocks to
+	// read to the fetch workers.
+	prefetched        chan *prefetchedTask
+	fetches           chan blockFetch
+	blockFetchWorkers int
+	blockReadAhead    int
 
 	lock sync.Mutex // protects the fields immediatly below
 	// ledgerMap lists Ledgers by their Partner key.
 	ledgerMap map[peer.ID]*ledger
+	// unstored holds the records of the ledgers of disconnected peers until
+	// they are written to the ledger store
+	unstored map[peer.ID]*ledgerRecord
+	// dropped counts the dropped ledgers, a ledger loaded while one was
+	// dropped may be stale
+	dropped uint64
 
 	ticker *time.Ticker
+
+	// ctx is cancelled when the engine closes, cancel stops the engine's
+	// goroutines, running tracks them
+	ctx     context.Context
+	cancel  func()
+	running sync.WaitGroup
+
+	// maxMessageSize bounds the size of the blocks batched into one message
+	maxMessageSize int
+
+	// maxWantlistEntries and maxWantlistBytes bound the number of wants
+	// held for each peer and the size of their answers, zero if unbounded
+	maxWantlistEntries int
+	maxWantlistBytes   int
+
+	// sentBlockTTL is how long we don't send a block to a peer again after
+	// sending it, zero if we always do. suppressedSends counts the sends it
+	// avoided, accessed atomically.
+	sentBlockTTL    time.Duration
+	suppressedSends uint64
+	// requeues holds the timers queueing the suppressed wants again once
+	// the TTL is over, nil once the engine is closed
+	requeueLk sync.Mutex
+	requeues  map[*time.Timer]struct{}
+
+	// strategy decides whom to serve and in which order
+	strategy Strategy
+	// throttle limits the bytes sent to each peer, nil if unlimited
+	throttle Throttler
+
+	// ledgerStore persists the ledgers, nil if they are only kept in memory.
+	// storeLock serializes storing ledgers.
+	ledgerStore ds.Datastore
+	storeLock   sync.Mutex
+	// ledgerFlushInterval is how often modified ledgers are stored
+	ledgerFlushInterval time.Duration
+	// ledgerHalfLife is the time in which the bytes exchanged with a peer
+	// lose half their weight, zero if they don't decay
+	ledgerHalfLife time.Duration
+
+	// receiptKey signs the receipts we send peers, nil if we don't exchange
+	// receipts. self is the peer it identifies.
+	receiptKey ci.PrivKey
+	self       peer.ID
+
+	// peerFilter decides which blocks peers may get, nil if they may get
+	// all of them. denyMode is how denied wants are answered.
+	peerFilter PeerFilter
+	denyMode   DenyMode
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// MaxMessageSize sets the maximum size of the blocks the engine batches into
+// a single message to a peer.
+func MaxMessageSize(size int) Option {
+	return func(e *Engine) {
+		e.maxMessageSize = size
+	}
+}
+
+// MaxWantlistEntries bounds the number of wants the engine holds for each
+// peer. Once a peer's wantlist is full, new wants replace the lowest priority
+// ones, or are dropped if they have the lowest priority. Zero is unbounded,
+// the default.
+func MaxWantlistEntries(n int) Option {
+	return func(e *Engine) {
+		e.maxWantlistEntries = n
+	}
+}
+
+// MaxWantlistBytes bounds the total size of the blocks the engine holds
+// wants for from each peer, evicting wants like MaxWantlistEntries. Zero is
+// unbounded, the default.
+func MaxWantlistBytes(n int) Option {
+	return func(e *Engine) {
+		e.maxWantlistBytes = n
+	}
+}
+
+// ServeFrom makes the engine serve the blocks of src rather than those of
+// the blockstore it was created with, which may then be nil.
+func ServeFrom(src BlockSource) Option {
+	return func(e *Engine) {
+		e.bs = src
+	}
+}
+
+// BlockFetchWorkers sets the number of blocks the engine reads from the
+// block source concurrently.
+func BlockFetchWorkers(n int) Option {
+	return func(e *Engine) {
+		e.blockFetchWorkers = n
+	}
+}
+
+// BlockReadAhead sets the number of tasks whose blocks the engine reads from
+// the block source before they are taken from the outbox.
+func BlockReadAhead(n int) Option {
+	return func(e *Engine) {
+		e.blockReadAhead = n
+	}
+}
+
+// Throttler limits the bytes sent to each peer, such as an upload limiter.
+type Throttler interface {
+	// Ready reports whether p can be sent blocks right now.
+	Ready(p peer.ID) bool
+	// Reserve counts n bytes about to be sent to p against its limit.
+	Reserve(p peer.ID, n int)
+	// Refund gives back n bytes reserved for p that weren't sent.
+	Refund(p peer.ID, n int)
+}
+
+// Throttle makes the engine skip the peers t reports can't be sent blocks
+// right now when selecting the next task. The peers keep their place in the
+// queue and are checked again on the next selection. The blocks of a task
+// are reserved with t as soon as it is selected, ahead of the outbox taking
+// it, and the bytes that end up not being sent are refunded.
+func Throttle(t Throttler) Option {
+	return func(e *Engine) {
+		e.throttle = t
+	}
+}
+
+// SentBlockTTL sets how long the engine doesn't send a peer a block again
+// after sending it, even if the peer wants it again. The default, zero,
+// disables the check. The TTL should be longer than the peers' wantlist
+// rebroadcast interval.
+func SentBlockTTL(ttl time.Duration) Option {
+	return func(e *Engine) {
+		e.sentBlockTTL = ttl
+	}
+}
+
+// LedgerStore persists the ledgers in the given datastore, so the accounting
+// of the exchanges with peers survives disconnects and restarts.
+func LedgerStore(d ds.Datastore) Option {
+	return func(e *Engine) {
+		e.ledgerStore = namespace.Wrap(d, ds.NewKey("/bitswap/ledgers"))
+	}
+}
+
+// LedgerFlushInterval sets how often the ledgers modified since the last
+// flush are written to the ledger store.
+func LedgerFlushInterval(interval time.Duration) Option {
+	return func(e *Engine) {
+		e.ledgerFlushInterval = interval
+	}
+}
+
+// LedgerHalfLife makes the bytes exchanged with peers decay, losing half
+// their weight in the given time. By default they never decay.
+func LedgerHalfLife(halfLife time.Duration) Option {
+	return func(e *Engine) {
+		e.ledgerHalfLife = halfLife
+	}
+}
+
+// ReceiptKey makes the engine sign receipts for the data peers send us with
+// the given key, which must be the key of the local peer, and accept the
+// receipts peers send us.
+func ReceiptKey(sk ci.PrivKey) Option {
+	return func(e *Engine) {
+		e.receiptKey = sk
+	}
+}
+
+// AccessControl makes the engine only serve the blocks the filter permits,
+// answering the wants it denies as mode says.
+func AccessControl(f PeerFilter, mode DenyMode) Option {
+	return func(e *Engine) {
+		e.peerFilter = f
+		e.denyMode = mode
+	}
+}
+
+// ServingStrategy sets the strategy deciding which peers the engine serves
+// and in which order. The default is WantlistPriority.
+func ServingStrategy(s Strategy) Option {
+	return func(e *Engine) {
+		e.strategy = s
+	}
 }
 
-func NewEngine(ctx context.Context, bs bstore.Blockstore) *Engine {
+func NewEngine(ctx context.Context, bs bstore.Blockstore, options ...Option) *Engine {
+	ctx, cancel := context.WithCancel(ctx)
 	e := &Engine{
-		ledgerMap:        make(map[peer.ID]*ledger),
-		bs:               bs,
-		peerRequestQueue: newPRQ(),
-		outbox:           make(chan (<-chan *Envelope), outboxChanBuffer),
-		workSignal:       make(chan struct{}, 1),
-		ticker:           time.NewTicker(time.Millisecond * 100),
+		ledgerMap:           make(map[peer.ID]*ledger),
+		unstored:            make(map[peer.ID]*ledgerRecord),
+		outbox:              make(chan (<-chan *Envelope), outboxChanBuffer),
+		workSignal:          make(chan struct{}, 1),
+		ticker:              time.NewTicker(time.Millisecond * 100),
+		maxMessageSize:      maxMessageSize,
+		requeues:            make(map[*time.Timer]struct{}),
+		strategy:            WantlistPriority,
+		ledgerFlushInterval: ledgerFlushInterval,
+		blockFetchWorkers:   blockFetchWorkers,
+		blockReadAhead:      blockReadAhead,
+		ctx:                 ctx,
+		cancel:              cancel,
+	}
+	if bs != nil {
+		e.bs = FromBlockstore(bs)
+	}
+	for _, option := range options {
+		option(e)
+	}
+	if e.blockFetchWorkers < 1 {
+		e.blockFetchWorkers = 1
+	}
+	if e.blockReadAhead < 0 {
+		e.blockReadAhead = 0
 	}
+	e.peerRequestQueue = newPRQ(e.strategy)
+	if e.throttle != nil {
+		e.peerRequestQueue.ready = e.throttle.Ready
+	}
+	e.prefetched = make(chan *prefetchedTask, e.blockReadAhead)
+	e.fetches = make(chan blockFetch, e.blockFetchWorkers)
+	if e.receiptKey != nil {
+		self, err := peer.IDFromPrivateKey(e.receiptKey)
+		if err != nil {
+			log.Errorf("not exchanging receipts: %s", err)
+			e.receiptKey = nil
+		}
+		e.self = self
+	}
+	e.running.Add(2 + e.blockFetchWorkers)
 	go e.taskWorker(ctx)
+	go e.prefetchWorker(ctx)
+	for i := 0; i < e.blockFetchWorkers; i++ {
+		go e.fetchWorker(ctx)
+	}
+	if e.ledgerStore != nil || e.ledgerHalfLife > 0 {
+		e.running.Add(1)
+		go e.ledgerWorker(ctx)
+	}
 	return e
 }
 
+// Close stops the engine from preparing messages, flushes the ledgers and
+// waits for it to exit. Envelopes already taken from the outbox can still be
+// sent.
+func (e *Engine) Close() {
+	e.requeueLk.Lock()
+	for t := range e.requeues {
+		t.Stop()
+	}
+	e.requeues = nil
+	e.requeueLk.Unlock()
+	e.cancel()
+	e.running.Wait()
+}
+
 func (e *Engine) WantlistForPeer(p peer.ID) (out []wl.Entry) {
 	partner := e.findOrCreate(p)
 	partner.lk.Lock()
@@ -120,16 +390,12 @@ func (e *Engine) LedgerForPeer(p peer.ID) *Receipt {
 	ledger.lk.Lock()
 	defer ledger.lk.Unlock()
 
-	return &Receipt{
-		Peer:      ledger.Partner.String(),
-		Value:     ledger.Accounting.Value(),
-		Sent:      ledger.Accounting.BytesSent,
-		Recv:      ledger.Accounting.BytesRecv,
-		Exchanged: ledger.ExchangeCount(),
-	}
+	r := ledger.receipt()
+	return &r
 }
 
 func (e *Engine) taskWorker(ctx context.Context) {
+	defer e.running.Done()
 	defer close(e.outbox) // because taskWorker uses the channel exclusively
 	for {
 		oneTimeUse := make(chan *Envelope, 1) // buffer to prevent blocking
@@ -154,29 +420,54 @@ func (e *Engine) taskWorker(ctx context.Context) {
 // context is cancelled before the next Envelope can be created.
 func (e *Engine) nextEnvelope(ctx context.Context) (*Envelope, error) {
 	for {
-		nextTask := e.peerRequestQueue.Pop()
-		for nextTask == nil {
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			case <-e.workSignal:
-				nextTask = e.peerRequestQueue.Pop()
-			case <-e.ticker.C:
-				e.peerRequestQueue.thawRound()
-				nextTask = e.peerRequestQueue.Pop()
-			}
+		var pt *prefetchedTask
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case pt = <-e.prefetched:
 		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pt.fetched:
+		}
+		nextTask := pt.task
+		wanted := e.stillWanted(nextTask.Target, nextTask.Entries)
+		var sent int
 
 		// with a task in hand, we're ready to prepare the envelope...
 		msg := bsmsg.New(true)
-		for _, entry := range nextTask.Entries {
-			block, err := e.bs.Get(entry.Cid)
-			if err != nil {
-				log.Errorf("tried to execute a task and errored fetching block: %s", err)
+		for i, entry := range nextTask.Entries {
+			if entry.notPermitted {
+				msg.AddNotPermitted(entry.Cid)
 				continue
 			}
-			msg.AddBlock(block)
+			if !wanted[i] {
+				// cancelled after the task was read ahead
+				continue
+			}
+			if !e.permitted(nextTask.Target, entry.Cid) {
+				// the filter changed since the want was queued, answer as
+				// if it had been denied on arrival
+				if e.denyMode == DenyNotPermitted {
+					msg.AddNotPermitted(entry.Cid)
+				}
+				continue
+			}
+			if entry.dontHave {
+				msg.AddDontHave(entry.Cid)
+				continue
+			}
+			if entry.WantType == pb.Message_Wantlist_Have {
+				msg.AddHave(entry.Cid)
+				continue
+			}
+			if block := pt.blocks[i]; block != nil {
+				msg.AddBlock(block)
+				sent += len(block.RawData())
+			}
 		}
+		e.settleReserved(pt, sent)
 
 		if msg.Empty() {
 			// If we don't have the block, don't hold that against the peer
@@ -201,6 +492,65 @@ func (e *Engine) nextEnvelope(ctx context.Context) (*Envelope, error) {
 	}
 }
 
+// reserve reserves the blocks a task sends with the throttle, so that the
+// peer stops being ready before the task reaches the outbox. The sizes are
+// the ones recorded in the peer's ledger when the wants were queued.
+func (e *Engine) reserve(task *peerRequestTask) int {
+	if e.throttle == nil {
+		return 0
+	}
+	e.lock.Lock()
+	l, ok := e.ledgerMap[task.Target]
+	if !ok {
+		e.lock.Unlock()
+		return 0
+	}
+	l.lk.Lock()
+	e.lock.Unlock()
+	n := 0
+	for i := range task.Entries {
+		if entry := &task.Entries[i]; entry.sendsBlock() {
+			n += l.wantSizes[entry.Cid]
+		}
+	}
+	l.lk.Unlock()
+	e.throttle.Reserve(task.Target, n)
+	return n
+}
+
+// settleReserved refunds the bytes reserved for a task that aren't sent, or
+// reserves the ones sent beyond the reservation.
+func (e *Engine) settleReserved(pt *prefetchedTask, sent int) {
+	if e.throttle == nil {
+		return
+	}
+	if d := pt.reserved - sent; d > 0 {
+		e.throttle.Refund(pt.task.Target, d)
+	} else if d < 0 {
+		e.throttle.Reserve(pt.task.Target, -d)
+	}
+}
+
+// stillWanted reports which entries of a task are still in the peer's
+// wantlist. Tasks are popped from the request queue ahead of the outbox, so
+// cancels arriving meanwhile don't remove them.
+func (e *Engine) stillWanted(p peer.ID, entries []peerRequestTaskEntry) []bool {
+	wanted := make([]bool, len(entries))
+	e.lock.Lock()
+	l, ok := e.ledgerMap[p]
+	if !ok {
+		e.lock.Unlock()
+		return wanted
+	}
+	l.lk.Lock()
+	e.lock.Unlock()
+	defer l.lk.Unlock()
+	for i, entry := range entries {
+		_, wanted[i] = l.WantListContains(entry.Cid)
+	}
+	return wanted
+}
+
 // Outbox returns a channel of one-time use Envelope channels.
 func (e *Engine) Outbox() <-chan (<-chan *Envelope) {
 	return e.outbox
@@ -237,55 +587,254 @@ func (e *Engine) MessageReceived(p peer.ID, m bsmsg.BitSwapMessage) error {
 	l.lk.Lock()
 	defer l.lk.Unlock()
 	if m.Full() {
-		l.wantList = wl.New()
+		l.ClearWants()
 	}
 
+	// handling the most important wants first means wants of the message
+	// never evict each other when the wantlist is full
+	wants := m.Wantlist()
+	sort.SliceStable(wants, func(i, j int) bool {
+		return wants[i].Priority > wants[j].Priority
+	})
+
 	var msgSize int
 	var activeEntries []wl.Entry
-	for _, entry := range m.Wantlist() {
+	var dontHaves []wl.Entry
+	var notPermitted []wl.Entry
+	for _, entry := range wants {
 		if entry.Cancel {
 			log.Debugf("%s cancel %s", p, entry.Cid)
 			l.CancelWant(entry.Cid)
 			e.peerRequestQueue.Remove(entry.Cid, p)
+		} else if !e.permitted(p, entry.Cid) {
+			// decided before looking at the block source, so the answer
+			// doesn't tell whether we have the block
+			log.Debugf("%s not permitted %s", p, entry.Cid)
+			l.CancelWant(entry.Cid)
+			e.peerRequestQueue.Remove(entry.Cid, p)
+			if e.denyMode == DenyNotPermitted {
+				notPermitted = append(notPermitted, entry.Entry)
+			}
+		} else if !e.admitWant(l, entry.Entry) {
+			log.Debugf("%s wantlist full, dropped %s", p, entry.Cid)
 		} else {
 			log.Debugf("wants %s - %d", entry.Cid, entry.Priority)
-			l.Wants(entry.Cid, entry.Priority)
-			blockSize, err := e.bs.GetSize(entry.Cid)
+			l.Wants(entry.Cid, entry.Priority, entry.WantType)
+			entrySize, err := e.entrySize(e.ctx, entry.Entry)
 			if err != nil {
 				if err == bstore.ErrNotFound {
+					if entry.SendDontHave {
+						dontHaves = append(dontHaves, entry.Entry)
+					}
 					continue
 				}
 				log.Error(err)
+			} else if e.sentRecently(l, entry.Entry) {
+				// most likely a rebroadcast crossing the block on the wire
+				log.Debugf("%s wants %s again, already sent", p, entry.Cid)
+			} else if !e.admitWantBytes(l, entry.Entry, entrySize) {
+				log.Debugf("%s wantlist full, dropped %s", p, entry.Cid)
+				l.CancelWant(entry.Cid)
+				e.peerRequestQueue.Remove(entry.Cid, p)
 			} else {
 				// we have the block
+				l.SetWantSize(entry.Cid, entrySize)
 				newWorkExists = true
-				if msgSize+blockSize > maxMessageSize {
+				if msgSize+entrySize > e.maxMessageSize {
 					e.peerRequestQueue.Push(p, activeEntries...)
 					activeEntries = []wl.Entry{}
 					msgSize = 0
 				}
 				activeEntries = append(activeEntries, entry.Entry)
-				msgSize += blockSize
+				msgSize += entrySize
 			}
 		}
 	}
 	if len(activeEntries) > 0 {
 		e.peerRequestQueue.Push(p, activeEntries...)
 	}
+	if len(dontHaves) > 0 {
+		// tell the peer right away so it can ask someone else
+		newWorkExists = true
+		e.peerRequestQueue.PushDontHaves(p, dontHaves...)
+	}
+	if len(notPermitted) > 0 {
+		newWorkExists = true
+		e.peerRequestQueue.PushNotPermitted(p, notPermitted...)
+	}
 	for _, block := range m.Blocks() {
 		log.Debugf("got block %s %d bytes", block, len(block.RawData()))
 		l.ReceivedBytes(len(block.RawData()))
 	}
+	if r := m.Receipt(); r != nil {
+		e.receiveReceipt(l, r)
+	}
+	e.peerRequestQueue.UpdateLedger(p, l.receipt())
 	return nil
 }
 
+// entrySize returns the number of bytes answering a want adds to a message:
+// the size of the block for a want-block, the size of the cid for a
+// want-have. Returns bstore.ErrNotFound if we don't have the block.
+func (e *Engine) entrySize(ctx context.Context, entry wl.Entry) (int, error) {
+	if entry.WantType == pb.Message_Wantlist_Have {
+		has, err := e.bs.Has(ctx, entry.Cid)
+		if err != nil {
+			return 0, err
+		}
+		if !has {
+			return 0, bstore.ErrNotFound
+		}
+		return len(entry.Cid.Bytes()), nil
+	}
+	return e.bs.GetSize(ctx, entry.Cid)
+}
+
+// sentRecently returns true, counting a suppressed send, if the want is
+// for a block sent to the peer within the sent block TTL. The want stays in
+// the wantlist and is queued again when the TTL expires. l.lk must be held.
+func (e *Engine) sentRecently(l *ledger, entry wl.Entry) bool {
+	if e.sentBlockTTL <= 0 || entry.WantType != pb.Message_Wantlist_Block {
+		return false
+	}
+	now := time.Now()
+	if !l.SentRecently(entry.Cid, now, e.sentBlockTTL) {
+		return false
+	}
+	atomic.AddUint64(&e.suppressedSends, 1)
+	e.requeueAfterTTL(l, entry.Cid, now)
+	return true
+}
+
+// requeueAfterTTL queues the suppressed want for c again once the block sent
+// to the peer is older than the sent block TTL, in case the peer didn't get
+// it. l.lk must be held.
+func (e *Engine) requeueAfterTTL(l *ledger, c cid.Cid, now time.Time) {
+	if _, ok := l.suppressed[c]; ok {
+		return
+	}
+	e.requeueLk.Lock()
+	defer e.requeueLk.Unlock()
+	if e.requeues == nil {
+		return // closed
+	}
+	l.suppressed[c] = struct{}{}
+	var t *time.Timer
+	t = time.AfterFunc(l.SentAt(c).Add(e.sentBlockTTL).Sub(now), func() {
+		if !e.startRequeue(t) {
+			return
+		}
+		defer e.running.Done()
+		e.lock.Lock()
+		if e.ledgerMap[l.Partner] != l {
+			// dropped on disconnect, along with the peer's wants
+			e.lock.Unlock()
+			return
+		}
+		l.lk.Lock()
+		e.lock.Unlock()
+		defer l.lk.Unlock()
+
+		delete(l.suppressed, c)
+		entry, ok := l.WantListContains(c)
+		if !ok || !e.permitted(l.Partner, c) || e.sentRecently(l, entry) {
+			return
+		}
+		size, err := e.entrySize(e.ctx, entry)
+		if err != nil {
+			if err != bstore.ErrNotFound {
+				log.Error(err)
+			}
+			return
+		}
+		if !e.admitWantBytes(l, entry, size) {
+			l.CancelWant(c)
+			return
+		}
+		l.SetWantSize(c, size)
+		e.peerRequestQueue.Push(l.Partner, entry)
+		e.peerRequestQueue.UpdateLedger(l.Partner, l.receipt())
+		e.signalNewWork()
+	})
+	e.requeues[t] = struct{}{}
+}
+
+// startRequeue forgets the timer of a requeue about to run and has Close wait
+// for it. Returns false if the engine is closed or closing.
+func (e *Engine) startRequeue(t *time.Timer) bool {
+	e.requeueLk.Lock()
+	defer e.requeueLk.Unlock()
+	if e.requeues == nil || e.ctx.Err() != nil {
+		return false
+	}
+	delete(e.requeues, t)
+	e.running.Add(1)
+	return true
+}
+
+// SuppressedSends returns the number of times the engine didn't send a peer
+// a block because it had recently sent it.
+func (e *Engine) SuppressedSends() uint64 {
+	return atomic.LoadUint64(&e.suppressedSends)
+}
+
+// admitWant makes room for a new want in the peer's full wantlist by
+// evicting lower priority wants. Returns false if there is no room for it.
+// l.lk must be held.
+func (e *Engine) admitWant(l *ledger, entry wl.Entry) bool {
+	if _, ok := l.wantList.Contains(entry.Cid); ok || e.maxWantlistEntries <= 0 {
+		return true
+	}
+	return e.evictWants(l, entry, l.byPriority,
+		func() bool { return l.wantList.Len() < e.maxWantlistEntries })
+}
+
+// admitWantBytes makes room for the answer to a want in the peer's
+// wantlist, evicting lower priority wants we can answer. Returns false if
+// there is no room for it. l.lk must be held.
+func (e *Engine) admitWantBytes(l *ledger, entry wl.Entry, size int) bool {
+	if e.maxWantlistBytes <= 0 {
+		return true
+	}
+	return e.evictWants(l, entry, l.sized,
+		func() bool { return l.pendingBytes-l.wantSizes[entry.Cid]+size <= e.maxWantlistBytes })
+}
+
+// evictWants evicts the lowest priority wants of evictable, as long as they
+// have a lower priority than entry, until fits returns true. Returns false,
+// counting entry as rejected, if that isn't enough.
+func (e *Engine) evictWants(l *ledger, entry wl.Entry, evictable *wantHeap, fits func() bool) bool {
+	if own, ok := evictable.index[entry.Cid]; ok {
+		// a want never evicts itself
+		evictable.Remove(entry.Cid)
+		defer evictable.Put(entry.Cid, own.priority)
+	}
+	for !fits() {
+		c, priority, ok := evictable.Lowest()
+		if !ok || priority >= entry.Priority {
+			l.rejectedWants++
+			return false
+		}
+		l.evictedWants++
+		l.CancelWant(c)
+		e.peerRequestQueue.Remove(c, l.Partner)
+	}
+	return true
+}
+
 func (e *Engine) addBlock(block blocks.Block) {
 	work := false
 
 	for _, l := range e.ledgerMap {
 		l.lk.Lock()
-		if entry, ok := l.WantListContains(block.Cid()); ok {
+		if entry, ok := l.WantListContains(block.Cid()); ok && e.permitted(l.Partner, block.Cid()) && !e.sentRecently(l, entry) {
 			e.peerRequestQueue.Push(l.Partner, entry)
+			if entry.WantType == pb.Message_Wantlist_Have {
+				l.SetWantSize(entry.Cid, len(entry.Cid.Bytes()))
+			} else {
+				l.SetWantSize(entry.Cid, len(block.RawData()))
+			}
+			e.peerRequestQueue.UpdateLedger(l.Partner, l.receipt())
 			work = true
 		}
 		l.lk.Unlock()
@@ -314,40 +863,62 @@ func (e *Engine) MessageSent(p peer.ID, m bsmsg.BitSwapMessage) error {
 	l.lk.Lock()
 	defer l.lk.Unlock()
 
+	now := time.Now()
 	for _, block := range m.Blocks() {
 		l.SentBytes(len(block.RawData()))
-		l.wantList.Remove(block.Cid())
+		if e.sentBlockTTL > 0 {
+			l.SentBlock(block.Cid(), now, e.sentBlockTTL)
+		}
+		l.CancelWant(block.Cid())
 		e.peerRequestQueue.Remove(block.Cid(), p)
 	}
+	e.peerRequestQueue.UpdateLedger(p, l.receipt())
+
+	// a HAVE answers a want-have, unless the peer has since asked for the
+	// block. DONT_HAVEs keep the want so we send the block if we get it.
+	for _, c := range m.Haves() {
+		if entry, ok := l.wantList.Contains(c); ok && entry.WantType == pb.Message_Wantlist_Have {
+			l.CancelWant(c)
+		}
+	}
 
 	return nil
 }
 
 func (e *Engine) PeerConnected(p peer.ID) {
-	e.lock.Lock()
-	defer e.lock.Unlock()
-	l, ok := e.ledgerMap[p]
-	if !ok {
-		l = newLedger(p)
-		e.ledgerMap[p] = l
+	for {
+		l := e.findOrCreate(p)
+		e.lock.Lock()
+		// the ledger may have been dropped by a disconnect meanwhile
+		if e.ledgerMap[p] == l {
+			l.lk.Lock()
+			l.ref++
+			l.lk.Unlock()
+			e.lock.Unlock()
+			return
+		}
+		e.lock.Unlock()
 	}
-	l.lk.Lock()
-	defer l.lk.Unlock()
-	l.ref++
 }
 
 func (e *Engine) PeerDisconnected(p peer.ID) {
 	e.lock.Lock()
-	defer e.lock.Unlock()
 	l, ok := e.ledgerMap[p]
 	if !ok {
+		e.lock.Unlock()
 		return
 	}
 	l.lk.Lock()
-	defer l.lk.Unlock()
 	l.ref--
-	if l.ref <= 0 {
-		delete(e.ledgerMap, p)
+	dropped := l.ref <= 0
+	if dropped {
+		e.dropLedger(l)
+	}
+	l.lk.Unlock()
+	e.lock.Unlock()
+
+	if dropped {
+		e.storeDropped(p)
 	}
 }
 
@@ -361,16 +932,9 @@ func (e *Engine) numBytesReceivedFrom(p peer.ID) uint64 {
 	return e.findOrCreate(p).Accounting.BytesRecv
 }
 
-// ledger lazily instantiates a ledger
-func (e *Engine) findOrCreate(p peer.ID) *ledger {
-	e.lock.Lock()
-	defer e.lock.Unlock()
-	l, ok := e.ledgerMap[p]
-	if !ok {
-		l = newLedger(p)
-		e.ledgerMap[p] = l
-	}
-	return l
+// permitted reports whether the peer filter lets p get the block c.
+func (e *Engine) permitted(p peer.ID, c cid.Cid) bool {
+	return e.peerFilter == nil || e.peerFilter.Permit(p, c)
 }
 
 func (e *Engine) signalNewWork() {
@@ -1,16 +1,21 @@
 package decision
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	message "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	bsul "github.com/ipfs/go-bitswap/uploadlimiter"
 
 	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
@@ -241,3 +246,597 @@ func stringsComplement(set, subset []string) []string {
 	}
 	return complement
 }
+
+func TestWantHaveAnsweredWithHave(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	block := blocks.NewBlock([]byte("held"))
+	if err := bs.Put(block); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(ctx, bs)
+	partner := testutil.RandPeerIDFatal(t)
+
+	m := message.New(false)
+	m.AddEntryWithType(block.Cid(), 1, pb.Message_Wantlist_Have, true)
+	e.MessageReceived(partner, m)
+
+	envelope := nextEnvelope(t, e)
+	if len(envelope.Message.Blocks()) != 0 {
+		t.Fatal("want-have should not be answered with the block")
+	}
+	haves := envelope.Message.Haves()
+	if len(haves) != 1 || !haves[0].Equals(block.Cid()) {
+		t.Fatal("want-have should be answered with a HAVE")
+	}
+	if len(envelope.Message.DontHaves()) != 0 {
+		t.Fatal("unexpected DONT_HAVE")
+	}
+	envelope.Sent()
+
+	e.MessageSent(partner, envelope.Message)
+	if len(e.WantlistForPeer(partner)) != 0 {
+		t.Fatal("want-have should be removed from the wantlist once answered")
+	}
+}
+
+func TestDontHaveThenBlockOnceAdded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	e := NewEngine(ctx, bs)
+	partner := testutil.RandPeerIDFatal(t)
+	block := blocks.NewBlock([]byte("missing"))
+
+	m := message.New(false)
+	m.AddEntryWithType(block.Cid(), 1, pb.Message_Wantlist_Block, true)
+	e.MessageReceived(partner, m)
+
+	envelope := nextEnvelope(t, e)
+	dontHaves := envelope.Message.DontHaves()
+	if len(dontHaves) != 1 || !dontHaves[0].Equals(block.Cid()) {
+		t.Fatal("missing want-block should be answered with a DONT_HAVE")
+	}
+	envelope.Sent()
+	e.MessageSent(partner, envelope.Message)
+
+	if err := bs.Put(block); err != nil {
+		t.Fatal(err)
+	}
+	e.AddBlock(block)
+
+	envelope = nextEnvelope(t, e)
+	received := envelope.Message.Blocks()
+	if len(received) != 1 || !received[0].Cid().Equals(block.Cid()) {
+		t.Fatal("block should be sent once we have it")
+	}
+}
+
+func nextEnvelope(t *testing.T, e *Engine) *Envelope {
+	t.Helper()
+	select {
+	case next := <-e.Outbox():
+		select {
+		case envelope := <-next:
+			return envelope
+		case <-time.After(time.Second):
+		}
+	case <-time.After(time.Second):
+	}
+	t.Fatal("no envelope in outbox")
+	return nil
+}
+
+// servePayingPeers only serves peers that sent us data.
+type servePayingPeers struct {
+	Strategy
+}
+
+func (servePayingPeers) ShouldServe(p PartnerStats) bool {
+	return p.Ledger.Recv > 0
+}
+
+func TestServingStrategySeesLedger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	block := blocks.NewBlock([]byte("held"))
+	if err := bs.Put(block); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(ctx, bs, ServingStrategy(servePayingPeers{WantlistPriority}))
+	partner := testutil.RandPeerIDFatal(t)
+
+	m := message.New(false)
+	m.AddEntry(block.Cid(), 1)
+	e.MessageReceived(partner, m)
+
+	next := <-e.Outbox()
+	select {
+	case <-next:
+		t.Fatal("peer that sent us nothing should not be served")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	m = message.New(false)
+	m.AddBlock(blocks.NewBlock([]byte("payment")))
+	e.MessageReceived(partner, m)
+
+	select {
+	case envelope := <-next:
+		if len(envelope.Message.Blocks()) != 1 {
+			t.Fatal("expected the wanted block")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer should be served once it sent us data")
+	}
+}
+
+func TestThrottledPeerSkipped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	for _, letter := range []string{"a", "b"} {
+		if err := bs.Put(blocks.NewBlock([]byte(letter))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	throttled := testutil.RandPeerIDFatal(t)
+	other := testutil.RandPeerIDFatal(t)
+	var lk sync.Mutex
+	ready := false
+	e := NewEngine(ctx, bs, Throttle(readyThrottle(func(p peer.ID) bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return p != throttled || ready
+	})))
+
+	partnerWants(e, []string{"a"}, throttled)
+	partnerWants(e, []string{"b"}, other)
+	if envelope := nextEnvelope(t, e); envelope.Peer != other {
+		t.Fatal("expected the peer that isn't throttled to be served")
+	}
+
+	lk.Lock()
+	ready = true
+	lk.Unlock()
+	if envelope := nextEnvelope(t, e); envelope.Peer != throttled {
+		t.Fatal("expected the throttled peer to be served once ready")
+	}
+}
+
+// readyThrottle is a Throttler that only reports whether peers are ready.
+type readyThrottle func(p peer.ID) bool
+
+func (f readyThrottle) Ready(p peer.ID) bool { return f(p) }
+
+func (readyThrottle) Reserve(peer.ID, int) {}
+
+func (readyThrottle) Refund(peer.ID, int) {}
+
+func TestReadAheadKeepsPeerUploadRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	const blockSize, count = 1000, 5
+	// one want per message, so each block is a task of its own
+	var wants []message.BitSwapMessage
+	for i := 0; i < count; i++ {
+		block := blocks.NewBlock(bytes.Repeat([]byte{byte(i)}, blockSize))
+		if err := bs.Put(block); err != nil {
+			t.Fatal(err)
+		}
+		msg := message.New(false)
+		msg.AddEntry(block.Cid(), count-i)
+		wants = append(wants, msg)
+	}
+	const rate, burst = 10000, blockSize
+	limiter := bsul.New(bsul.Limit{}, bsul.Limit{Rate: rate, Burst: burst}, nil)
+	e := NewEngine(ctx, bs, BlockReadAhead(count), Throttle(limiter))
+	partner := testutil.RandPeerIDFatal(t)
+
+	start := time.Now()
+	for _, msg := range wants {
+		e.MessageReceived(partner, msg)
+	}
+	sent := 0
+	for i := 0; i < count; i++ {
+		envelope := nextEnvelope(t, e)
+		elapsed := time.Since(start)
+		for _, block := range envelope.Message.Blocks() {
+			sent += len(block.RawData())
+		}
+		// a peer with any bandwidth left can be sent a whole block
+		if allowed := burst + blockSize + int(elapsed.Seconds()*rate); sent > allowed {
+			t.Fatalf("%d bytes handed out after %s, over the %d the peer limit allows", sent, elapsed, allowed)
+		}
+		envelope.Sent()
+	}
+}
+
+func TestLedgerSurvivesDisconnectAndRestart(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	partner := testutil.RandPeerIDFatal(t)
+
+	e := NewEngine(context.Background(), bs, LedgerStore(store))
+	e.PeerConnected(partner)
+	m := message.New(false)
+	m.AddBlock(blocks.NewBlock([]byte("received")))
+	e.MessageReceived(partner, m)
+	m = message.New(false)
+	m.AddBlock(blocks.NewBlock([]byte("sent block")))
+	e.MessageSent(partner, m)
+	e.PeerDisconnected(partner)
+
+	checkLedger := func(r *Receipt) {
+		t.Helper()
+		if r.Recv != 8 || r.Sent != 10 || r.Exchanged != 2 {
+			t.Fatalf("ledger not restored: %+v", r)
+		}
+	}
+	e.PeerConnected(partner)
+	checkLedger(e.LedgerForPeer(partner))
+	e.Close()
+
+	e = NewEngine(context.Background(), bs, LedgerStore(store))
+	defer e.Close()
+	checkLedger(e.LedgerForPeer(partner))
+}
+
+// blockingStore is a datastore whose writes wait until it is released.
+type blockingStore struct {
+	ds.Datastore
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(k ds.Key, v []byte) error {
+	<-s.release
+	return s.Datastore.Put(k, v)
+}
+
+func TestSlowLedgerStoreDoesNotBlockEngine(t *testing.T) {
+	store := &blockingStore{
+		Datastore: dssync.MutexWrap(ds.NewMapDatastore()),
+		release:   make(chan struct{}),
+	}
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	e := NewEngine(context.Background(), bs, LedgerStore(store))
+	defer e.Close()
+	partner := testutil.RandPeerIDFatal(t)
+	other := testutil.RandPeerIDFatal(t)
+
+	e.PeerConnected(partner)
+	m := message.New(false)
+	m.AddBlock(blocks.NewBlock([]byte("received")))
+	e.MessageReceived(partner, m)
+	disconnected := make(chan struct{})
+	go func() {
+		e.PeerDisconnected(partner)
+		close(disconnected)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		e.MessageReceived(other, m)
+		// the ledger being stored is restored as it was dropped
+		e.PeerConnected(partner)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("storing a ledger blocked the engine")
+	}
+	if r := e.LedgerForPeer(partner); r.Recv != 8 {
+		t.Fatalf("ledger not restored: %+v", r)
+	}
+
+	close(store.release)
+	<-disconnected
+}
+
+func TestLedgersFlushedPeriodically(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	e := NewEngine(context.Background(),
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		LedgerStore(store), LedgerFlushInterval(10*time.Millisecond))
+	defer e.Close()
+	partner := testutil.RandPeerIDFatal(t)
+
+	m := message.New(false)
+	m.AddBlock(blocks.NewBlock([]byte("received")))
+	e.MessageReceived(partner, m)
+
+	key := ds.NewKey("/bitswap/ledgers").Child(ledgerKey(partner))
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if has, _ := store.Has(key); has {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("ledger was not flushed")
+		}
+	}
+}
+
+func TestLedgerDecay(t *testing.T) {
+	l := newLedger(testutil.RandPeerIDFatal(t))
+	l.SentBytes(1000)
+	l.ReceivedBytes(4000)
+
+	l.decay(l.decayedAt.Add(time.Hour), time.Hour)
+	if l.Accounting.BytesSent != 500 || l.Accounting.BytesRecv != 2000 {
+		t.Fatal("expected bytes to halve after a half-life, got", l.Accounting)
+	}
+	l.decay(l.decayedAt.Add(2*time.Hour), time.Hour)
+	if l.Accounting.BytesSent != 125 || l.Accounting.BytesRecv != 500 {
+		t.Fatal("expected bytes to quarter after two half-lives, got", l.Accounting)
+	}
+	if r := l.receipt(); r.Sent != 125 || r.TotalSent != 1000 || r.TotalRecv != 4000 {
+		t.Fatalf("expected receipt totals not to decay, got %+v", r)
+	}
+}
+
+func TestWantlistEntriesBounded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := NewEngine(ctx, blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		MaxWantlistEntries(3))
+	partner := testutil.RandPeerIDFatal(t)
+
+	m := message.New(true)
+	for i := 0; i < 5; i++ {
+		m.AddEntry(blocks.NewBlock([]byte(fmt.Sprint(i))).Cid(), i)
+	}
+	e.MessageReceived(partner, m)
+	checkWants := func(expected ...int) {
+		t.Helper()
+		wants := e.WantlistForPeer(partner)
+		if len(wants) != len(expected) {
+			t.Fatalf("expected %d wants, got %d", len(expected), len(wants))
+		}
+		for i, w := range wants {
+			if w.Priority != expected[i] {
+				t.Fatalf("expected want of priority %d, got %d", expected[i], w.Priority)
+			}
+		}
+	}
+	checkWants(4, 3, 2)
+	if r := e.LedgerForPeer(partner); r.Evicted != 0 || r.Rejected != 2 {
+		t.Fatalf("expected no evicted and 2 rejected wants, got %d and %d", r.Evicted, r.Rejected)
+	}
+
+	// a more important want evicts the least important one
+	m = message.New(false)
+	m.AddEntry(blocks.NewBlock([]byte("urgent")).Cid(), 10)
+	m.AddEntry(blocks.NewBlock([]byte("idle")).Cid(), 0)
+	e.MessageReceived(partner, m)
+	checkWants(10, 4, 3)
+	if r := e.LedgerForPeer(partner); r.Evicted != 1 || r.Rejected != 3 {
+		t.Fatalf("expected 1 evicted and 3 rejected wants, got %d and %d", r.Evicted, r.Rejected)
+	}
+}
+
+func TestWantlistBytesBounded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	var held []blocks.Block
+	for i := 0; i < 3; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("%010d", i)))
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, b)
+	}
+	e := NewEngine(ctx, bs, MaxWantlistBytes(25))
+	partner := testutil.RandPeerIDFatal(t)
+
+	m := message.New(false)
+	m.AddEntry(held[0].Cid(), 1)
+	m.AddEntry(held[1].Cid(), 2)
+	// a want for a block we don't have takes no room
+	m.AddEntry(blocks.NewBlock([]byte("missing")).Cid(), 0)
+	e.MessageReceived(partner, m)
+	if len(e.WantlistForPeer(partner)) != 3 {
+		t.Fatal("expected wants to fit")
+	}
+
+	m = message.New(false)
+	m.AddEntry(held[2].Cid(), 3)
+	e.MessageReceived(partner, m)
+	wants := e.WantlistForPeer(partner)
+	if len(wants) != 3 || wants[0].Priority != 3 || wants[1].Priority != 2 || wants[2].Priority != 0 {
+		t.Fatal("expected the lowest priority want we can answer to be evicted")
+	}
+	if r := e.LedgerForPeer(partner); r.Evicted != 1 || r.Rejected != 0 {
+		t.Fatalf("expected 1 evicted and no rejected wants, got %d and %d", r.Evicted, r.Rejected)
+	}
+
+	// nothing less important is left to evict
+	m = message.New(false)
+	m.AddEntry(held[0].Cid(), 1)
+	e.MessageReceived(partner, m)
+	if r := e.LedgerForPeer(partner); r.Evicted != 1 || r.Rejected != 1 {
+		t.Fatalf("expected 1 evicted and 1 rejected want, got %d and %d", r.Evicted, r.Rejected)
+	}
+	if len(e.WantlistForPeer(partner)) != 3 {
+		t.Fatal("expected the rejected want to be dropped")
+	}
+}
+
+func TestDuplicateSendSuppressed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	block := blocks.NewBlock([]byte("sent once"))
+	if err := bs.Put(block); err != nil {
+		t.Fatal(err)
+	}
+	ttl := 200 * time.Millisecond
+	e := NewEngine(ctx, bs, SentBlockTTL(ttl))
+	partner := testutil.RandPeerIDFatal(t)
+
+	wantBlock := func() {
+		m := message.New(false)
+		m.AddEntry(block.Cid(), 1)
+		e.MessageReceived(partner, m)
+	}
+	wantBlock()
+	envelope := nextEnvelope(t, e)
+	if len(envelope.Message.Blocks()) != 1 {
+		t.Fatal("block should be sent")
+	}
+	e.MessageSent(partner, envelope.Message)
+	envelope.Sent()
+
+	// the peer's rebroadcast crossed the block on the wire
+	wantBlock()
+	next := <-e.Outbox()
+	select {
+	case <-next:
+		t.Fatal("block should not be sent again within the ttl")
+	case <-time.After(ttl / 2):
+	}
+	if n := e.SuppressedSends(); n != 1 {
+		t.Fatal("expected 1 suppressed send, got", n)
+	}
+	if len(e.WantlistForPeer(partner)) != 1 {
+		t.Fatal("suppressed want should stay in the wantlist")
+	}
+
+	// the want is answered once the ttl expires, without a rebroadcast
+	select {
+	case envelope = <-next:
+	case <-time.After(time.Second):
+		t.Fatal("no envelope in outbox")
+	}
+	if len(envelope.Message.Blocks()) != 1 {
+		t.Fatal("block should be sent again once the ttl expired")
+	}
+}
+
+func TestSuppressedWantNotRequeuedAfterClose(t *testing.T) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	block := blocks.NewBlock([]byte("sent once"))
+	if err := bs.Put(block); err != nil {
+		t.Fatal(err)
+	}
+	ttl := 50 * time.Millisecond
+	e := NewEngine(context.Background(), bs, SentBlockTTL(ttl))
+	partner := testutil.RandPeerIDFatal(t)
+
+	m := message.New(false)
+	m.AddEntry(block.Cid(), 1)
+	e.MessageReceived(partner, m)
+	envelope := nextEnvelope(t, e)
+	e.MessageSent(partner, envelope.Message)
+	envelope.Sent()
+	e.MessageReceived(partner, m)
+	if n := e.SuppressedSends(); n != 1 {
+		t.Fatal("expected 1 suppressed send, got", n)
+	}
+
+	e.Close()
+	time.Sleep(2 * ttl)
+	if task := e.peerRequestQueue.Pop(); task != nil {
+		t.Fatal("suppressed want should not be queued again after close")
+	}
+}
+
+// slowBlockstore holds every Get until release is closed, counting the Gets
+// in flight.
+type slowBlockstore struct {
+	blockstore.Blockstore
+	inFlight chan struct{}
+	release  chan struct{}
+}
+
+func (bs *slowBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	bs.inFlight <- struct{}{}
+	<-bs.release
+	return bs.Blockstore.Get(c)
+}
+
+func TestCancelAfterReadAheadNotSent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := &slowBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		inFlight:   make(chan struct{}, 10),
+		release:    make(chan struct{}),
+	}
+	e := NewEngine(ctx, bs, BlockReadAhead(1))
+	partner := testutil.RandPeerIDFatal(t)
+	block := blocks.NewBlock([]byte("cancelled"))
+	if err := bs.Put(block); err != nil {
+		t.Fatal(err)
+	}
+	m := message.New(false)
+	m.AddEntry(block.Cid(), 1)
+	e.MessageReceived(partner, m)
+
+	// the task is popped and its block being read when the cancel arrives
+	select {
+	case <-bs.inFlight:
+	case <-time.After(time.Second):
+		t.Fatal("block not read ahead")
+	}
+	m = message.New(false)
+	m.Cancel(block.Cid())
+	e.MessageReceived(partner, m)
+	close(bs.release)
+
+	next := <-e.Outbox()
+	select {
+	case envelope := <-next:
+		t.Fatal("cancelled block sent", envelope.Message.Blocks())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBlocksFetchedConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := &slowBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		inFlight:   make(chan struct{}, 10),
+		release:    make(chan struct{}),
+	}
+	e := NewEngine(ctx, bs, BlockFetchWorkers(3), BlockReadAhead(2))
+
+	for i := 0; i < 3; i++ {
+		block := blocks.NewBlock([]byte(fmt.Sprint(i)))
+		if err := bs.Put(block); err != nil {
+			t.Fatal(err)
+		}
+		m := message.New(false)
+		m.AddEntry(block.Cid(), 1)
+		e.MessageReceived(testutil.RandPeerIDFatal(t), m)
+	}
+
+	// the blocks of the read-ahead are read at once, before anything is
+	// taken from the outbox
+	for i := 0; i < 2; i++ {
+		select {
+		case <-bs.inFlight:
+		case <-time.After(time.Second):
+			t.Fatalf("expected 2 concurrent reads, got %d", i)
+		}
+	}
+	select {
+	case <-bs.inFlight:
+		t.Fatal("read beyond the read-ahead")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(bs.release)
+
+	for i := 0; i < 3; i++ {
+		envelope := nextEnvelope(t, e)
+		if len(envelope.Message.Blocks()) != 1 {
+			t.Fatal("expected a block in every envelope")
+		}
+		envelope.Sent()
+	}
+}
@@ -1,9 +1,11 @@
 package decision
 
 import (
+	"math"
 	"sync"
 	"time"
 
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	wl "github.com/ipfs/go-bitswap/wantlist"
 
 	cid "github.com/ipfs/go-cid"
@@ -13,8 +15,13 @@ import (
 func newLedger(p peer.ID) *ledger {
 	return &ledger{
 		wantList:   wl.New(),
+		wantSizes:  make(map[cid.Cid]int),
+		byPriority: newWantHeap(),
+		sized:      newWantHeap(),
 		Partner:    p,
 		sentToPeer: make(map[string]time.Time),
+		suppressed: make(map[cid.Cid]struct{}),
+		decayedAt:  time.Now(),
 	}
 }
 
@@ -27,6 +34,10 @@ type ledger struct {
 	// Accounting tracks bytes sent and received.
 	Accounting debtRatio
 
+	// total tracks the bytes sent and received like Accounting, without
+	// decay. Receipts acknowledge it.
+	total debtRatio
+
 	// lastExchange is the time of the last data exchange.
 	lastExchange time.Time
 
@@ -36,10 +47,46 @@ type ledger struct {
 	// wantList is a (bounded, small) set of keys that Partner desires.
 	wantList *wl.Wantlist
 
+	// wantSizes holds the size of the answers to the wants we can answer,
+	// and pendingBytes their sum
+	wantSizes    map[cid.Cid]int
+	pendingBytes int
+
+	// byPriority orders the wants by priority, and sized the ones in
+	// wantSizes, to find the wants to evict from a full wantlist
+	byPriority *wantHeap
+	sized      *wantHeap
+
+	// rejectedWants counts the wants dropped because the wantlist was full,
+	// and evictedWants the wants dropped to make room for more important ones
+	rejectedWants uint64
+	evictedWants  uint64
+
 	// sentToPeer is a set of keys to ensure we dont send duplicate blocks
-	// to a given peer
+	// to a given peer, with the time they were sent
 	sentToPeer map[string]time.Time
 
+	// suppressed holds the wants not answered because the block was sent
+	// recently, until they are queued again
+	suppressed map[cid.Cid]struct{}
+
+	// sentPrunedAt is the last time expired keys were pruned from sentToPeer
+	sentPrunedAt time.Time
+
+	// peerReceipt is the latest receipt Partner signed for us, nil if it
+	// never sent one
+	peerReceipt *PeerReceipt
+
+	// acknowledgedRecv is total.BytesRecv when we last signed a receipt for
+	// Partner
+	acknowledgedRecv uint64
+
+	// dirty is set when the accounting changed since the ledger was stored
+	dirty bool
+
+	// decayedAt is the time the bytes exchanged were last decayed
+	decayedAt time.Time
+
 	// ref is the reference count for this ledger, its used to ensure we
 	// don't drop the reference to this ledger in multi-connection scenarios
 	ref int
@@ -48,11 +95,31 @@ type ledger struct {
 }
 
 type Receipt struct {
-	Peer      string
+	Peer string
+	// Value, Sent and Recv decay with the ledger's half-life, so they
+	// favour recent exchanges
 	Value     float64
 	Sent      uint64
 	Recv      uint64
 	Exchanged uint64
+
+	// TotalSent and TotalRecv are the bytes sent to and received from the
+	// peer, without decay
+	TotalSent uint64
+	TotalRecv uint64
+
+	// Acknowledged is the number of bytes the peer acknowledged receiving
+	// from us in the latest receipt it signed. It doesn't decay, so it is
+	// to be compared with TotalSent.
+	Acknowledged uint64
+
+	// Rejected is the number of wants of the peer dropped because its
+	// wantlist was full
+	Rejected uint64
+
+	// Evicted is the number of wants of the peer dropped from its full
+	// wantlist to make room for more important ones
+	Evicted uint64
 }
 
 type debtRatio struct {
@@ -68,27 +135,129 @@ func (l *ledger) SentBytes(n int) {
 	l.exchangeCount++
 	l.lastExchange = time.Now()
 	l.Accounting.BytesSent += uint64(n)
+	l.total.BytesSent += uint64(n)
+	l.dirty = true
 }
 
 func (l *ledger) ReceivedBytes(n int) {
 	l.exchangeCount++
 	l.lastExchange = time.Now()
 	l.Accounting.BytesRecv += uint64(n)
+	l.total.BytesRecv += uint64(n)
+	l.dirty = true
 }
 
-func (l *ledger) Wants(k cid.Cid, priority int) {
+// decay scales down the bytes exchanged so that they lose half their weight
+// every halfLife. A zero halfLife disables decay. The totals don't decay.
+func (l *ledger) decay(now time.Time, halfLife time.Duration) {
+	elapsed := now.Sub(l.decayedAt)
+	if elapsed <= 0 {
+		return
+	}
+	l.decayedAt = now
+	if halfLife <= 0 {
+		return
+	}
+	factor := math.Exp2(-float64(elapsed) / float64(halfLife))
+	l.Accounting.BytesSent = uint64(float64(l.Accounting.BytesSent) * factor)
+	l.Accounting.BytesRecv = uint64(float64(l.Accounting.BytesRecv) * factor)
+}
+
+func (l *ledger) Wants(k cid.Cid, priority int, wantType pb.Message_Wantlist_WantType) {
 	log.Debugf("peer %s wants %s", l.Partner, k)
-	l.wantList.Add(k, priority)
+	if e, ok := l.wantList.Contains(k); ok {
+		// only a want-have being upgraded to a want-block changes the entry
+		if e.WantType == pb.Message_Wantlist_Block || wantType == pb.Message_Wantlist_Have {
+			return
+		}
+		l.wantList.Remove(k)
+	}
+	l.wantList.AddEntry(wl.Entry{Cid: k, Priority: priority, WantType: wantType})
+	l.byPriority.Put(k, priority)
+	if l.wantSizes[k] > 0 {
+		l.sized.Put(k, priority)
+	}
 }
 
 func (l *ledger) CancelWant(k cid.Cid) {
 	l.wantList.Remove(k)
+	l.byPriority.Remove(k)
+	l.sized.Remove(k)
+	l.pendingBytes -= l.wantSizes[k]
+	delete(l.wantSizes, k)
+}
+
+// ClearWants empties the wantlist.
+func (l *ledger) ClearWants() {
+	l.wantList = wl.New()
+	l.wantSizes = make(map[cid.Cid]int)
+	l.byPriority = newWantHeap()
+	l.sized = newWantHeap()
+	l.pendingBytes = 0
+}
+
+// SetWantSize records the size of the answer to a want.
+func (l *ledger) SetWantSize(k cid.Cid, size int) {
+	l.pendingBytes += size - l.wantSizes[k]
+	l.wantSizes[k] = size
+	if e, ok := l.wantList.Contains(k); ok && size > 0 {
+		l.sized.Put(k, e.Priority)
+	} else {
+		l.sized.Remove(k)
+	}
 }
 
 func (l *ledger) WantListContains(k cid.Cid) (wl.Entry, bool) {
 	return l.wantList.Contains(k)
 }
 
+// SentBlock records that the block k was sent to Partner, dropping the
+// records older than ttl once in a while.
+func (l *ledger) SentBlock(k cid.Cid, now time.Time, ttl time.Duration) {
+	l.sentToPeer[k.KeyString()] = now
+	if now.Sub(l.sentPrunedAt) < ttl {
+		return
+	}
+	for key, sent := range l.sentToPeer {
+		if now.Sub(sent) >= ttl {
+			delete(l.sentToPeer, key)
+		}
+	}
+	l.sentPrunedAt = now
+}
+
+// SentRecently returns true if the block k was sent to Partner less than ttl
+// ago.
+func (l *ledger) SentRecently(k cid.Cid, now time.Time, ttl time.Duration) bool {
+	sent, ok := l.sentToPeer[k.KeyString()]
+	return ok && now.Sub(sent) < ttl
+}
+
+// SentAt returns the time the block k was last sent to Partner, the zero
+// time if it wasn't sent recently.
+func (l *ledger) SentAt(k cid.Cid) time.Time {
+	return l.sentToPeer[k.KeyString()]
+}
+
 func (l *ledger) ExchangeCount() uint64 {
 	return l.exchangeCount
 }
+
+// receipt summarizes the ledger.
+func (l *ledger) receipt() Receipt {
+	r := Receipt{
+		Peer:      l.Partner.String(),
+		Value:     l.Accounting.Value(),
+		Sent:      l.Accounting.BytesSent,
+		Recv:      l.Accounting.BytesRecv,
+		Exchanged: l.ExchangeCount(),
+		TotalSent: l.total.BytesSent,
+		TotalRecv: l.total.BytesRecv,
+		Rejected:  l.rejectedWants,
+		Evicted:   l.evictedWants,
+	}
+	if l.peerReceipt != nil {
+		r.Acknowledged = l.peerReceipt.Received
+	}
+	return r
+}
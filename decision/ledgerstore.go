@@ -0,0 +1,254 @@
+package decision
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+
+	ds "github.com/ipfs/go-datastore"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ledgerRecord is the part of a ledger kept in the ledger store.
+type ledgerRecord struct {
+	BytesSent     uint64
+	BytesRecv     uint64
+	TotalSent     uint64
+	TotalRecv     uint64
+	ExchangeCount uint64
+	LastExchange  time.Time
+	DecayedAt     time.Time
+
+	// PeerReceipt is the latest receipt signed by the peer
+	PeerReceipt *bsmsg.ExchangeReceipt `json:",omitempty"`
+
+	// dirty is set if the record wasn't stored yet
+	dirty bool
+}
+
+func ledgerKey(p peer.ID) ds.Key {
+	return ds.NewKey(p.Pretty())
+}
+
+// findOrCreate returns the ledger of a peer, creating it if needed. The
+// accounting of new ledgers is loaded from the ledger store without holding
+// the engine's locks, so a slow store doesn't hold up other peers.
+func (e *Engine) findOrCreate(p peer.ID) *ledger {
+	for {
+		e.lock.Lock()
+		l, ok := e.ledgerMapOrUnstored(p)
+		dropped := e.dropped
+		e.lock.Unlock()
+		if ok {
+			return l
+		}
+		if e.ledgerStore == nil {
+			return e.addLedger(newLedger(p), dropped)
+		}
+		// the ledger of a peer being stored is in e.unstored, but one
+		// dropped while we load may be stored after we read it
+		if l := e.addLedger(e.loadLedger(p), dropped); l != nil {
+			return l
+		}
+	}
+}
+
+// ledgerMapOrUnstored returns the ledger of a peer, restoring it from its
+// record if it was dropped but not stored yet. e.lock must be held.
+func (e *Engine) ledgerMapOrUnstored(p peer.ID) (*ledger, bool) {
+	if l, ok := e.ledgerMap[p]; ok {
+		return l, true
+	}
+	if r, ok := e.unstored[p]; ok {
+		l := e.ledgerFromRecord(p, r)
+		e.ledgerMap[p] = l
+		return l, true
+	}
+	return nil, false
+}
+
+// addLedger adds a new ledger to ledgerMap, returning the ledger already
+// there if another one was added meanwhile. Returns nil if a ledger was
+// dropped since dropped was read, in case it was the peer's.
+func (e *Engine) addLedger(l *ledger, dropped uint64) *ledger {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if existing, ok := e.ledgerMapOrUnstored(l.Partner); ok {
+		return existing
+	}
+	if e.dropped != dropped {
+		return nil
+	}
+	e.ledgerMap[l.Partner] = l
+	return l
+}
+
+// loadLedger creates the ledger of a peer, loading its accounting from the
+// ledger store.
+func (e *Engine) loadLedger(p peer.ID) *ledger {
+	data, err := e.ledgerStore.Get(ledgerKey(p))
+	if err != nil {
+		if err != ds.ErrNotFound {
+			log.Errorf("error loading ledger of %s: %s", p, err)
+		}
+		return newLedger(p)
+	}
+	var r ledgerRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		log.Errorf("error decoding ledger of %s: %s", p, err)
+		return newLedger(p)
+	}
+	return e.ledgerFromRecord(p, &r)
+}
+
+func (e *Engine) ledgerFromRecord(p peer.ID, r *ledgerRecord) *ledger {
+	l := newLedger(p)
+	l.Accounting = debtRatio{BytesSent: r.BytesSent, BytesRecv: r.BytesRecv}
+	l.total = debtRatio{BytesSent: r.TotalSent, BytesRecv: r.TotalRecv}
+	l.exchangeCount = r.ExchangeCount
+	l.lastExchange = r.LastExchange
+	l.decayedAt = r.DecayedAt
+	l.decay(time.Now(), e.ledgerHalfLife)
+	if r.PeerReceipt != nil {
+		pr, err := VerifyReceipt(r.PeerReceipt)
+		if err != nil {
+			log.Errorf("error loading receipt of %s: %s", p, err)
+		} else {
+			l.peerReceipt = pr
+		}
+	}
+	return l
+}
+
+// ledgerRecord returns the record to store for the ledger, nil if it didn't
+// change since it was last stored. l.lk must be held.
+func (e *Engine) ledgerRecord(l *ledger) *ledgerRecord {
+	if e.ledgerStore == nil || !l.dirty {
+		return nil
+	}
+	return e.snapshot(l)
+}
+
+// snapshot returns the record of the ledger, marking the ledger stored.
+// l.lk must be held.
+func (e *Engine) snapshot(l *ledger) *ledgerRecord {
+	r := &ledgerRecord{
+		BytesSent:     l.Accounting.BytesSent,
+		BytesRecv:     l.Accounting.BytesRecv,
+		TotalSent:     l.total.BytesSent,
+		TotalRecv:     l.total.BytesRecv,
+		ExchangeCount: l.exchangeCount,
+		LastExchange:  l.lastExchange,
+		DecayedAt:     l.decayedAt,
+		dirty:         l.dirty,
+	}
+	l.dirty = false
+	if l.peerReceipt != nil {
+		r.PeerReceipt = &l.peerReceipt.Signed
+	}
+	return r
+}
+
+// dropLedger removes the ledger of a disconnected peer from ledgerMap, and
+// keeps its record until storeDropped writes it. e.lock and l.lk must be
+// held.
+func (e *Engine) dropLedger(l *ledger) {
+	delete(e.ledgerMap, l.Partner)
+	e.dropped++
+	if e.ledgerStore != nil {
+		// kept even if it was stored, the write may still be in progress
+		e.unstored[l.Partner] = e.snapshot(l)
+	}
+}
+
+// storeDropped writes the record of the dropped ledger of a peer to the
+// ledger store, if it wasn't written yet.
+func (e *Engine) storeDropped(p peer.ID) {
+	e.storeLock.Lock()
+	defer e.storeLock.Unlock()
+
+	e.lock.Lock()
+	r, ok := e.unstored[p]
+	e.lock.Unlock()
+	if !ok {
+		return
+	}
+	if r.dirty {
+		if err := e.putRecord(p, r); err != nil {
+			log.Errorf("error storing ledger of %s: %s", p, err)
+		}
+	}
+
+	e.lock.Lock()
+	if e.unstored[p] == r {
+		delete(e.unstored, p)
+	}
+	e.lock.Unlock()
+}
+
+// storeLedger writes the ledger to the ledger store if it changed since it
+// was last stored.
+func (e *Engine) storeLedger(l *ledger) {
+	e.storeLock.Lock()
+	defer e.storeLock.Unlock()
+
+	l.lk.Lock()
+	r := e.ledgerRecord(l)
+	l.lk.Unlock()
+	if r == nil {
+		return
+	}
+	if err := e.putRecord(l.Partner, r); err != nil {
+		log.Errorf("error storing ledger of %s: %s", l.Partner, err)
+		l.lk.Lock()
+		l.dirty = true
+		l.lk.Unlock()
+	}
+}
+
+func (e *Engine) putRecord(p peer.ID, r *ledgerRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return e.ledgerStore.Put(ledgerKey(p), data)
+}
+
+// ledgerWorker periodically decays and flushes the ledgers, and flushes them
+// one last time when the engine closes.
+func (e *Engine) ledgerWorker(ctx context.Context) {
+	defer e.running.Done()
+	ticker := time.NewTicker(e.ledgerFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flushLedgers()
+		case <-ctx.Done():
+			e.flushLedgers()
+			return
+		}
+	}
+}
+
+func (e *Engine) flushLedgers() {
+	e.lock.Lock()
+	ledgers := make([]*ledger, 0, len(e.ledgerMap))
+	for _, l := range e.ledgerMap {
+		ledgers = append(ledgers, l)
+	}
+	e.lock.Unlock()
+
+	now := time.Now()
+	for _, l := range ledgers {
+		if e.ledgerHalfLife > 0 {
+			l.lk.Lock()
+			l.decay(now, e.ledgerHalfLife)
+			e.peerRequestQueue.UpdateLedger(l.Partner, l.receipt())
+			l.lk.Unlock()
+		}
+		e.storeLedger(l)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	wantlist "github.com/ipfs/go-bitswap/wantlist"
 
 	cid "github.com/ipfs/go-cid"
@@ -14,28 +15,40 @@ import (
 type peerRequestQueue interface {
 	// Pop returns the next peerRequestTask. Returns nil if the peerRequestQueue is empty.
 	Pop() *peerRequestTask
+	// Push queues blocks we hold for a peer. Want-have entries are answered
+	// with a HAVE presence instead of the block.
 	Push(to peer.ID, entries ...wantlist.Entry)
+	// PushDontHaves queues DONT_HAVE presences for blocks we don't hold.
+	PushDontHaves(to peer.ID, entries ...wantlist.Entry)
+	// PushNotPermitted queues NOT_PERMITTED presences for blocks the peer
+	// may not get.
+	PushNotPermitted(to peer.ID, entries ...wantlist.Entry)
 	Remove(k cid.Cid, p peer.ID)
+	// UpdateLedger records the accounting of the exchange with a peer for
+	// the strategy to decide on.
+	UpdateLedger(p peer.ID, r Receipt)
 
 	// NB: cannot expose simply expose taskQueue.Len because trashed elements
 	// may exist. These trashed elements should not contribute to the count.
 }
 
-func newPRQ() *prq {
-	return &prq{
+func newPRQ(strategy Strategy) *prq {
+	tl := &prq{
 		taskMap:  make(map[taskEntryKey]*peerRequestTask),
 		partners: make(map[peer.ID]*activePartner),
 		frozen:   make(map[peer.ID]*activePartner),
-		pQueue:   pq.New(partnerCompare),
+		strategy: strategy,
 	}
+	tl.pQueue = pq.New(tl.partnerCompare)
+	return tl
 }
 
 // verify interface implementation
 var _ peerRequestQueue = &prq{}
 
-// TODO: at some point, the strategy needs to plug in here
-// to help decide how to sort tasks (on add) and how to select
-// tasks (on getnext). For now, we are assuming a dumb/nice strategy.
+// prq sorts partners and their tasks as the strategy decides, and skips the
+// partners it refuses to serve or that aren't ready when selecting the next
+// task.
 type prq struct {
 	lock     sync.Mutex
 	pQueue   pq.PQ
@@ -43,15 +56,37 @@ type prq struct {
 	partners map[peer.ID]*activePartner
 
 	frozen map[peer.ID]*activePartner
+
+	strategy Strategy
+	// ready reports whether a partner can be sent blocks right now, nil if
+	// they always can
+	ready func(peer.ID) bool
 }
 
 // Push currently adds a new peerRequestTask to the end of the list.
 func (tl *prq) Push(to peer.ID, entries ...wantlist.Entry) {
+	tl.push(to, entries, peerRequestTaskEntry{})
+}
+
+// PushDontHaves adds a new peerRequestTask answering the given entries with
+// DONT_HAVE presences.
+func (tl *prq) PushDontHaves(to peer.ID, entries ...wantlist.Entry) {
+	tl.push(to, entries, peerRequestTaskEntry{dontHave: true})
+}
+
+// PushNotPermitted adds a new peerRequestTask answering the given entries
+// with NOT_PERMITTED presences.
+func (tl *prq) PushNotPermitted(to peer.ID, entries ...wantlist.Entry) {
+	tl.push(to, entries, peerRequestTaskEntry{notPermitted: true})
+}
+
+// push queues the entries, answered as answer says.
+func (tl *prq) push(to peer.ID, entries []wantlist.Entry, answer peerRequestTaskEntry) {
 	tl.lock.Lock()
 	defer tl.lock.Unlock()
 	partner, ok := tl.partners[to]
 	if !ok {
-		partner = newActivePartner()
+		partner = tl.newActivePartner(to)
 		tl.pQueue.Push(partner)
 		tl.partners[to] = partner
 	}
@@ -62,10 +97,13 @@ func (tl *prq) Push(to peer.ID, entries ...wantlist.Entry) {
 	var priority int
 	newEntries := make([]peerRequestTaskEntry, 0, len(entries))
 	for _, entry := range entries {
-		if partner.activeBlocks.Has(entry.Cid) {
+		taskEntry := answer
+		taskEntry.Entry = entry
+		if taskEntry.sendsBlock() && partner.activeBlocks.Has(entry.Cid) {
 			continue
 		}
 		if task, ok := tl.taskMap[taskEntryKey{to, entry.Cid}]; ok {
+			task.upgrade(taskEntry)
 			if entry.Priority > task.Priority {
 				task.Priority = entry.Priority
 				partner.taskQueue.Update(task.index)
@@ -75,7 +113,7 @@ func (tl *prq) Push(to peer.ID, entries ...wantlist.Entry) {
 		if entry.Priority > priority {
 			priority = entry.Priority
 		}
-		newEntries = append(newEntries, peerRequestTaskEntry{entry, false})
+		newEntries = append(newEntries, taskEntry)
 	}
 
 	if len(newEntries) == 0 {
@@ -89,7 +127,7 @@ func (tl *prq) Push(to peer.ID, entries ...wantlist.Entry) {
 		Done: func(e []peerRequestTaskEntry) {
 			tl.lock.Lock()
 			for _, entry := range e {
-				partner.TaskDone(entry.Cid)
+				partner.TaskDone(entry)
 			}
 			tl.pQueue.Update(partner.Index())
 			tl.lock.Unlock()
@@ -108,11 +146,32 @@ func (tl *prq) Push(to peer.ID, entries ...wantlist.Entry) {
 func (tl *prq) Pop() *peerRequestTask {
 	tl.lock.Lock()
 	defer tl.lock.Unlock()
-	if tl.pQueue.Len() == 0 {
-		return nil
+
+	// partners the strategy refuses to serve or that aren't ready keep their
+	// place for next time
+	var refused []*activePartner
+	defer func() {
+		for _, partner := range refused {
+			tl.pQueue.Push(partner)
+		}
+	}()
+
+	for tl.pQueue.Len() > 0 {
+		partner := tl.pQueue.Pop().(*activePartner)
+		if partner.requests > 0 && partner.freezeVal == 0 &&
+			(!tl.strategy.ShouldServe(partner.stats()) || (tl.ready != nil && !tl.ready(partner.id))) {
+			refused = append(refused, partner)
+			continue
+		}
+		out := tl.popTask(partner)
+		tl.pQueue.Push(partner)
+		return out
 	}
-	partner := tl.pQueue.Pop().(*activePartner)
+	return nil
+}
 
+// popTask takes the next task of a partner, dropping the cancelled ones.
+func (tl *prq) popTask(partner *activePartner) *peerRequestTask {
 	var out *peerRequestTask
 	for partner.taskQueue.Len() > 0 && partner.freezeVal == 0 {
 		out = partner.taskQueue.Pop().(*peerRequestTask)
@@ -124,7 +183,7 @@ func (tl *prq) Pop() *peerRequestTask {
 				continue
 			}
 			partner.requests--
-			partner.StartTask(entry.Cid)
+			partner.StartTask(entry)
 			newEntries = append(newEntries, entry)
 		}
 		if len(newEntries) > 0 {
@@ -133,10 +192,9 @@ func (tl *prq) Pop() *peerRequestTask {
 			out = nil // discarding tasks that have been removed
 			continue
 		}
+		partner.lastServed = time.Now()
 		break // and return |out|
 	}
-
-	tl.pQueue.Push(partner)
 	return out
 }
 
@@ -173,6 +231,19 @@ func (tl *prq) Remove(k cid.Cid, p peer.ID) {
 	tl.lock.Unlock()
 }
 
+// UpdateLedger records the accounting of the exchange with a peer.
+func (tl *prq) UpdateLedger(p peer.ID, r Receipt) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+
+	partner, ok := tl.partners[p]
+	if !ok {
+		return
+	}
+	partner.ledger = r
+	tl.pQueue.Update(partner.index)
+}
+
 func (tl *prq) fullThaw() {
 	tl.lock.Lock()
 	defer tl.lock.Unlock()
@@ -199,9 +270,22 @@ func (tl *prq) thawRound() {
 
 type peerRequestTaskEntry struct {
 	wantlist.Entry
+	// dontHave marks entries answered with a DONT_HAVE presence because we
+	// didn't hold the block when the want arrived
+	dontHave bool
+	// notPermitted marks entries answered with a NOT_PERMITTED presence
+	// because the peer may not get the block
+	notPermitted bool
 	// trash in a book-keeping field
 	trash bool
 }
+
+// sendsBlock returns true if the entry is answered with the block itself
+// rather than a HAVE, DONT_HAVE or NOT_PERMITTED presence.
+func (e *peerRequestTaskEntry) sendsBlock() bool {
+	return !e.dontHave && !e.notPermitted && e.WantType == pb.Message_Wantlist_Block
+}
+
 type peerRequestTask struct {
 	Entries  []peerRequestTaskEntry
 	Priority int
@@ -215,6 +299,27 @@ type peerRequestTask struct {
 	index   int // book-keeping field used by the pq container
 }
 
+// upgrade replaces the queued answer for the entry's cid if the new one is
+// more useful to the peer: a HAVE or the block once we hold it or the peer
+// is permitted to get it, and the block once the peer wants it.
+func (t *peerRequestTask) upgrade(n peerRequestTaskEntry) {
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		if !e.Cid.Equals(n.Cid) {
+			continue
+		}
+		if e.trash || n.dontHave || n.notPermitted {
+			return
+		}
+		e.dontHave = false
+		e.notPermitted = false
+		if n.WantType == pb.Message_Wantlist_Block {
+			e.WantType = n.WantType
+		}
+		return
+	}
+}
+
 // Index implements pq.Elem.
 func (t *peerRequestTask) Index() int {
 	return t.index
@@ -232,12 +337,18 @@ type taskEntryKey struct {
 }
 
 // FIFO is a basic task comparator that returns tasks in the order created.
+//
+// Deprecated: the order tasks are answered in is set with a Strategy's
+// CompareTasks.
 var FIFO = func(a, b *peerRequestTask) bool {
 	return a.created.Before(b.created)
 }
 
 // V1 respects the target peer's wantlist priority. For tasks involving
 // different peers, the oldest task is prioritized.
+//
+// Deprecated: the order tasks are answered in is set with a Strategy's
+// CompareTasks.
 var V1 = func(a, b *peerRequestTask) bool {
 	if a.Target == b.Target {
 		return a.Priority > b.Priority
@@ -245,13 +356,17 @@ var V1 = func(a, b *peerRequestTask) bool {
 	return FIFO(a, b)
 }
 
-func wrapCmp(f func(a, b *peerRequestTask) bool) func(a, b pq.Elem) bool {
-	return func(a, b pq.Elem) bool {
-		return f(a.(*peerRequestTask), b.(*peerRequestTask))
+// info describes the task to the strategy.
+func (t *peerRequestTask) info() TaskInfo {
+	return TaskInfo{
+		Target:   t.Target,
+		Priority: t.Priority,
+		Created:  t.created,
 	}
 }
 
 type activePartner struct {
+	id peer.ID
 
 	// Active is the number of blocks this peer is currently being sent
 	// active must be locked around as it will be updated externally
@@ -270,20 +385,32 @@ type activePartner struct {
 
 	freezeVal int
 
+	// lastServed is the last time a task was popped for this peer
+	lastServed time.Time
+
+	// ledger is the accounting last passed to UpdateLedger
+	ledger Receipt
+
 	// priority queue of tasks belonging to this peer
 	taskQueue pq.PQ
 }
 
-func newActivePartner() *activePartner {
+func (tl *prq) newActivePartner(p peer.ID) *activePartner {
 	return &activePartner{
-		taskQueue:    pq.New(wrapCmp(V1)),
+		id:           p,
+		taskQueue:    pq.New(tl.taskCompare),
 		activeBlocks: cid.NewSet(),
 	}
 }
 
+// taskCompare implements pq.ElemComparator by asking the strategy.
+func (tl *prq) taskCompare(a, b pq.Elem) bool {
+	return tl.strategy.CompareTasks(a.(*peerRequestTask).info(), b.(*peerRequestTask).info())
+}
+
 // partnerCompare implements pq.ElemComparator
 // returns true if peer 'a' has higher priority than peer 'b'
-func partnerCompare(a, b pq.Elem) bool {
+func (tl *prq) partnerCompare(a, b pq.Elem) bool {
 	pa := a.(*activePartner)
 	pb := b.(*activePartner)
 
@@ -303,27 +430,37 @@ func partnerCompare(a, b pq.Elem) bool {
 		return true
 	}
 
-	if pa.active == pb.active {
-		// sorting by taskQueue.Len() aids in cleaning out trash entries faster
-		// if we sorted instead by requests, one peer could potentially build up
-		// a huge number of cancelled entries in the queue resulting in a memory leak
-		return pa.taskQueue.Len() > pb.taskQueue.Len()
+	return tl.strategy.ComparePartners(pa.stats(), pb.stats())
+}
+
+// stats describes the partner to the strategy.
+func (p *activePartner) stats() PartnerStats {
+	return PartnerStats{
+		Peer:       p.id,
+		Requests:   p.requests,
+		Active:     p.active,
+		Queued:     p.taskQueue.Len(),
+		LastServed: p.lastServed,
+		Ledger:     p.ledger,
 	}
-	return pa.active < pb.active
 }
 
 // StartTask signals that a task was started for this partner.
-func (p *activePartner) StartTask(k cid.Cid) {
+func (p *activePartner) StartTask(e peerRequestTaskEntry) {
 	p.activelk.Lock()
-	p.activeBlocks.Add(k)
+	if e.sendsBlock() {
+		p.activeBlocks.Add(e.Cid)
+	}
 	p.active++
 	p.activelk.Unlock()
 }
 
 // TaskDone signals that a task was completed for this partner.
-func (p *activePartner) TaskDone(k cid.Cid) {
+func (p *activePartner) TaskDone(e peerRequestTaskEntry) {
 	p.activelk.Lock()
-	p.activeBlocks.Remove(k)
+	if e.sendsBlock() {
+		p.activeBlocks.Remove(e.Cid)
+	}
 	p.active--
 	if p.active < 0 {
 		panic("more tasks finished than started!")
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"testing"
 
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	"github.com/ipfs/go-bitswap/wantlist"
 	cid "github.com/ipfs/go-cid"
 	u "github.com/ipfs/go-ipfs-util"
@@ -15,7 +16,7 @@ import (
 )
 
 func TestPushPop(t *testing.T) {
-	prq := newPRQ()
+	prq := newPRQ(WantlistPriority)
 	partner := testutil.RandPeerIDFatal(t)
 	alphabet := strings.Split("abcdefghijklmnopqrstuvwxyz", "")
 	vowels := strings.Split("aeiou", "")
@@ -77,7 +78,7 @@ func TestPushPop(t *testing.T) {
 
 // This test checks that peers wont starve out other peers
 func TestPeerRepeats(t *testing.T) {
-	prq := newPRQ()
+	prq := newPRQ(WantlistPriority)
 	a := testutil.RandPeerIDFatal(t)
 	b := testutil.RandPeerIDFatal(t)
 	c := testutil.RandPeerIDFatal(t)
@@ -128,3 +129,24 @@ func TestPeerRepeats(t *testing.T) {
 		}
 	}
 }
+
+func TestQueuedPresenceUpgrades(t *testing.T) {
+	prq := newPRQ(WantlistPriority)
+	partner := testutil.RandPeerIDFatal(t)
+	c := cid.NewCidV0(u.Hash([]byte("a")))
+
+	prq.PushDontHaves(partner, wantlist.Entry{Cid: c, WantType: pb.Message_Wantlist_Have})
+	prq.Push(partner, wantlist.Entry{Cid: c, WantType: pb.Message_Wantlist_Have})
+	prq.Push(partner, wantlist.Entry{Cid: c})
+
+	task := prq.Pop()
+	if len(task.Entries) != 1 {
+		t.Fatal("expected a single entry, got", len(task.Entries))
+	}
+	if !task.Entries[0].sendsBlock() {
+		t.Fatal("queued DONT_HAVE should be upgraded to the block")
+	}
+	if prq.Pop() != nil {
+		t.Fatal("expected no more tasks")
+	}
+}
@@ -0,0 +1,86 @@
+package decision
+
+import (
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// PeerFilter decides which blocks peers may get from us.
+type PeerFilter interface {
+	// Permit reports whether p may be sent the block c, or told whether we
+	// have it.
+	Permit(p peer.ID, c cid.Cid) bool
+}
+
+// PeerFilterFunc is a function implementing PeerFilter.
+type PeerFilterFunc func(p peer.ID, c cid.Cid) bool
+
+// Permit implements PeerFilter.
+func (f PeerFilterFunc) Permit(p peer.ID, c cid.Cid) bool {
+	return f(p, c)
+}
+
+// DenyMode is how the engine answers the wants a PeerFilter denies. Denied
+// wants get the same answer whether we have the block or not.
+type DenyMode int
+
+const (
+	// DenyIgnore drops denied wants without answering them.
+	DenyIgnore DenyMode = iota
+	// DenyNotPermitted answers denied wants with a NOT_PERMITTED presence.
+	DenyNotPermitted
+)
+
+// PeerList is a PeerFilter permitting or denying all blocks to a set of
+// peers that can be changed at any time.
+type PeerList struct {
+	allow bool
+
+	lk    sync.RWMutex
+	peers map[peer.ID]struct{}
+}
+
+// NewAllowlist returns a PeerList only permitting the given peers.
+func NewAllowlist(peers ...peer.ID) *PeerList {
+	return newPeerList(true, peers)
+}
+
+// NewDenylist returns a PeerList permitting all but the given peers.
+func NewDenylist(peers ...peer.ID) *PeerList {
+	return newPeerList(false, peers)
+}
+
+func newPeerList(allow bool, peers []peer.ID) *PeerList {
+	pl := &PeerList{
+		allow: allow,
+		peers: make(map[peer.ID]struct{}, len(peers)),
+	}
+	for _, p := range peers {
+		pl.peers[p] = struct{}{}
+	}
+	return pl
+}
+
+// Add adds a peer to the list.
+func (pl *PeerList) Add(p peer.ID) {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+	pl.peers[p] = struct{}{}
+}
+
+// Remove removes a peer from the list.
+func (pl *PeerList) Remove(p peer.ID) {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+	delete(pl.peers, p)
+}
+
+// Permit implements PeerFilter.
+func (pl *PeerList) Permit(p peer.ID, c cid.Cid) bool {
+	pl.lk.RLock()
+	defer pl.lk.RUnlock()
+	_, listed := pl.peers[p]
+	return listed == pl.allow
+}
@@ -0,0 +1,128 @@
+package decision
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	message "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	peer "github.com/libp2p/go-libp2p-peer"
+	testutil "github.com/libp2p/go-testutil"
+)
+
+func TestPeerLists(t *testing.T) {
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	c := blocks.NewBlock([]byte("block")).Cid()
+
+	allow := NewAllowlist(a)
+	if !allow.Permit(a, c) || allow.Permit(b, c) {
+		t.Fatal("allowlist should only permit listed peers")
+	}
+	allow.Add(b)
+	allow.Remove(a)
+	if allow.Permit(a, c) || !allow.Permit(b, c) {
+		t.Fatal("allowlist should follow changes")
+	}
+
+	deny := NewDenylist(a)
+	if deny.Permit(a, c) || !deny.Permit(b, c) {
+		t.Fatal("denylist should permit all but listed peers")
+	}
+}
+
+func TestDeniedWantsAnsweredAlike(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	held := blocks.NewBlock([]byte("held"))
+	if err := bs.Put(held); err != nil {
+		t.Fatal(err)
+	}
+	missing := blocks.NewBlock([]byte("missing"))
+	friend := testutil.RandPeerIDFatal(t)
+	stranger := testutil.RandPeerIDFatal(t)
+	e := NewEngine(ctx, bs, AccessControl(NewAllowlist(friend), DenyNotPermitted))
+
+	m := message.New(false)
+	m.AddEntry(held.Cid(), 1)
+	m.AddEntryWithType(missing.Cid(), 1, pb.Message_Wantlist_Block, true)
+	e.MessageReceived(stranger, m)
+
+	envelope := nextEnvelope(t, e)
+	if envelope.Peer != stranger {
+		t.Fatal("expected answer for the stranger")
+	}
+	if len(envelope.Message.Blocks()) != 0 || len(envelope.Message.DontHaves()) != 0 {
+		t.Fatal("denied peer should not learn which blocks we have")
+	}
+	if len(envelope.Message.NotPermitted()) != 2 {
+		t.Fatal("expected both wants to be answered with NOT_PERMITTED")
+	}
+	envelope.Sent()
+	if len(e.WantlistForPeer(stranger)) != 0 {
+		t.Fatal("denied wants should not be kept")
+	}
+
+	e.MessageReceived(friend, m)
+	envelope = nextEnvelope(t, e)
+	if len(envelope.Message.Blocks()) != 1 || len(envelope.Message.NotPermitted()) != 0 {
+		t.Fatal("permitted peer should be served")
+	}
+}
+
+func TestRevokedWantsAnsweredNotPermitted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	held := blocks.NewBlock([]byte("held"))
+	if err := bs.Put(held); err != nil {
+		t.Fatal(err)
+	}
+	// the want is permitted on arrival, and revoked once queued
+	var checks int32
+	revoked := PeerFilterFunc(func(p peer.ID, c cid.Cid) bool {
+		return atomic.AddInt32(&checks, 1) == 1
+	})
+	e := NewEngine(ctx, bs, AccessControl(revoked, DenyNotPermitted))
+
+	m := message.New(false)
+	m.AddEntry(held.Cid(), 1)
+	e.MessageReceived(testutil.RandPeerIDFatal(t), m)
+
+	envelope := nextEnvelope(t, e)
+	if len(envelope.Message.Blocks()) != 0 || len(envelope.Message.NotPermitted()) != 1 {
+		t.Fatal("expected the revoked want to be answered with NOT_PERMITTED")
+	}
+}
+
+func TestDeniedWantsIgnored(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	held := blocks.NewBlock([]byte("held"))
+	if err := bs.Put(held); err != nil {
+		t.Fatal(err)
+	}
+	stranger := testutil.RandPeerIDFatal(t)
+	e := NewEngine(ctx, bs, AccessControl(NewDenylist(stranger), DenyIgnore))
+
+	m := message.New(false)
+	m.AddEntryWithType(held.Cid(), 1, pb.Message_Wantlist_Have, true)
+	e.MessageReceived(stranger, m)
+
+	next := <-e.Outbox()
+	select {
+	case <-next:
+		t.Fatal("denied wants should not be answered")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,113 @@
+package decision
+
+import (
+	"context"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// prefetchedTask is a task popped ahead of the outbox, with the blocks it
+// sends being read from the block source by the fetch workers.
+type prefetchedTask struct {
+	task *peerRequestTask
+	// blocks holds the fetched blocks at the index of their entry, nil for
+	// entries not answered with a block or whose block couldn't be read
+	blocks []blocks.Block
+	// reserved is the number of bytes reserved with the throttle
+	reserved int
+	// remaining counts the fetches not done yet, plus one until all of them
+	// are queued. Accessed atomically.
+	remaining int32
+	// fetched is closed once all the blocks are fetched
+	fetched chan struct{}
+}
+
+func (pt *prefetchedTask) fetchDone() {
+	if atomic.AddInt32(&pt.remaining, -1) == 0 {
+		close(pt.fetched)
+	}
+}
+
+// blockFetch asks a fetch worker to read the block of an entry of a task.
+type blockFetch struct {
+	pt    *prefetchedTask
+	entry int
+}
+
+// prefetchWorker pops tasks from the request queue as soon as there is room
+// in the read-ahead and has their blocks fetched, handing the tasks to the
+// taskWorker in the order they were popped.
+func (e *Engine) prefetchWorker(ctx context.Context) {
+	defer e.running.Done()
+	defer e.ticker.Stop()
+	for {
+		task, err := e.nextTask(ctx)
+		if err != nil {
+			return // ctx cancelled
+		}
+		pt := &prefetchedTask{
+			task:      task,
+			blocks:    make([]blocks.Block, len(task.Entries)),
+			reserved:  e.reserve(task),
+			remaining: 1,
+			fetched:   make(chan struct{}),
+		}
+		select {
+		case e.prefetched <- pt:
+		case <-ctx.Done():
+			return
+		}
+		for i := range task.Entries {
+			entry := &task.Entries[i]
+			if !entry.sendsBlock() || !e.permitted(task.Target, entry.Cid) {
+				continue
+			}
+			atomic.AddInt32(&pt.remaining, 1)
+			select {
+			case e.fetches <- blockFetch{pt: pt, entry: i}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		pt.fetchDone()
+	}
+}
+
+// nextTask waits for a task in the request queue. Returns an error if the
+// context is cancelled first.
+func (e *Engine) nextTask(ctx context.Context) (*peerRequestTask, error) {
+	nextTask := e.peerRequestQueue.Pop()
+	for nextTask == nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-e.workSignal:
+			nextTask = e.peerRequestQueue.Pop()
+		case <-e.ticker.C:
+			e.peerRequestQueue.thawRound()
+			nextTask = e.peerRequestQueue.Pop()
+		}
+	}
+	return nextTask, nil
+}
+
+// fetchWorker reads the blocks of prefetched tasks from the block source.
+func (e *Engine) fetchWorker(ctx context.Context) {
+	defer e.running.Done()
+	for {
+		select {
+		case f := <-e.fetches:
+			c := f.pt.task.Entries[f.entry].Cid
+			block, err := e.bs.Get(ctx, c)
+			if err != nil {
+				log.Errorf("tried to execute a task and errored fetching block: %s", err)
+			} else {
+				f.pt.blocks[f.entry] = block
+			}
+			f.pt.fetchDone()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package decision
+
+import (
+	"errors"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+
+	ci "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ErrBadReceiptSignature is returned when a receipt was not signed by the key
+// it carries.
+var ErrBadReceiptSignature = errors.New("bad receipt signature")
+
+// ErrReceiptSignerMismatch is returned when a receipt was signed by another
+// peer than the one it names as signer.
+var ErrReceiptSignerMismatch = errors.New("receipt signer does not match its key")
+
+// PeerReceipt is a receipt in which a peer acknowledges the data it exchanged
+// with another peer.
+type PeerReceipt struct {
+	// Signer is the peer that signed the receipt.
+	Signer peer.ID
+
+	// Partner is the peer the receipt is for.
+	Partner peer.ID
+
+	// Received is the number of bytes the signer acknowledges receiving
+	// from the partner.
+	Received uint64
+
+	// Sent is the number of bytes the signer says it sent to the partner.
+	Sent uint64
+
+	// Time is when the receipt was signed.
+	Time time.Time
+
+	// Signed is the receipt as the signer sent it, to show to third parties.
+	Signed bsmsg.ExchangeReceipt
+}
+
+// SignReceipt signs a receipt acknowledging the bytes received from and sent
+// to partner with sk.
+func SignReceipt(sk ci.PrivKey, partner peer.ID, received, sent uint64, t time.Time) (*bsmsg.ExchangeReceipt, error) {
+	signer, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	data, err := (&pb.ReceiptData{
+		Signer:        []byte(signer),
+		Partner:       []byte(partner),
+		BytesReceived: received,
+		BytesSent:     sent,
+		Timestamp:     t.UnixNano(),
+	}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := sk.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ci.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	return &bsmsg.ExchangeReceipt{
+		Data:      data,
+		Signature: sig,
+		PublicKey: pk,
+	}, nil
+}
+
+// VerifyReceipt checks that a receipt was signed by the peer it names as
+// signer and decodes it.
+func VerifyReceipt(r *bsmsg.ExchangeReceipt) (*PeerReceipt, error) {
+	pk, err := ci.UnmarshalPublicKey(r.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := pk.Verify(r.Data, r.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrBadReceiptSignature
+	}
+
+	var data pb.ReceiptData
+	if err := data.Unmarshal(r.Data); err != nil {
+		return nil, err
+	}
+	signer := peer.ID(data.Signer)
+	if !signer.MatchesPublicKey(pk) {
+		return nil, ErrReceiptSignerMismatch
+	}
+	return &PeerReceipt{
+		Signer:   signer,
+		Partner:  peer.ID(data.Partner),
+		Received: data.BytesReceived,
+		Sent:     data.BytesSent,
+		Time:     time.Unix(0, data.Timestamp),
+		Signed:   *r,
+	}, nil
+}
+
+// SignReceipts signs receipts acknowledging all the data received from every
+// connected peer that sent us data since we last signed one for it, skipping
+// the peers accept rejects. A nil accept accepts every peer. It returns
+// nothing unless the engine has a ReceiptKey.
+func (e *Engine) SignReceipts(accept func(peer.ID) bool) map[peer.ID]*bsmsg.ExchangeReceipt {
+	if e.receiptKey == nil {
+		return nil
+	}
+
+	e.lock.Lock()
+	ledgers := make([]*ledger, 0, len(e.ledgerMap))
+	for _, l := range e.ledgerMap {
+		ledgers = append(ledgers, l)
+	}
+	e.lock.Unlock()
+
+	out := make(map[peer.ID]*bsmsg.ExchangeReceipt)
+	now := time.Now()
+	for _, l := range ledgers {
+		l.lk.Lock()
+		if l.ref > 0 && l.total.BytesRecv != l.acknowledgedRecv && (accept == nil || accept(l.Partner)) {
+			r, err := SignReceipt(e.receiptKey, l.Partner, l.total.BytesRecv, l.total.BytesSent, now)
+			if err != nil {
+				log.Errorf("error signing receipt for %s: %s", l.Partner, err)
+			} else {
+				out[l.Partner] = r
+				l.acknowledgedRecv = l.total.BytesRecv
+			}
+		}
+		l.lk.Unlock()
+	}
+	return out
+}
+
+// ReceiptFromPeer returns the latest receipt the peer signed for the data it
+// exchanged with us, nil if it never sent one.
+func (e *Engine) ReceiptFromPeer(p peer.ID) *PeerReceipt {
+	l := e.findOrCreate(p)
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if l.peerReceipt == nil {
+		return nil
+	}
+	r := *l.peerReceipt
+	return &r
+}
+
+// receiveReceipt keeps the receipt a peer sent if it is valid, meant for us
+// and newer than the one we have. l.lk must be held.
+func (e *Engine) receiveReceipt(l *ledger, signed *bsmsg.ExchangeReceipt) {
+	if e.receiptKey == nil {
+		return
+	}
+	r, err := VerifyReceipt(signed)
+	if err != nil {
+		log.Warningf("invalid receipt from %s: %s", l.Partner, err)
+		return
+	}
+	if r.Signer != l.Partner || r.Partner != e.self {
+		log.Warningf("receipt from %s is not for its exchange with us", l.Partner)
+		return
+	}
+	if l.peerReceipt != nil && !r.Time.After(l.peerReceipt.Time) {
+		return
+	}
+	l.peerReceipt = r
+	l.dirty = true
+}
@@ -0,0 +1,154 @@
+package decision
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	message "github.com/ipfs/go-bitswap/message"
+
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ci "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	testutil "github.com/libp2p/go-testutil"
+)
+
+func randKey(t *testing.T) (ci.PrivKey, peer.ID) {
+	t.Helper()
+	sk, _, err := ci.GenerateKeyPair(ci.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk, p
+}
+
+func TestSignAndVerifyReceipt(t *testing.T) {
+	sk, signer := randKey(t)
+	partner := testutil.RandPeerIDFatal(t)
+	now := time.Now()
+
+	signed, err := SignReceipt(sk, partner, 10, 20, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := VerifyReceipt(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Signer != signer || r.Partner != partner || r.Received != 10 || r.Sent != 20 || !r.Time.Equal(now) {
+		t.Fatalf("receipt changed on signing: %+v", r)
+	}
+
+	signed.Data[len(signed.Data)-1]++
+	if _, err := VerifyReceipt(signed); err != ErrBadReceiptSignature {
+		t.Fatal("expected tampered receipt to be rejected, got", err)
+	}
+}
+
+func TestReceiptsExchangedBetweenEngines(t *testing.T) {
+	skA, a := randKey(t)
+	skB, b := randKey(t)
+	skC, _ := randKey(t)
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	newEngine := func(sk ci.PrivKey, options ...Option) *Engine {
+		bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		return NewEngine(context.Background(), bs, append(options, ReceiptKey(sk))...)
+	}
+	ea := newEngine(skA)
+	defer ea.Close()
+	eb := newEngine(skB, LedgerStore(store))
+	ec := newEngine(skC)
+	defer ec.Close()
+
+	// b sends a a block
+	m := message.New(false)
+	block := blocks.NewBlock([]byte("block from b"))
+	m.AddBlock(block)
+	eb.MessageSent(a, m)
+	ea.PeerConnected(b)
+	ea.MessageReceived(b, m)
+
+	receipts := ea.SignReceipts(nil)
+	if len(receipts) != 1 || receipts[b] == nil {
+		t.Fatal("expected a receipt for the peer that sent us data")
+	}
+	if len(ea.SignReceipts(nil)) != 0 {
+		t.Fatal("expected no receipt until the peer sends more data")
+	}
+
+	m = message.New(false)
+	m.SetReceipt(receipts[b])
+	ec.MessageReceived(a, m)
+	if ec.ReceiptFromPeer(a) != nil {
+		t.Fatal("receipt meant for another peer should be rejected")
+	}
+
+	eb.PeerConnected(a)
+	eb.MessageReceived(a, m)
+	checkReceipt := func(e *Engine) {
+		t.Helper()
+		r := e.ReceiptFromPeer(a)
+		if r == nil || r.Signer != a || r.Partner != b || r.Received != uint64(len(block.RawData())) {
+			t.Fatalf("expected receipt acknowledging the block, got %+v", r)
+		}
+		if lr := e.LedgerForPeer(a); lr.Acknowledged != uint64(len(block.RawData())) || lr.Acknowledged != lr.TotalSent {
+			t.Fatalf("expected ledger to show all the bytes sent as acknowledged, got %+v", lr)
+		}
+	}
+	checkReceipt(eb)
+
+	// the receipt is kept with the ledger
+	eb.Close()
+	eb = newEngine(skB, LedgerStore(store))
+	defer eb.Close()
+	checkReceipt(eb)
+}
+
+func TestReceiptsIgnoreDecay(t *testing.T) {
+	sk, _ := randKey(t)
+	partner := testutil.RandPeerIDFatal(t)
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	e := NewEngine(context.Background(), bs, ReceiptKey(sk), LedgerHalfLife(time.Hour))
+	defer e.Close()
+
+	e.PeerConnected(partner)
+	m := message.New(false)
+	m.AddBlock(blocks.NewBlock([]byte("first")))
+	e.MessageReceived(partner, m)
+	if receipts := e.SignReceipts(func(peer.ID) bool { return false }); len(receipts) != 0 {
+		t.Fatal("expected no receipt for a rejected peer")
+	}
+	if len(e.SignReceipts(nil)) != 1 {
+		t.Fatal("expected a receipt for the peer that sent us data")
+	}
+
+	l := e.findOrCreate(partner)
+	l.lk.Lock()
+	l.decay(l.decayedAt.Add(time.Hour), time.Hour)
+	l.lk.Unlock()
+	if len(e.SignReceipts(nil)) != 0 {
+		t.Fatal("expected no receipt when only decay changed the ledger")
+	}
+
+	m = message.New(false)
+	m.AddBlock(blocks.NewBlock([]byte("second")))
+	e.MessageReceived(partner, m)
+	signed := e.SignReceipts(nil)[partner]
+	if signed == nil {
+		t.Fatal("expected a receipt for the new data")
+	}
+	r, err := VerifyReceipt(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Received != uint64(len("first")+len("second")) {
+		t.Fatal("expected receipt to acknowledge all the data received, got", r.Received)
+	}
+}
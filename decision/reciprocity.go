@@ -0,0 +1,95 @@
+package decision
+
+import (
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// DefaultGraceBytes is the default number of bytes a reciprocity strategy
+// sends a peer before holding its debt ratio against it.
+const DefaultGraceBytes = 1 << 20
+
+// ReciprocityOption configures a strategy returned by NewReciprocity.
+type ReciprocityOption func(*reciprocity)
+
+// ReciprocityBase sets the strategy ordering the peers in good standing and
+// the tasks of each peer. The default is WantlistPriority.
+func ReciprocityBase(s Strategy) ReciprocityOption {
+	return func(r *reciprocity) {
+		r.base = s
+	}
+}
+
+// GraceBytes sets the number of bytes sent to a peer before its debt ratio
+// counts, so new peers can get started.
+func GraceBytes(n uint64) ReciprocityOption {
+	return func(r *reciprocity) {
+		r.grace = n
+	}
+}
+
+// Allow exempts peers from reciprocity: they are served as if they were
+// always in good standing.
+func Allow(peers ...peer.ID) ReciprocityOption {
+	return func(r *reciprocity) {
+		for _, p := range peers {
+			r.allowed[p] = struct{}{}
+		}
+	}
+}
+
+// NewReciprocity returns a tit-for-tat strategy. Peers we sent more than
+// they sent us are served after the others, the most indebted last, and
+// peers whose debt ratio exceeds maxDebtRatio are not served until they send
+// us more data. A maxDebtRatio of zero only deprioritizes indebted peers.
+func NewReciprocity(maxDebtRatio float64, options ...ReciprocityOption) Strategy {
+	r := &reciprocity{
+		base:         WantlistPriority,
+		maxDebtRatio: maxDebtRatio,
+		grace:        DefaultGraceBytes,
+		allowed:      make(map[peer.ID]struct{}),
+	}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+type reciprocity struct {
+	base         Strategy
+	maxDebtRatio float64
+	grace        uint64
+
+	// allowed is not modified once the strategy is built
+	allowed map[peer.ID]struct{}
+}
+
+// debt returns the debt ratio held against the peer, zero if it is in good
+// standing.
+func (r *reciprocity) debt(p PartnerStats) float64 {
+	if _, ok := r.allowed[p.Peer]; ok {
+		return 0
+	}
+	if p.Ledger.Sent < r.grace || p.Ledger.Value <= 1 {
+		return 0
+	}
+	return p.Ledger.Value
+}
+
+func (r *reciprocity) ShouldServe(p PartnerStats) bool {
+	if r.maxDebtRatio > 0 && r.debt(p) > r.maxDebtRatio {
+		return false
+	}
+	return r.base.ShouldServe(p)
+}
+
+func (r *reciprocity) ComparePartners(a, b PartnerStats) bool {
+	da, db := r.debt(a), r.debt(b)
+	if da == db {
+		return r.base.ComparePartners(a, b)
+	}
+	return da < db
+}
+
+func (r *reciprocity) CompareTasks(a, b TaskInfo) bool {
+	return r.base.CompareTasks(a, b)
+}
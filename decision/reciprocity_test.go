@@ -0,0 +1,89 @@
+package decision
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-bitswap/wantlist"
+	cid "github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-testutil"
+)
+
+func TestReciprocityGraceAndDebt(t *testing.T) {
+	p := testutil.RandPeerIDFatal(t)
+	r := NewReciprocity(2, GraceBytes(100))
+
+	newPeer := PartnerStats{Peer: p, Ledger: Receipt{Sent: 99, Value: 99}}
+	if !r.ShouldServe(newPeer) {
+		t.Fatal("peer within its grace allowance should be served")
+	}
+	indebted := PartnerStats{Peer: p, Ledger: Receipt{Sent: 300, Recv: 99, Value: 3}}
+	if r.ShouldServe(indebted) {
+		t.Fatal("peer over the maximum debt ratio should not be served")
+	}
+	paying := PartnerStats{Peer: p, Ledger: Receipt{Sent: 300, Recv: 199, Value: 1.5}}
+	if !r.ShouldServe(paying) {
+		t.Fatal("peer under the maximum debt ratio should be served")
+	}
+
+	if !r.ComparePartners(paying, indebted) || r.ComparePartners(indebted, paying) {
+		t.Fatal("less indebted peer should be served first")
+	}
+	even := PartnerStats{Peer: p, Ledger: Receipt{Sent: 300, Recv: 299, Value: 1}}
+	if !r.ComparePartners(even, paying) {
+		t.Fatal("peer in good standing should be served first")
+	}
+	if !r.ComparePartners(newPeer, paying) {
+		t.Fatal("peer within its grace allowance should be served first")
+	}
+}
+
+func TestReciprocityDeprioritizeOnly(t *testing.T) {
+	p := testutil.RandPeerIDFatal(t)
+	r := NewReciprocity(0, GraceBytes(0))
+
+	indebted := PartnerStats{Peer: p, Ledger: Receipt{Sent: 1000, Value: 1000}}
+	if !r.ShouldServe(indebted) {
+		t.Fatal("without a maximum debt ratio every peer should be served")
+	}
+}
+
+func TestReciprocityAllowlist(t *testing.T) {
+	friend := testutil.RandPeerIDFatal(t)
+	stranger := testutil.RandPeerIDFatal(t)
+	r := NewReciprocity(2, GraceBytes(0), Allow(friend))
+
+	ledger := Receipt{Sent: 1000, Value: 1000}
+	if !r.ShouldServe(PartnerStats{Peer: friend, Ledger: ledger}) {
+		t.Fatal("allowed peer should always be served")
+	}
+	if r.ShouldServe(PartnerStats{Peer: stranger, Ledger: ledger}) {
+		t.Fatal("other peers should not be served")
+	}
+}
+
+func TestReciprocityThrottlesInQueue(t *testing.T) {
+	prq := newPRQ(NewReciprocity(2, GraceBytes(10)))
+	leecher := testutil.RandPeerIDFatal(t)
+	seeder := testutil.RandPeerIDFatal(t)
+
+	prq.Push(leecher, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte("l")))})
+	prq.Push(seeder, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte("s")))})
+	prq.UpdateLedger(leecher, Receipt{Sent: 100, Value: 100})
+	prq.UpdateLedger(seeder, Receipt{Sent: 100, Recv: 100, Value: 1})
+
+	task := prq.Pop()
+	if task == nil || task.Target != seeder {
+		t.Fatal("expected the peer in good standing to be served")
+	}
+	if prq.Pop() != nil {
+		t.Fatal("peer over the maximum debt ratio should not be served")
+	}
+
+	// the leecher pays up
+	prq.UpdateLedger(leecher, Receipt{Sent: 100, Recv: 99, Value: 1})
+	task = prq.Pop()
+	if task == nil || task.Target != leecher {
+		t.Fatal("peer should be served again once it sent us data")
+	}
+}
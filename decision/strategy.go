@@ -0,0 +1,132 @@
+package decision
+
+import (
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Strategy decides which peers the engine serves, in which order, and in
+// which order it answers the wants of each peer.
+type Strategy interface {
+	// ShouldServe reports whether the wants queued for a peer may be
+	// answered now. Wants of peers it refuses stay queued until it accepts
+	// them.
+	ShouldServe(p PartnerStats) bool
+
+	// ComparePartners returns true if peer a should be served before peer b.
+	// Peers with nothing to send and peers waiting for cancels to arrive are
+	// always served last.
+	ComparePartners(a, b PartnerStats) bool
+
+	// CompareTasks returns true if task a should be answered before task b.
+	// Both tasks are for the same peer.
+	CompareTasks(a, b TaskInfo) bool
+}
+
+// PartnerStats describes a peer with wants queued in the engine.
+type PartnerStats struct {
+	Peer peer.ID
+
+	// Requests is the number of wants queued for the peer.
+	Requests int
+
+	// Active is the number of wants being answered.
+	Active int
+
+	// Queued is the number of tasks in the peer's queue, including the ones
+	// cancelled since they were queued.
+	Queued int
+
+	// LastServed is the last time a task was taken for the peer, zero if
+	// it was never served.
+	LastServed time.Time
+
+	// Ledger is the accounting of the exchange with the peer.
+	Ledger Receipt
+}
+
+// TaskInfo describes a queued batch of wants from a peer.
+type TaskInfo struct {
+	Target peer.ID
+
+	// Priority is the highest wantlist priority of the task's entries.
+	Priority int
+
+	// Created is the time the task was queued.
+	Created time.Time
+}
+
+// WantlistPriority serves first the peers we are sending the fewest blocks,
+// and answers the wants of each peer strictly in order of their wantlist
+// priority. It is the default strategy.
+var WantlistPriority Strategy = wantlistPriority{}
+
+// RoundRobin serves peers in turn, starting with the one served least
+// recently, and answers the wants of each peer in the order they arrived.
+var RoundRobin Strategy = roundRobin{}
+
+// LedgerWeighted serves first the peers that sent us the most compared to
+// what we sent them, so that each peer gets a share of our upload in
+// proportion to what it uploads to us. The wants of each peer are answered
+// in order of their wantlist priority.
+var LedgerWeighted Strategy = ledgerWeighted{}
+
+type wantlistPriority struct{}
+
+func (wantlistPriority) ShouldServe(PartnerStats) bool {
+	return true
+}
+
+func (wantlistPriority) ComparePartners(a, b PartnerStats) bool {
+	if a.Active == b.Active {
+		// sorting by the queue length aids in cleaning out trash entries faster
+		// if we sorted instead by requests, one peer could potentially build up
+		// a huge number of cancelled entries in the queue resulting in a memory leak
+		return a.Queued > b.Queued
+	}
+	return a.Active < b.Active
+}
+
+func (wantlistPriority) CompareTasks(a, b TaskInfo) bool {
+	if a.Priority == b.Priority {
+		return a.Created.Before(b.Created)
+	}
+	return a.Priority > b.Priority
+}
+
+type roundRobin struct{}
+
+func (roundRobin) ShouldServe(PartnerStats) bool {
+	return true
+}
+
+func (roundRobin) ComparePartners(a, b PartnerStats) bool {
+	if a.LastServed.Equal(b.LastServed) {
+		return a.Queued > b.Queued
+	}
+	return a.LastServed.Before(b.LastServed)
+}
+
+func (roundRobin) CompareTasks(a, b TaskInfo) bool {
+	return a.Created.Before(b.Created)
+}
+
+type ledgerWeighted struct{}
+
+func (ledgerWeighted) ShouldServe(PartnerStats) bool {
+	return true
+}
+
+func (ledgerWeighted) ComparePartners(a, b PartnerStats) bool {
+	// the debt ratio of a peer grows as we send it blocks, so peers that
+	// keep sending us data keep their place near the front
+	if a.Ledger.Value == b.Ledger.Value {
+		return WantlistPriority.ComparePartners(a, b)
+	}
+	return a.Ledger.Value < b.Ledger.Value
+}
+
+func (ledgerWeighted) CompareTasks(a, b TaskInfo) bool {
+	return WantlistPriority.CompareTasks(a, b)
+}
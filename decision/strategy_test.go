@@ -0,0 +1,114 @@
+package decision
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-bitswap/wantlist"
+	cid "github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-testutil"
+)
+
+func TestRoundRobinServesPeersInTurn(t *testing.T) {
+	prq := newPRQ(RoundRobin)
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+
+	// a queues more tasks, and with higher priorities, than b
+	for i := 0; i < 4; i++ {
+		prq.Push(a, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte(fmt.Sprint("a", i)))), Priority: i})
+	}
+	for i := 0; i < 2; i++ {
+		prq.Push(b, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte(fmt.Sprint("b", i)))), Priority: i})
+	}
+
+	var targets []string
+	var received []string
+	for {
+		task := prq.Pop()
+		if task == nil {
+			break
+		}
+		task.Done(task.Entries)
+		targets = append(targets, task.Target.Pretty())
+		received = append(received, task.Entries[0].Cid.String())
+	}
+
+	expected := []string{a.Pretty(), b.Pretty(), a.Pretty(), b.Pretty(), a.Pretty(), a.Pretty()}
+	if fmt.Sprint(targets) != fmt.Sprint(expected) {
+		t.Fatal("peers should be served in turn, got", targets)
+	}
+	// wants are answered in the order they arrived, not by priority
+	if received[0] != cid.NewCidV0(u.Hash([]byte("a0"))).String() {
+		t.Fatal("expected oldest want of a to be answered first")
+	}
+}
+
+func TestLedgerWeightedPrefersGenerousPeers(t *testing.T) {
+	prq := newPRQ(LedgerWeighted)
+	generous := testutil.RandPeerIDFatal(t)
+	leecher := testutil.RandPeerIDFatal(t)
+
+	for i := 0; i < 3; i++ {
+		prq.Push(leecher, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte(fmt.Sprint("l", i))))})
+		prq.Push(generous, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte(fmt.Sprint("g", i))))})
+	}
+	prq.UpdateLedger(leecher, Receipt{Value: 4})
+	prq.UpdateLedger(generous, Receipt{Value: 0.5})
+
+	for i := 0; i < 3; i++ {
+		task := prq.Pop()
+		if task.Target != generous {
+			t.Fatal("expected peer with the lowest debt ratio to be served first")
+		}
+		task.Done(task.Entries)
+	}
+
+	// once we sent it enough, the generous peer falls behind the other one
+	prq.Push(generous, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte("g3")))})
+	prq.UpdateLedger(generous, Receipt{Value: 8})
+	if task := prq.Pop(); task.Target != leecher {
+		t.Fatal("expected peer with the lowest debt ratio to be served first")
+	}
+}
+
+type refuseStrategy struct {
+	Strategy
+	refused map[string]bool
+}
+
+func (s refuseStrategy) ShouldServe(p PartnerStats) bool {
+	return !s.refused[p.Peer.Pretty()]
+}
+
+func TestRefusedPeersAreSkipped(t *testing.T) {
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+	strategy := refuseStrategy{WantlistPriority, map[string]bool{a.Pretty(): true}}
+	prq := newPRQ(strategy)
+
+	for i := 0; i < 3; i++ {
+		// a always has the most queued so would be served first
+		prq.Push(a, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte(fmt.Sprint("a", i))))})
+		prq.Push(a, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte(fmt.Sprint("a", i+3))))})
+	}
+	prq.Push(b, wantlist.Entry{Cid: cid.NewCidV0(u.Hash([]byte("b")))})
+
+	task := prq.Pop()
+	if task == nil || task.Target != b {
+		t.Fatal("expected the accepted peer to be served")
+	}
+	task.Done(task.Entries)
+	if prq.Pop() != nil {
+		t.Fatal("refused peer should not be served")
+	}
+
+	delete(strategy.refused, a.Pretty())
+	for i := 0; i < 6; i++ {
+		task := prq.Pop()
+		if task == nil || task.Target != a {
+			t.Fatal("wants of a peer should stay queued until it is accepted")
+		}
+	}
+}
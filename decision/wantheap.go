@@ -0,0 +1,79 @@
+package decision
+
+import (
+	"container/heap"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// wantHeap orders a peer's wants by priority, lowest first, so the want to
+// evict from a full wantlist is found without scanning the wantlist.
+type wantHeap struct {
+	items []*wantItem
+	index map[cid.Cid]*wantItem
+}
+
+type wantItem struct {
+	cid      cid.Cid
+	priority int
+	pos      int
+}
+
+func newWantHeap() *wantHeap {
+	return &wantHeap{index: make(map[cid.Cid]*wantItem)}
+}
+
+// Put adds the want for c, or updates its priority.
+func (h *wantHeap) Put(c cid.Cid, priority int) {
+	if it, ok := h.index[c]; ok {
+		it.priority = priority
+		heap.Fix(h, it.pos)
+		return
+	}
+	it := &wantItem{cid: c, priority: priority}
+	h.index[c] = it
+	heap.Push(h, it)
+}
+
+// Remove drops the want for c, if there is one.
+func (h *wantHeap) Remove(c cid.Cid) {
+	if it, ok := h.index[c]; ok {
+		heap.Remove(h, it.pos)
+		delete(h.index, c)
+	}
+}
+
+// Lowest returns the want with the lowest priority. ok is false if the heap
+// is empty.
+func (h *wantHeap) Lowest() (c cid.Cid, priority int, ok bool) {
+	if len(h.items) == 0 {
+		return cid.Cid{}, 0, false
+	}
+	return h.items[0].cid, h.items[0].priority, true
+}
+
+// heap.Interface, not to be called directly
+
+func (h *wantHeap) Len() int { return len(h.items) }
+
+func (h *wantHeap) Less(i, j int) bool { return h.items[i].priority < h.items[j].priority }
+
+func (h *wantHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].pos = i
+	h.items[j].pos = j
+}
+
+func (h *wantHeap) Push(x interface{}) {
+	it := x.(*wantItem)
+	it.pos = len(h.items)
+	h.items = append(h.items, it)
+}
+
+func (h *wantHeap) Pop() interface{} {
+	n := len(h.items) - 1
+	it := h.items[n]
+	h.items[n] = nil
+	h.items = h.items[:n]
+	return it
+}
@@ -0,0 +1,40 @@
+package decision
+
+import (
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+func TestWantHeapLowest(t *testing.T) {
+	h := newWantHeap()
+	if _, _, ok := h.Lowest(); ok {
+		t.Fatal("expected an empty heap")
+	}
+	var bs []blocks.Block
+	for _, p := range []int{5, 2, 8, 1, 9} {
+		b := blocks.NewBlock([]byte(fmt.Sprint(p)))
+		bs = append(bs, b)
+		h.Put(b.Cid(), p)
+	}
+	check := func(expected int) {
+		t.Helper()
+		if _, p, ok := h.Lowest(); !ok || p != expected {
+			t.Fatalf("expected lowest priority %d, got %d", expected, p)
+		}
+	}
+	check(1)
+	h.Remove(bs[3].Cid())
+	check(2)
+	h.Put(bs[1].Cid(), 7)
+	check(5)
+	h.Remove(bs[0].Cid())
+	h.Remove(bs[0].Cid())
+	if c, p, _ := h.Lowest(); p != 7 || !c.Equals(bs[1].Cid()) {
+		t.Fatal("expected the updated want to be lowest")
+	}
+	if h.Len() != 3 {
+		t.Fatal("expected 3 wants, got", h.Len())
+	}
+}
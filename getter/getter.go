@@ -3,6 +3,7 @@ package getter
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	notifications "github.com/ipfs/go-bitswap/notifications"
 	logging "github.com/ipfs/go-log"
@@ -57,6 +58,118 @@ func SyncGetBlock(p context.Context, k cid.Cid, gb GetBlocksFunc) (blocks.Block,
 	}
 }
 
+// AsyncGetBlocksOrdered takes a set of block cids and a function for getting
+// blocks, and returns a channel delivering the blocks in the order of the
+// cids. At most window blocks are asked for at a time: the next block is
+// only asked for once the first block of the window was delivered, so few
+// blocks are held waiting for an earlier one. A block repeated in the cids
+// is only asked for once. The channel is closed once all blocks were
+// delivered, or earlier if getting a block fails or ctx ends. The error
+// channel then receives why, ErrCancelled if the blocks stopped coming, and
+// is closed after the block channel.
+func AsyncGetBlocksOrdered(ctx context.Context, keys []cid.Cid, window int, gb GetBlocksFunc) (<-chan blocks.Block, <-chan error) {
+	if window < 1 {
+		window = 1
+	}
+	out := make(chan blocks.Block)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		if err := deliverOrdered(ctx, keys, window, gb, out); err != nil {
+			errs <- err
+		}
+	}()
+	return out, errs
+}
+
+// orderedSlot is a block of the window of an ordered request.
+type orderedSlot struct {
+	c cid.Cid
+	// promise delivers the block, nil if an earlier slot of the window
+	// fetches the same block or it was delivered already
+	promise <-chan blocks.Block
+	blk     blocks.Block
+}
+
+// deliverOrdered delivers the blocks in order on out, which it closes.
+// Returns why it stopped before delivering every block.
+func deliverOrdered(ctx context.Context, keys []cid.Cid, window int, gb GetBlocksFunc, out chan<- blocks.Block) error {
+	// cancelling ctx cancels the wants of the blocks not delivered
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		close(out)
+	}()
+
+	// delivered blocks repeated later in keys are kept until their last
+	// repeat is delivered
+	repeats := make(map[cid.Cid]int)
+	for _, k := range keys {
+		repeats[k]++
+	}
+	delivered := make(map[cid.Cid]blocks.Block)
+
+	var slots []*orderedSlot
+	next := 0
+	for next < len(keys) || len(slots) > 0 {
+		for ; next < len(keys) && len(slots) < window; next++ {
+			slot := &orderedSlot{c: keys[next], blk: delivered[keys[next]]}
+			if slot.blk == nil && !fetching(slots, slot.c) {
+				promise, err := gb(ctx, []cid.Cid{slot.c})
+				if err != nil {
+					return fmt.Errorf("getting block %s in order: %s", slot.c, err)
+				}
+				slot.promise = promise
+			}
+			slots = append(slots, slot)
+		}
+
+		head := slots[0]
+		if head.blk == nil {
+			select {
+			case blk, ok := <-head.promise:
+				if !ok {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					return ErrCancelled
+				}
+				head.blk = blk
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		for _, s := range slots[1:] {
+			if s.promise == nil && s.c.Equals(head.c) {
+				s.blk = head.blk
+			}
+		}
+
+		select {
+		case out <- head.blk:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if repeats[head.c]--; repeats[head.c] > 0 {
+			delivered[head.c] = head.blk
+		} else {
+			delete(delivered, head.c)
+		}
+		slots = slots[1:]
+	}
+	return nil
+}
+
+// fetching returns true if a slot of the window fetches the block.
+func fetching(slots []*orderedSlot, c cid.Cid) bool {
+	for _, s := range slots {
+		if s.promise != nil && s.c.Equals(c) {
+			return true
+		}
+	}
+	return false
+}
+
 // WantFunc is any function that can express a want for set of blocks.
 type WantFunc func(context.Context, []cid.Cid)
 
@@ -110,3 +223,122 @@ func handleIncoming(ctx context.Context, remaining *cid.Set, in <-chan blocks.Bl
 		}
 	}
 }
+
+var (
+	// ErrTimeout is the reason a block was not fetched when the request timed
+	// out while peers that may have the block were being asked for it.
+	ErrTimeout = errors.New("timed out")
+	// ErrNoProviders is the reason a block was not fetched when the request
+	// timed out before any peer to ask for the block was found.
+	ErrNoProviders = errors.New("no providers found")
+	// ErrRejected is the reason a block was not fetched when the request
+	// timed out after every peer asked for the block turned it down.
+	ErrRejected = errors.New("rejected by peers")
+	// ErrCancelled is the reason a block was not fetched when the request was
+	// cancelled or the fetcher shut down.
+	ErrCancelled = errors.New("cancelled")
+)
+
+// FetchError is the error of a block that could not be fetched.
+type FetchError struct {
+	Cid cid.Cid
+	// Reason is one of ErrTimeout, ErrNoProviders, ErrRejected or
+	// ErrCancelled.
+	Reason error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("fetching %s: %s", e.Cid, e.Reason)
+}
+
+// Unwrap returns the reason the block could not be fetched.
+func (e *FetchError) Unwrap() error {
+	return e.Reason
+}
+
+// Result is the outcome of fetching a block: the block, or the error saying
+// why it could not be fetched.
+type Result struct {
+	Cid   cid.Cid
+	Block blocks.Block
+	Err   *FetchError
+}
+
+// ReasonFunc returns why the given blocks could not be fetched before the
+// request timed out. Blocks missing from the returned map failed with
+// ErrTimeout.
+type ReasonFunc func([]cid.Cid) map[cid.Cid]error
+
+// AsyncFetchBlocks is like AsyncGetBlocks, but returns a channel with a
+// result for every requested key, in the order the blocks are fetched or
+// fail. A key requested more than once gets a result each time. The blocks
+// still missing when ctx ends fail with the reason given by the reason
+// function if it timed out, with ErrCancelled otherwise. The channel is
+// closed once every key has a result.
+func AsyncFetchBlocks(ctx context.Context, keys []cid.Cid, notif notifications.PubSub, want WantFunc, cwants func([]cid.Cid), reason ReasonFunc) (<-chan Result, error) {
+	// with room for a result per key, results are never lost if the
+	// caller stops reading
+	out := make(chan Result, len(keys))
+	if len(keys) == 0 {
+		close(out)
+		return out, nil
+	}
+
+	// the number of times each missing block was requested
+	remaining := make(map[cid.Cid]int, len(keys))
+	subCtx, cancel := context.WithCancel(ctx)
+	promise := notif.Subscribe(subCtx, keys...)
+	for _, k := range keys {
+		log.Event(ctx, "Bitswap.GetBlockRequest.Start", k)
+		remaining[k]++
+	}
+
+	want(ctx, keys)
+
+	go handleResults(ctx, cancel, keys, remaining, promise, out, cwants, reason)
+	return out, nil
+}
+
+func handleResults(ctx context.Context, cancel func(), keys []cid.Cid, remaining map[cid.Cid]int, in <-chan blocks.Block, out chan<- Result, cfun func([]cid.Cid), reason ReasonFunc) {
+	defer cancel()
+	for len(remaining) > 0 {
+		blk, ok := <-in
+		if !ok {
+			break
+		}
+		n := remaining[blk.Cid()]
+		delete(remaining, blk.Cid())
+		for i := 0; i < n; i++ {
+			out <- Result{Cid: blk.Cid(), Block: blk}
+		}
+	}
+
+	// in the order requested, without repeats
+	var missing []cid.Cid
+	var requested []int
+	for _, k := range keys {
+		if n, ok := remaining[k]; ok {
+			missing = append(missing, k)
+			requested = append(requested, n)
+			delete(remaining, k)
+		}
+	}
+	var reasons map[cid.Cid]error
+	if len(missing) > 0 && ctx.Err() == context.DeadlineExceeded {
+		reasons = reason(missing)
+	}
+	cfun(missing)
+	for i, k := range missing {
+		err := ErrCancelled
+		if ctx.Err() == context.DeadlineExceeded {
+			err = ErrTimeout
+			if r, ok := reasons[k]; ok {
+				err = r
+			}
+		}
+		for j := 0; j < requested[i]; j++ {
+			out <- Result{Cid: k, Err: &FetchError{Cid: k, Reason: err}}
+		}
+	}
+	close(out)
+}
@@ -1,5 +1,7 @@
 module github.com/ipfs/go-bitswap
 
+go 1.27.1
+
 require (
 	github.com/cskr/pubsub v1.0.2
 	github.com/gogo/protobuf v1.2.1
@@ -20,6 +22,7 @@ require (
 	github.com/ipfs/go-metrics-interface v0.0.1
 	github.com/jbenet/goprocess v0.0.0-20160826012719-b497e2f366b8
 	github.com/libp2p/go-libp2p v0.0.2
+	github.com/libp2p/go-libp2p-crypto v0.0.1
 	github.com/libp2p/go-libp2p-host v0.0.1
 	github.com/libp2p/go-libp2p-interface-connmgr v0.0.1
 	github.com/libp2p/go-libp2p-loggables v0.0.1
@@ -32,3 +35,115 @@ require (
 	github.com/libp2p/go-testutil v0.0.1
 	github.com/multiformats/go-multiaddr v0.0.1
 )
+
+require (
+	github.com/AndreasBriese/bbloom v0.0.0-20180913140656-343706a395b7 // indirect
+	github.com/Kubuxu/go-os-helper v0.0.1 // indirect
+	github.com/aead/siphash v1.0.1 // indirect
+	github.com/btcsuite/btcd v0.0.0-20190213025234-306aecffea32 // indirect
+	github.com/btcsuite/btclog v0.0.0-20170628155309-84c8d2346e9f // indirect
+	github.com/btcsuite/btcutil v0.0.0-20190207003914-4c204d697803 // indirect
+	github.com/btcsuite/go-socks v0.0.0-20170105172521-4720035b7bfd // indirect
+	github.com/btcsuite/goleveldb v0.0.0-20160330041536-7834afc9e8cd // indirect
+	github.com/btcsuite/snappy-go v0.0.0-20151229074030-0bdef8d06723 // indirect
+	github.com/btcsuite/websocket v0.0.0-20150119174127-31079b680792 // indirect
+	github.com/btcsuite/winsvc v1.0.0 // indirect
+	github.com/coreos/go-semver v0.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/dgraph-io/badger v1.5.5-0.20190226225317-8115aed38f8f // indirect
+	github.com/dgryski/go-farm v0.0.0-20190104051053-3adb47b1fb0f // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/fd/go-nat v1.0.0 // indirect
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/go-check/check v0.0.0-20180628173108-788fd7840127 // indirect
+	github.com/golang/protobuf v1.3.0 // indirect
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
+	github.com/google/uuid v1.1.1 // indirect
+	github.com/gorilla/websocket v1.4.0 // indirect
+	github.com/gxed/hashland/keccakpg v0.0.1 // indirect
+	github.com/gxed/hashland/murmur3 v0.0.1 // indirect
+	github.com/hpcloud/tail v1.0.0 // indirect
+	github.com/huin/goupnp v0.0.0-20180415215157-1395d1447324 // indirect
+	github.com/ipfs/bbloom v0.0.1 // indirect
+	github.com/ipfs/go-ds-badger v0.0.2 // indirect
+	github.com/ipfs/go-ds-leveldb v0.0.1 // indirect
+	github.com/ipfs/go-ipfs-ds-help v0.0.1 // indirect
+	github.com/jackpal/gateway v1.0.4 // indirect
+	github.com/jackpal/go-nat-pmp v1.0.1 // indirect
+	github.com/jbenet/go-cienv v0.0.0-20150120210510-1bb1476777ec // indirect
+	github.com/jbenet/go-temp-err-catcher v0.0.0-20150120210811-aac704a3f4f2 // indirect
+	github.com/jessevdk/go-flags v0.0.0-20141203071132-1679536dcc89 // indirect
+	github.com/jrick/logrotate v1.0.0 // indirect
+	github.com/kisielk/errcheck v1.1.0 // indirect
+	github.com/kisielk/gotool v1.0.0 // indirect
+	github.com/kkdai/bstream v0.0.0-20161212061736-f391b8402d23 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/kr/pty v1.1.1 // indirect
+	github.com/kr/text v0.1.0 // indirect
+	github.com/libp2p/go-addr-util v0.0.1 // indirect
+	github.com/libp2p/go-buffer-pool v0.0.1 // indirect
+	github.com/libp2p/go-conn-security v0.0.1 // indirect
+	github.com/libp2p/go-conn-security-multistream v0.0.1 // indirect
+	github.com/libp2p/go-flow-metrics v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-autonat v0.0.2 // indirect
+	github.com/libp2p/go-libp2p-blankhost v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-circuit v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-discovery v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-interface-pnet v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-metrics v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-nat v0.0.2 // indirect
+	github.com/libp2p/go-libp2p-record v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-secio v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-swarm v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-transport v0.0.4 // indirect
+	github.com/libp2p/go-libp2p-transport-upgrader v0.0.1 // indirect
+	github.com/libp2p/go-maddr-filter v0.0.1 // indirect
+	github.com/libp2p/go-mplex v0.0.1 // indirect
+	github.com/libp2p/go-msgio v0.0.1 // indirect
+	github.com/libp2p/go-reuseport v0.0.1 // indirect
+	github.com/libp2p/go-reuseport-transport v0.0.1 // indirect
+	github.com/libp2p/go-stream-muxer v0.0.1 // indirect
+	github.com/libp2p/go-tcp-transport v0.0.1 // indirect
+	github.com/libp2p/go-ws-transport v0.0.1 // indirect
+	github.com/mattn/go-colorable v0.1.1 // indirect
+	github.com/mattn/go-isatty v0.0.5 // indirect
+	github.com/miekg/dns v1.1.4 // indirect
+	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1 // indirect
+	github.com/minio/sha256-simd v0.0.0-20190131020904-2d45a736cd16 // indirect
+	github.com/mr-tron/base58 v1.1.0 // indirect
+	github.com/multiformats/go-base32 v0.0.3 // indirect
+	github.com/multiformats/go-multiaddr-dns v0.0.2 // indirect
+	github.com/multiformats/go-multiaddr-net v0.0.1 // indirect
+	github.com/multiformats/go-multibase v0.0.1 // indirect
+	github.com/multiformats/go-multihash v0.0.1 // indirect
+	github.com/multiformats/go-multistream v0.0.1 // indirect
+	github.com/onsi/ginkgo v1.7.0 // indirect
+	github.com/onsi/gomega v1.4.3 // indirect
+	github.com/opentracing/opentracing-go v1.0.2 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
+	github.com/stretchr/testify v1.3.0 // indirect
+	github.com/syndtr/goleveldb v1.0.0 // indirect
+	github.com/whyrusleeping/go-keyspace v0.0.0-20160322163242-5b898ac5add1 // indirect
+	github.com/whyrusleeping/go-logging v0.0.0-20170515211332-0457bb6b88fc // indirect
+	github.com/whyrusleeping/go-notifier v0.0.0-20170827234753-097c5d47330f // indirect
+	github.com/whyrusleeping/go-smux-multiplex v3.0.16+incompatible // indirect
+	github.com/whyrusleeping/go-smux-multistream v2.0.2+incompatible // indirect
+	github.com/whyrusleeping/go-smux-yamux v2.0.9+incompatible // indirect
+	github.com/whyrusleeping/mafmt v1.2.8 // indirect
+	github.com/whyrusleeping/mdns v0.0.0-20180901202407-ef14215e6b30 // indirect
+	github.com/whyrusleeping/multiaddr-filter v0.0.0-20160516205228-e903e4adabd7 // indirect
+	github.com/whyrusleeping/yamux v1.1.5 // indirect
+	golang.org/x/crypto v0.0.0-20190228161510-8dd112bcdc25 // indirect
+	golang.org/x/net v0.0.0-20190227160552-c95aed5357e7 // indirect
+	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
+	golang.org/x/sys v0.0.0-20190228124157-a34e9553db1e // indirect
+	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/tools v0.0.0-20180221164845-07fd8470d635 // indirect
+	google.golang.org/genproto v0.0.0-20180831171423-11092d34479b // indirect
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/fsnotify.v1 v1.4.7 // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	gopkg.in/yaml.v2 v2.2.1 // indirect
+)
@@ -0,0 +1,216 @@
+package inboundqueue
+
+import (
+	"context"
+	"sync"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+
+	logging "github.com/ipfs/go-log"
+	metrics "github.com/ipfs/go-metrics-interface"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+var log = logging.Logger("bitswap")
+
+// MessageHandler processes a message taken off the queue.
+type MessageHandler func(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage)
+
+// Stats is a snapshot of the state of the queue.
+type Stats struct {
+	// Depth is the number of messages waiting to be processed.
+	Depth int
+	// Dropped is the number of messages dropped because their peer's
+	// buffer was full.
+	Dropped uint64
+}
+
+type queuedMessage struct {
+	ctx context.Context
+	msg bsmsg.BitSwapMessage
+}
+
+type peerQueue struct {
+	p        peer.ID
+	messages []queuedMessage
+	// set while a worker is processing one of the peer's messages
+	busy bool
+}
+
+// InboundQueue sits between the network and bitswap. It buffers a bounded
+// number of messages per peer and hands them to a fixed pool of workers,
+// taking one message from each peer in turn so a single busy peer can't
+// monopolize processing. Messages from the same peer are processed one at
+// a time, in the order they were received.
+type InboundQueue struct {
+	ctx        context.Context
+	cancel     func()
+	running    sync.WaitGroup
+	handler    MessageHandler
+	workers    int
+	maxPerPeer int
+
+	lk    sync.Mutex
+	peers map[peer.ID]*peerQueue
+	// peers with messages that aren't being processed, in the order they
+	// get their next turn
+	ready   []*peerQueue
+	depth   int
+	dropped uint64
+	// wakes up idle workers
+	work chan struct{}
+
+	depthGauge  metrics.Gauge
+	dropCounter metrics.Counter
+}
+
+// New creates a new InboundQueue that passes messages to handler from the
+// given number of workers, buffering up to maxPerPeer messages per peer.
+func New(ctx context.Context, handler MessageHandler, workers int, maxPerPeer int) *InboundQueue {
+	ctx, cancel := context.WithCancel(ctx)
+	return &InboundQueue{
+		ctx:        ctx,
+		cancel:     cancel,
+		handler:    handler,
+		workers:    workers,
+		maxPerPeer: maxPerPeer,
+		peers:      make(map[peer.ID]*peerQueue),
+		work:       make(chan struct{}, workers),
+		depthGauge: metrics.NewCtx(ctx, "inbound_queue_depth",
+			"Number of received messages waiting to be processed").Gauge(),
+		dropCounter: metrics.NewCtx(ctx, "inbound_queue_dropped_total",
+			"Number of received messages dropped because the peer's queue was full").Counter(),
+	}
+}
+
+// Startup starts the workers processing the queue.
+func (iq *InboundQueue) Startup() {
+	iq.running.Add(iq.workers)
+	for i := 0; i < iq.workers; i++ {
+		go iq.runWorker()
+	}
+}
+
+// Shutdown stops the queue from accepting messages and waits for the workers
+// to finish the messages they are processing. Messages still queued are
+// dropped.
+func (iq *InboundQueue) Shutdown() {
+	iq.cancel()
+	iq.running.Wait()
+}
+
+// Enqueue adds a message from a peer to the queue. It returns false if the
+// message was dropped because the peer's buffer is full or the queue is shut
+// down.
+func (iq *InboundQueue) Enqueue(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage) bool {
+	select {
+	case <-iq.ctx.Done():
+		return false
+	default:
+	}
+
+	iq.lk.Lock()
+	pq, ok := iq.peers[p]
+	if !ok {
+		pq = &peerQueue{p: p}
+		iq.peers[p] = pq
+	}
+	if len(pq.messages) >= iq.maxPerPeer {
+		iq.dropped++
+		iq.lk.Unlock()
+		iq.dropCounter.Inc()
+		log.Debugf("inbound queue for %s full, dropping message", p)
+		return false
+	}
+
+	pq.messages = append(pq.messages, queuedMessage{ctx, incoming})
+	iq.depth++
+	if len(pq.messages) == 1 && !pq.busy {
+		iq.ready = append(iq.ready, pq)
+	}
+	iq.lk.Unlock()
+
+	iq.depthGauge.Inc()
+	iq.signalWork()
+	return true
+}
+
+// Stats returns the current depth of the queue and the number of messages
+// dropped so far.
+func (iq *InboundQueue) Stats() Stats {
+	iq.lk.Lock()
+	defer iq.lk.Unlock()
+	return Stats{
+		Depth:   iq.depth,
+		Dropped: iq.dropped,
+	}
+}
+
+func (iq *InboundQueue) signalWork() {
+	select {
+	case iq.work <- struct{}{}:
+	default:
+	}
+}
+
+func (iq *InboundQueue) runWorker() {
+	defer iq.running.Done()
+	for {
+		select {
+		case <-iq.ctx.Done():
+			return
+		default:
+		}
+
+		pq, qm, ok := iq.next()
+		if !ok {
+			select {
+			case <-iq.work:
+				continue
+			case <-iq.ctx.Done():
+				return
+			}
+		}
+
+		iq.handler(qm.ctx, pq.p, qm.msg)
+		iq.done(pq)
+	}
+}
+
+// next takes the first message of the peer whose turn it is.
+func (iq *InboundQueue) next() (*peerQueue, queuedMessage, bool) {
+	iq.lk.Lock()
+	defer iq.lk.Unlock()
+	if len(iq.ready) == 0 {
+		return nil, queuedMessage{}, false
+	}
+
+	pq := iq.ready[0]
+	iq.ready[0] = nil
+	iq.ready = iq.ready[1:]
+
+	qm := pq.messages[0]
+	pq.messages[0] = queuedMessage{}
+	pq.messages = pq.messages[1:]
+	pq.busy = true
+	iq.depth--
+	iq.depthGauge.Dec()
+	return pq, qm, true
+}
+
+// done puts the peer back at the end of the line if it has more messages.
+func (iq *InboundQueue) done(pq *peerQueue) {
+	iq.lk.Lock()
+	pq.busy = false
+	more := len(pq.messages) > 0
+	if more {
+		iq.ready = append(iq.ready, pq)
+	} else {
+		delete(iq.peers, pq.p)
+	}
+	iq.lk.Unlock()
+
+	if more {
+		iq.signalWork()
+	}
+}
@@ -0,0 +1,146 @@
+package inboundqueue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	"github.com/ipfs/go-bitswap/testutil"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+type processed struct {
+	p   peer.ID
+	msg bsmsg.BitSwapMessage
+}
+
+type fakeHandler struct {
+	lk        sync.Mutex
+	processed []processed
+	release   chan struct{}
+	done      chan struct{}
+}
+
+func newFakeHandler() *fakeHandler {
+	return &fakeHandler{
+		release: make(chan struct{}),
+		done:    make(chan struct{}, 100),
+	}
+}
+
+func (fh *fakeHandler) handle(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage) {
+	<-fh.release
+	fh.lk.Lock()
+	fh.processed = append(fh.processed, processed{p, incoming})
+	fh.lk.Unlock()
+	fh.done <- struct{}{}
+}
+
+func (fh *fakeHandler) waitProcessed(t *testing.T, n int) []processed {
+	for i := 0; i < n; i++ {
+		select {
+		case <-fh.done:
+		case <-time.After(time.Second):
+			t.Fatal("messages were not processed")
+		}
+	}
+	fh.lk.Lock()
+	defer fh.lk.Unlock()
+	return fh.processed
+}
+
+func TestRoundRobinAcrossPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fh := newFakeHandler()
+	iq := New(ctx, fh.handle, 1, 10)
+	iq.Startup()
+	peers := testutil.GeneratePeers(3)
+
+	// the first peer floods the queue before the others send anything
+	for i := 0; i < 5; i++ {
+		iq.Enqueue(ctx, peers[0], bsmsg.New(false))
+	}
+	iq.Enqueue(ctx, peers[1], bsmsg.New(false))
+	iq.Enqueue(ctx, peers[2], bsmsg.New(false))
+
+	close(fh.release)
+	result := fh.waitProcessed(t, 7)
+	if result[1].p != peers[1] || result[2].p != peers[2] {
+		t.Fatal("peers should take turns")
+	}
+	if stats := iq.Stats(); stats.Depth != 0 {
+		t.Fatal("queue should be empty after processing")
+	}
+}
+
+func TestMessagesFromPeerProcessedInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fh := newFakeHandler()
+	iq := New(ctx, fh.handle, 4, 10)
+	iq.Startup()
+	p := testutil.GeneratePeers(1)[0]
+
+	var sent []bsmsg.BitSwapMessage
+	for i := 0; i < 5; i++ {
+		msg := bsmsg.New(false)
+		sent = append(sent, msg)
+		iq.Enqueue(ctx, p, msg)
+	}
+
+	close(fh.release)
+	result := fh.waitProcessed(t, 5)
+	for i, r := range result {
+		if r.msg != sent[i] {
+			t.Fatal("messages from the same peer should be processed in order")
+		}
+	}
+}
+
+func TestDropsWhenPeerQueueFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fh := newFakeHandler()
+	iq := New(ctx, fh.handle, 1, 2)
+	iq.Startup()
+	peers := testutil.GeneratePeers(2)
+
+	// the worker blocks on the first message, leaving room for two more
+	accepted := 0
+	for i := 0; i < 5; i++ {
+		if iq.Enqueue(ctx, peers[0], bsmsg.New(false)) {
+			accepted++
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if accepted != 3 {
+		t.Fatalf("expected 3 messages to be accepted, got %d", accepted)
+	}
+	if !iq.Enqueue(ctx, peers[1], bsmsg.New(false)) {
+		t.Fatal("a full queue for one peer should not affect other peers")
+	}
+
+	stats := iq.Stats()
+	if stats.Depth != 3 || stats.Dropped != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	close(fh.release)
+	fh.waitProcessed(t, 4)
+}
+
+func TestEnqueueAfterShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fh := newFakeHandler()
+	iq := New(ctx, fh.handle, 1, 2)
+	iq.Startup()
+	cancel()
+
+	if iq.Enqueue(ctx, testutil.GeneratePeers(1)[0], bsmsg.New(false)) {
+		t.Fatal("should not accept messages after shutdown")
+	}
+}
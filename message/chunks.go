@@ -0,0 +1,258 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// DefaultBlockChunkSize is the size of the chunks blocks are split into when
+// they are too large to be sent in one message.
+const DefaultBlockChunkSize = 1 << 20
+
+// DefaultMaxPendingChunkBytes is the default bound on the total size of the
+// blocks a single peer may be sending us in chunks at the same time.
+const DefaultMaxPendingChunkBytes = 32 << 20
+
+// DefaultPartialBlockTimeout is how long a partially received block is kept
+// without receiving another chunk of it.
+const DefaultPartialBlockTimeout = time.Minute
+
+// ErrChunkedBlockMismatch is returned when a reassembled block does not hash
+// to its CID.
+var ErrChunkedBlockMismatch = errors.New("reassembled block does not match its cid")
+
+// SplitLargeBlocks splits the blocks in the message larger than chunkSize
+// into chunks of at most chunkSize bytes. It returns the rest of the message
+// followed by one message per chunk, in order, or just the message if it has
+// no large blocks.
+func SplitLargeBlocks(m BitSwapMessage, chunkSize int) []BitSwapMessage {
+	var large []blocks.Block
+	for _, b := range m.Blocks() {
+		if len(b.RawData()) > chunkSize {
+			large = append(large, b)
+		}
+	}
+	if len(large) == 0 {
+		return []BitSwapMessage{m}
+	}
+
+	var out []BitSwapMessage
+	rest := copyWithoutChunks(m, func(b blocks.Block) bool {
+		return len(b.RawData()) <= chunkSize
+	})
+	for _, bc := range m.BlockChunks() {
+		rest.AddBlockChunk(bc)
+	}
+	if !rest.Empty() {
+		out = append(out, rest)
+	}
+
+	for _, b := range large {
+		data := b.RawData()
+		for offset := 0; offset < len(data); offset += chunkSize {
+			end := offset + chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			chunkMsg := New(false)
+			chunkMsg.AddBlockChunk(BlockChunk{
+				Cid:       b.Cid(),
+				TotalSize: uint64(len(data)),
+				Offset:    uint64(offset),
+				Data:      data[offset:end],
+			})
+			out = append(out, chunkMsg)
+		}
+	}
+	return out
+}
+
+// copyWithoutChunks copies everything but the block chunks and the blocks
+// not matching keepBlock from m into a new message.
+func copyWithoutChunks(m BitSwapMessage, keepBlock func(blocks.Block) bool) BitSwapMessage {
+	out := New(m.Full())
+	for _, e := range m.Wantlist() {
+		if e.Cancel {
+			out.Cancel(e.Cid)
+		} else {
+			out.AddEntryWithType(e.Cid, e.Priority, e.WantType, e.SendDontHave)
+		}
+	}
+	for _, b := range m.Blocks() {
+		if keepBlock(b) {
+			out.AddBlock(b)
+		}
+	}
+	for _, c := range m.Haves() {
+		out.AddHave(c)
+	}
+	for _, c := range m.DontHaves() {
+		out.AddDontHave(c)
+	}
+	for _, c := range m.NotPermitted() {
+		out.AddNotPermitted(c)
+	}
+	out.SetReceipt(m.Receipt())
+	return out
+}
+
+// ChunkAssembler reassembles blocks received in chunks, bounding how much
+// memory each peer's partially received blocks may hold and for how long.
+type ChunkAssembler struct {
+	maxPending uint64
+	timeout    time.Duration
+
+	lk    sync.Mutex
+	peers map[peer.ID]*peerChunks
+	// when partial blocks were last checked for expiry
+	lastExpiry time.Time
+}
+
+type peerChunks struct {
+	// sum of the sizes of the partial blocks
+	pending uint64
+	blocks  map[cid.Cid]*partialBlock
+}
+
+type partialBlock struct {
+	data     []byte
+	received uint64
+	// when the last chunk was received
+	updated time.Time
+}
+
+// NewChunkAssembler returns a ChunkAssembler that holds at most maxPending
+// bytes of partially received blocks per peer.
+func NewChunkAssembler(maxPending int) *ChunkAssembler {
+	return &ChunkAssembler{
+		maxPending: uint64(maxPending),
+		timeout:    DefaultPartialBlockTimeout,
+		peers:      make(map[peer.ID]*peerChunks),
+		lastExpiry: time.Now(),
+	}
+}
+
+// Assemble adds the chunks in a message from p to the blocks being
+// reassembled. It returns the message with its chunks replaced by the
+// blocks they completed. Chunks that are out of order, don't fit in the
+// peer's allowance or complete a block that doesn't match its CID are
+// dropped together with the rest of their block, and the last such problem
+// is returned alongside the message. A chunk at offset 0 restarts its block,
+// as the peer resends blocks from the start when a stream fails mid-block.
+// Partial blocks that received no chunk for DefaultPartialBlockTimeout are
+// dropped as messages from any peer come in.
+func (ca *ChunkAssembler) Assemble(p peer.ID, m BitSwapMessage) (BitSwapMessage, error) {
+	ca.lk.Lock()
+	defer ca.lk.Unlock()
+
+	now := time.Now()
+	ca.expire(now)
+
+	chunks := m.BlockChunks()
+	if len(chunks) == 0 {
+		return m, nil
+	}
+
+	out := copyWithoutChunks(m, func(blocks.Block) bool { return true })
+
+	var err error
+	for _, bc := range chunks {
+		b, cerr := ca.addChunk(p, bc, now)
+		if cerr != nil {
+			err = cerr
+			continue
+		}
+		if b != nil {
+			out.AddBlock(b)
+		}
+	}
+	return out, err
+}
+
+func (ca *ChunkAssembler) addChunk(p peer.ID, bc BlockChunk, now time.Time) (blocks.Block, error) {
+	pc, ok := ca.peers[p]
+	if !ok {
+		pc = &peerChunks{blocks: make(map[cid.Cid]*partialBlock)}
+	}
+
+	partial, ok := pc.blocks[bc.Cid]
+	if ok && bc.Offset == 0 {
+		// the peer started sending the block over
+		ca.drop(p, pc, bc.Cid)
+		ok = false
+	}
+	if !ok {
+		if bc.Offset != 0 {
+			return nil, fmt.Errorf("chunk of %s at offset %d without start of block", bc.Cid, bc.Offset)
+		}
+		if bc.TotalSize > ca.maxPending-pc.pending {
+			return nil, fmt.Errorf("chunked block %s of %d bytes exceeds allowance for peer", bc.Cid, bc.TotalSize)
+		}
+		partial = &partialBlock{data: make([]byte, bc.TotalSize)}
+		pc.blocks[bc.Cid] = partial
+		pc.pending += bc.TotalSize
+		ca.peers[p] = pc
+	}
+
+	if bc.Offset != partial.received || bc.TotalSize != uint64(len(partial.data)) ||
+		uint64(len(bc.Data)) > uint64(len(partial.data))-partial.received {
+		ca.drop(p, pc, bc.Cid)
+		return nil, fmt.Errorf("unexpected chunk of %s at offset %d", bc.Cid, bc.Offset)
+	}
+	partial.received += uint64(copy(partial.data[bc.Offset:], bc.Data))
+	partial.updated = now
+	if partial.received < uint64(len(partial.data)) {
+		return nil, nil
+	}
+
+	ca.drop(p, pc, bc.Cid)
+	c, err := bc.Cid.Prefix().Sum(partial.data)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Equals(bc.Cid) {
+		return nil, ErrChunkedBlockMismatch
+	}
+	return blocks.NewBlockWithCid(partial.data, c)
+}
+
+func (ca *ChunkAssembler) drop(p peer.ID, pc *peerChunks, c cid.Cid) {
+	partial, ok := pc.blocks[c]
+	if !ok {
+		return
+	}
+	delete(pc.blocks, c)
+	pc.pending -= uint64(len(partial.data))
+	if len(pc.blocks) == 0 {
+		delete(ca.peers, p)
+	}
+}
+
+// expire drops the partial blocks that received no chunk for the timeout.
+// The blocks are checked at most twice per timeout.
+func (ca *ChunkAssembler) expire(now time.Time) {
+	if now.Sub(ca.lastExpiry) < ca.timeout/2 {
+		return
+	}
+	ca.lastExpiry = now
+	for p, pc := range ca.peers {
+		for c, partial := range pc.blocks {
+			if now.Sub(partial.updated) >= ca.timeout {
+				ca.drop(p, pc, c)
+			}
+		}
+	}
+}
+
+// PeerGone drops the partially received blocks of a peer.
+func (ca *ChunkAssembler) PeerGone(p peer.ID) {
+	ca.lk.Lock()
+	defer ca.lk.Unlock()
+	delete(ca.peers, p)
+}
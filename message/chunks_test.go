@@ -0,0 +1,187 @@
+package message
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func randomBlock(size int) blocks.Block {
+	data := make([]byte, size)
+	rand.Read(data)
+	return blocks.NewBlock(data)
+}
+
+func chunkedBlock(t *testing.T, b blocks.Block, chunkSize int) []BitSwapMessage {
+	m := New(false)
+	m.AddBlock(b)
+	parts := SplitLargeBlocks(m, chunkSize)
+	for _, part := range parts {
+		if len(part.Blocks()) != 0 {
+			t.Fatal("large block should not be sent whole")
+		}
+	}
+	return parts
+}
+
+func TestSplitAndAssembleLargeBlock(t *testing.T) {
+	p := peer.ID("peer")
+	small := blocks.NewBlock([]byte("small"))
+	large := randomBlock(350)
+
+	m := New(false)
+	m.AddBlock(small)
+	m.AddBlock(large)
+	m.AddEntry(mkFakeCid("want"), 1)
+	parts := SplitLargeBlocks(m, 100)
+	if len(parts) != 5 {
+		t.Fatalf("expected rest of message and 4 chunks, got %d messages", len(parts))
+	}
+	if len(parts[0].Blocks()) != 1 || len(parts[0].Wantlist()) != 1 {
+		t.Fatal("small block and wants should be sent as they are")
+	}
+
+	ca := NewChunkAssembler(1000)
+	var received []blocks.Block
+	for _, part := range parts {
+		// round trip through the wire format
+		buf := new(bytes.Buffer)
+		if err := part.ToNetV2(buf); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := FromNet(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assembled, err := ca.Assemble(p, decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(assembled.BlockChunks()) != 0 {
+			t.Fatal("chunks should be consumed by the assembler")
+		}
+		received = append(received, assembled.Blocks()...)
+	}
+
+	if len(received) != 2 || !received[1].Cid().Equals(large.Cid()) {
+		t.Fatal("large block was not reassembled")
+	}
+	if !bytes.Equal(received[1].RawData(), large.RawData()) {
+		t.Fatal("reassembled block data differs")
+	}
+	if len(ca.peers) != 0 {
+		t.Fatal("assembler should not hold on to completed blocks")
+	}
+}
+
+func TestAssembleRejectsOutOfOrderChunks(t *testing.T) {
+	p := peer.ID("peer")
+	parts := chunkedBlock(t, randomBlock(300), 100)
+
+	ca := NewChunkAssembler(1000)
+	if _, err := ca.Assemble(p, parts[1]); err == nil {
+		t.Fatal("expected error for chunk without start of block")
+	}
+	if _, err := ca.Assemble(p, parts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Assemble(p, parts[2]); err == nil {
+		t.Fatal("expected error for skipped chunk")
+	}
+	if len(ca.peers) != 0 {
+		t.Fatal("partial block should be dropped after a bad chunk")
+	}
+}
+
+func TestAssembleRestartsResentBlock(t *testing.T) {
+	p := peer.ID("peer")
+	b := randomBlock(300)
+	parts := chunkedBlock(t, b, 100)
+
+	ca := NewChunkAssembler(1000)
+	for _, part := range parts[:2] {
+		if _, err := ca.Assemble(p, part); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the send was interrupted and the block is sent again from the start
+	var received []blocks.Block
+	for _, part := range parts {
+		assembled, err := ca.Assemble(p, part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, assembled.Blocks()...)
+	}
+	if len(received) != 1 || !received[0].Cid().Equals(b.Cid()) {
+		t.Fatal("resent block was not reassembled")
+	}
+	if len(ca.peers) != 0 {
+		t.Fatal("assembler should not hold on to completed blocks")
+	}
+}
+
+func TestAssembleExpiresStalledBlocks(t *testing.T) {
+	ca := NewChunkAssembler(1000)
+	ca.timeout = 20 * time.Millisecond
+	if _, err := ca.Assemble(peer.ID("a"), chunkedBlock(t, randomBlock(300), 100)[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := ca.Assemble(peer.ID("b"), New(false)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ca.peers) != 0 {
+		t.Fatal("stalled partial block should have been dropped")
+	}
+}
+
+func TestAssembleLimitsPendingBytesPerPeer(t *testing.T) {
+	ca := NewChunkAssembler(500)
+	first := chunkedBlock(t, randomBlock(300), 100)
+	second := chunkedBlock(t, randomBlock(300), 100)
+
+	if _, err := ca.Assemble(peer.ID("a"), first[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Assemble(peer.ID("a"), second[0]); err == nil {
+		t.Fatal("expected error exceeding the peer's allowance")
+	}
+	if _, err := ca.Assemble(peer.ID("b"), second[0]); err != nil {
+		t.Fatal("allowance should be per peer")
+	}
+
+	ca.PeerGone(peer.ID("a"))
+	if _, err := ca.Assemble(peer.ID("a"), second[0]); err != nil {
+		t.Fatal("allowance should be released when peer is gone")
+	}
+}
+
+func TestAssembleVerifiesBlockHash(t *testing.T) {
+	b := randomBlock(200)
+	parts := chunkedBlock(t, b, 100)
+	chunk := parts[1].BlockChunks()[0]
+	tampered := New(false)
+	chunk.Data = append([]byte{}, chunk.Data...)
+	chunk.Data[0]++
+	tampered.AddBlockChunk(chunk)
+
+	ca := NewChunkAssembler(1000)
+	if _, err := ca.Assemble(peer.ID("a"), parts[0]); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ca.Assemble(peer.ID("a"), tampered)
+	if err != ErrChunkedBlockMismatch {
+		t.Fatal("expected hash mismatch error")
+	}
+	if len(m.Blocks()) != 0 {
+		t.Fatal("mismatched block should not be delivered")
+	}
+}
@@ -24,9 +24,26 @@ type BitSwapMessage interface {
 	// Blocks returns a slice of unique blocks.
 	Blocks() []blocks.Block
 
+	// Haves returns the keys the sender announced it has (HAVE presences).
+	Haves() []cid.Cid
+
+	// DontHaves returns the keys the sender announced it does not have
+	// (DONT_HAVE presences).
+	DontHaves() []cid.Cid
+
+	// NotPermitted returns the keys the sender refuses to serve us
+	// (NOT_PERMITTED presences).
+	NotPermitted() []cid.Cid
+
 	// AddEntry adds an entry to the Wantlist.
 	AddEntry(key cid.Cid, priority int)
 
+	// AddEntryWithType adds an entry to the Wantlist with the given want type,
+	// asking the receiver to answer with a DONT_HAVE if sendDontHave is set
+	// and it does not have the block. A want-block entry is never downgraded
+	// to a want-have by a later call for the same key.
+	AddEntryWithType(key cid.Cid, priority int, wantType pb.Message_Wantlist_WantType, sendDontHave bool)
+
 	Cancel(key cid.Cid)
 
 	Empty() bool
@@ -35,22 +52,56 @@ type BitSwapMessage interface {
 	Full() bool
 
 	AddBlock(blocks.Block)
+
+	// AddHave adds a HAVE presence for the given key. Presences for blocks
+	// that are part of the message are dropped.
+	AddHave(key cid.Cid)
+
+	// AddDontHave adds a DONT_HAVE presence for the given key.
+	AddDontHave(key cid.Cid)
+
+	// AddNotPermitted adds a NOT_PERMITTED presence for the given key.
+	AddNotPermitted(key cid.Cid)
+
+	// BlockChunks returns the pieces of blocks too large to be sent in a
+	// single message.
+	BlockChunks() []BlockChunk
+
+	// AddBlockChunk adds a piece of a block to the message.
+	AddBlockChunk(BlockChunk)
+
+	// Receipt returns the exchange receipt signed by the sender, nil if the
+	// message carries none.
+	Receipt() *ExchangeReceipt
+
+	// SetReceipt attaches an exchange receipt to the message.
+	SetReceipt(*ExchangeReceipt)
+
 	Exportable
 
 	Loggable() map[string]interface{}
 }
 
+// Exportable serializes a message for a given protocol version. Want-have
+// entries, block presences, block chunks and receipts only exist in bitswap
+// 1.2.0 (V2): older versions receive want-have entries as plain want-block
+// entries and none of the rest.
 type Exportable interface {
 	ToProtoV0() *pb.Message
 	ToProtoV1() *pb.Message
+	ToProtoV2() *pb.Message
 	ToNetV0(w io.Writer) error
 	ToNetV1(w io.Writer) error
+	ToNetV2(w io.Writer) error
 }
 
 type impl struct {
-	full     bool
-	wantlist map[cid.Cid]*Entry
-	blocks   map[cid.Cid]blocks.Block
+	full           bool
+	wantlist       map[cid.Cid]*Entry
+	blocks         map[cid.Cid]blocks.Block
+	blockPresences map[cid.Cid]pb.Message_BlockPresenceType
+	chunks         []BlockChunk
+	receipt        *ExchangeReceipt
 }
 
 func New(full bool) BitSwapMessage {
@@ -59,15 +110,34 @@ func New(full bool) BitSwapMessage {
 
 func newMsg(full bool) *impl {
 	return &impl{
-		blocks:   make(map[cid.Cid]blocks.Block),
-		wantlist: make(map[cid.Cid]*Entry),
-		full:     full,
+		blocks:         make(map[cid.Cid]blocks.Block),
+		wantlist:       make(map[cid.Cid]*Entry),
+		blockPresences: make(map[cid.Cid]pb.Message_BlockPresenceType),
+		full:           full,
 	}
 }
 
 type Entry struct {
 	wantlist.Entry
-	Cancel bool
+	Cancel       bool
+	SendDontHave bool
+}
+
+// BlockChunk is the piece of a block's data starting at Offset.
+type BlockChunk struct {
+	Cid       cid.Cid
+	TotalSize uint64
+	Offset    uint64
+	Data      []byte
+}
+
+// ExchangeReceipt acknowledges the data its signer exchanged with the peer it
+// is sent to. Data is an encoded pb.ReceiptData, signed with the private key
+// matching PublicKey.
+type ExchangeReceipt struct {
+	Data      []byte
+	Signature []byte
+	PublicKey []byte
 }
 
 func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
@@ -77,7 +147,7 @@ func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
 		if err != nil {
 			return nil, fmt.Errorf("incorrectly formatted cid in wantlist: %s", err)
 		}
-		m.addEntry(c, int(e.Priority), e.Cancel)
+		m.addEntry(c, int(e.Priority), e.Cancel, e.WantType, e.SendDontHave)
 	}
 
 	// deprecated
@@ -88,6 +158,8 @@ func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
 	}
 	//
 
+	// the network decompresses messages before they get here, so block
+	// CIDs are always computed from the uncompressed block data
 	for _, b := range pbm.GetPayload() {
 		pref, err := cid.PrefixFromBytes(b.GetPrefix())
 		if err != nil {
@@ -107,6 +179,35 @@ func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
 		m.AddBlock(blk)
 	}
 
+	for _, bp := range pbm.GetBlockPresences() {
+		c, err := cid.Cast(bp.GetCid())
+		if err != nil {
+			return nil, fmt.Errorf("incorrectly formatted cid in block presence: %s", err)
+		}
+		m.addBlockPresence(c, bp.GetType())
+	}
+
+	for _, bc := range pbm.GetChunks() {
+		c, err := cid.Cast(bc.GetCid())
+		if err != nil {
+			return nil, fmt.Errorf("incorrectly formatted cid in block chunk: %s", err)
+		}
+		m.AddBlockChunk(BlockChunk{
+			Cid:       c,
+			TotalSize: bc.GetTotalSize(),
+			Offset:    bc.GetOffset(),
+			Data:      bc.GetData(),
+		})
+	}
+
+	if r := pbm.GetReceipt(); r != nil {
+		m.SetReceipt(&ExchangeReceipt{
+			Data:      r.GetData(),
+			Signature: r.GetSignature(),
+			PublicKey: r.GetPublicKey(),
+		})
+	}
+
 	return m, nil
 }
 
@@ -115,7 +216,7 @@ func (m *impl) Full() bool {
 }
 
 func (m *impl) Empty() bool {
-	return len(m.blocks) == 0 && len(m.wantlist) == 0
+	return len(m.blocks) == 0 && len(m.wantlist) == 0 && len(m.blockPresences) == 0 && len(m.chunks) == 0 && m.receipt == nil
 }
 
 func (m *impl) Wantlist() []Entry {
@@ -134,35 +235,108 @@ func (m *impl) Blocks() []blocks.Block {
 	return bs
 }
 
+func (m *impl) Haves() []cid.Cid {
+	return m.presencesOfType(pb.Message_Have)
+}
+
+func (m *impl) DontHaves() []cid.Cid {
+	return m.presencesOfType(pb.Message_DontHave)
+}
+
+func (m *impl) NotPermitted() []cid.Cid {
+	return m.presencesOfType(pb.Message_NotPermitted)
+}
+
+func (m *impl) presencesOfType(t pb.Message_BlockPresenceType) []cid.Cid {
+	out := make([]cid.Cid, 0, len(m.blockPresences))
+	for c, bpt := range m.blockPresences {
+		if bpt == t {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (m *impl) BlockChunks() []BlockChunk {
+	out := make([]BlockChunk, len(m.chunks))
+	copy(out, m.chunks)
+	return out
+}
+
+func (m *impl) Receipt() *ExchangeReceipt {
+	return m.receipt
+}
+
+func (m *impl) SetReceipt(r *ExchangeReceipt) {
+	m.receipt = r
+}
+
 func (m *impl) Cancel(k cid.Cid) {
 	delete(m.wantlist, k)
-	m.addEntry(k, 0, true)
+	m.addEntry(k, 0, true, pb.Message_Wantlist_Block, false)
 }
 
 func (m *impl) AddEntry(k cid.Cid, priority int) {
-	m.addEntry(k, priority, false)
+	m.addEntry(k, priority, false, pb.Message_Wantlist_Block, false)
 }
 
-func (m *impl) addEntry(c cid.Cid, priority int, cancel bool) {
+func (m *impl) AddEntryWithType(k cid.Cid, priority int, wantType pb.Message_Wantlist_WantType, sendDontHave bool) {
+	m.addEntry(k, priority, false, wantType, sendDontHave)
+}
+
+func (m *impl) addEntry(c cid.Cid, priority int, cancel bool, wantType pb.Message_Wantlist_WantType, sendDontHave bool) {
 	e, exists := m.wantlist[c]
 	if exists {
+		// don't downgrade a pending want-block to a want-have
+		if !cancel && !e.Cancel && e.WantType == pb.Message_Wantlist_Block {
+			wantType = pb.Message_Wantlist_Block
+		}
 		e.Priority = priority
 		e.Cancel = cancel
+		e.WantType = wantType
+		e.SendDontHave = sendDontHave
 	} else {
 		m.wantlist[c] = &Entry{
 			Entry: wantlist.Entry{
 				Cid:      c,
 				Priority: priority,
+				WantType: wantType,
 			},
-			Cancel: cancel,
+			Cancel:       cancel,
+			SendDontHave: sendDontHave,
 		}
 	}
 }
 
 func (m *impl) AddBlock(b blocks.Block) {
+	delete(m.blockPresences, b.Cid())
 	m.blocks[b.Cid()] = b
 }
 
+func (m *impl) AddHave(k cid.Cid) {
+	m.addBlockPresence(k, pb.Message_Have)
+}
+
+func (m *impl) AddDontHave(k cid.Cid) {
+	m.addBlockPresence(k, pb.Message_DontHave)
+}
+
+func (m *impl) AddNotPermitted(k cid.Cid) {
+	m.addBlockPresence(k, pb.Message_NotPermitted)
+}
+
+func (m *impl) AddBlockChunk(bc BlockChunk) {
+	m.chunks = append(m.chunks, bc)
+}
+
+func (m *impl) addBlockPresence(c cid.Cid, t pb.Message_BlockPresenceType) {
+	// the block itself is a better answer than its presence
+	if _, ok := m.blocks[c]; ok {
+		return
+	}
+	m.blockPresences[c] = t
+}
+
 func FromNet(r io.Reader) (BitSwapMessage, error) {
 	pbr := ggio.NewDelimitedReader(r, inet.MessageSizeMax)
 	return FromPBReader(pbr)
@@ -177,17 +351,26 @@ func FromPBReader(pbr ggio.Reader) (BitSwapMessage, error) {
 	return newMessageFromProto(*pb)
 }
 
-func (m *impl) ToProtoV0() *pb.Message {
-	pbm := new(pb.Message)
-	pbm.Wantlist.Entries = make([]pb.Message_Wantlist_Entry, 0, len(m.wantlist))
+// legacyWantlist returns the wantlist as understood by peers that predate
+// bitswap 1.2.0: every entry wants the block.
+func (m *impl) legacyWantlist() pb.Message_Wantlist {
+	entries := make([]pb.Message_Wantlist_Entry, 0, len(m.wantlist))
 	for _, e := range m.wantlist {
-		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, pb.Message_Wantlist_Entry{
+		entries = append(entries, pb.Message_Wantlist_Entry{
 			Block:    e.Cid.Bytes(),
 			Priority: int32(e.Priority),
 			Cancel:   e.Cancel,
 		})
 	}
-	pbm.Wantlist.Full = m.full
+	return pb.Message_Wantlist{
+		Entries: entries,
+		Full:    m.full,
+	}
+}
+
+func (m *impl) ToProtoV0() *pb.Message {
+	pbm := new(pb.Message)
+	pbm.Wantlist = m.legacyWantlist()
 
 	blocks := m.Blocks()
 	pbm.Blocks = make([][]byte, 0, len(blocks))
@@ -198,26 +381,65 @@ func (m *impl) ToProtoV0() *pb.Message {
 }
 
 func (m *impl) ToProtoV1() *pb.Message {
+	pbm := new(pb.Message)
+	pbm.Wantlist = m.legacyWantlist()
+	pbm.Payload = m.payload()
+	return pbm
+}
+
+func (m *impl) ToProtoV2() *pb.Message {
 	pbm := new(pb.Message)
 	pbm.Wantlist.Entries = make([]pb.Message_Wantlist_Entry, 0, len(m.wantlist))
 	for _, e := range m.wantlist {
 		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, pb.Message_Wantlist_Entry{
-			Block:    e.Cid.Bytes(),
-			Priority: int32(e.Priority),
-			Cancel:   e.Cancel,
+			Block:        e.Cid.Bytes(),
+			Priority:     int32(e.Priority),
+			Cancel:       e.Cancel,
+			WantType:     e.WantType,
+			SendDontHave: e.SendDontHave,
 		})
 	}
 	pbm.Wantlist.Full = m.full
+	pbm.Payload = m.payload()
+
+	pbm.BlockPresences = make([]pb.Message_BlockPresence, 0, len(m.blockPresences))
+	for c, t := range m.blockPresences {
+		pbm.BlockPresences = append(pbm.BlockPresences, pb.Message_BlockPresence{
+			Cid:  c.Bytes(),
+			Type: t,
+		})
+	}
 
+	pbm.Chunks = make([]pb.Message_BlockChunk, 0, len(m.chunks))
+	for _, bc := range m.chunks {
+		pbm.Chunks = append(pbm.Chunks, pb.Message_BlockChunk{
+			Cid:       bc.Cid.Bytes(),
+			TotalSize: bc.TotalSize,
+			Offset:    bc.Offset,
+			Data:      bc.Data,
+		})
+	}
+
+	if m.receipt != nil {
+		pbm.Receipt = &pb.Message_Receipt{
+			Data:      m.receipt.Data,
+			Signature: m.receipt.Signature,
+			PublicKey: m.receipt.PublicKey,
+		}
+	}
+	return pbm
+}
+
+func (m *impl) payload() []pb.Message_Block {
 	blocks := m.Blocks()
-	pbm.Payload = make([]pb.Message_Block, 0, len(blocks))
+	payload := make([]pb.Message_Block, 0, len(blocks))
 	for _, b := range blocks {
-		pbm.Payload = append(pbm.Payload, pb.Message_Block{
+		payload = append(payload, pb.Message_Block{
 			Data:   b.RawData(),
 			Prefix: b.Cid().Prefix().Bytes(),
 		})
 	}
-	return pbm
+	return payload
 }
 
 func (m *impl) ToNetV0(w io.Writer) error {
@@ -232,13 +454,22 @@ func (m *impl) ToNetV1(w io.Writer) error {
 	return pbw.WriteMsg(m.ToProtoV1())
 }
 
+func (m *impl) ToNetV2(w io.Writer) error {
+	pbw := ggio.NewDelimitedWriter(w)
+
+	return pbw.WriteMsg(m.ToProtoV2())
+}
+
 func (m *impl) Loggable() map[string]interface{} {
 	blocks := make([]string, 0, len(m.blocks))
 	for _, v := range m.blocks {
 		blocks = append(blocks, v.Cid().String())
 	}
 	return map[string]interface{}{
-		"blocks": blocks,
-		"wants":  m.Wantlist(),
+		"blocks":       blocks,
+		"wants":        m.Wantlist(),
+		"haves":        m.Haves(),
+		"dontHaves":    m.DontHaves(),
+		"notPermitted": m.NotPermitted(),
 	}
 }
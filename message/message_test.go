@@ -196,3 +196,162 @@ func TestDuplicates(t *testing.T) {
 		t.Fatal("Duplicate in BitSwapMessage")
 	}
 }
+
+func TestToAndFromNetV2PreservesWantTypesAndPresences(t *testing.T) {
+	original := New(false)
+	original.AddEntryWithType(mkFakeCid("want-have"), 2, pb.Message_Wantlist_Have, true)
+	original.AddEntry(mkFakeCid("want-block"), 1)
+	original.AddHave(mkFakeCid("have"))
+	original.AddDontHave(mkFakeCid("dont-have"))
+
+	buf := new(bytes.Buffer)
+	if err := original.ToNetV2(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := FromNet(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range copied.Wantlist() {
+		switch {
+		case e.Cid.Equals(mkFakeCid("want-have")):
+			if e.WantType != pb.Message_Wantlist_Have || !e.SendDontHave {
+				t.Fatal("want-have entry lost its type or send-dont-have flag")
+			}
+		case e.Cid.Equals(mkFakeCid("want-block")):
+			if e.WantType != pb.Message_Wantlist_Block || e.SendDontHave {
+				t.Fatal("want-block entry changed type")
+			}
+		default:
+			t.Fatal("unexpected entry", e.Cid)
+		}
+	}
+
+	haves := copied.Haves()
+	if len(haves) != 1 || !haves[0].Equals(mkFakeCid("have")) {
+		t.Fatal("HAVE presence got dropped on marshal")
+	}
+	dontHaves := copied.DontHaves()
+	if len(dontHaves) != 1 || !dontHaves[0].Equals(mkFakeCid("dont-have")) {
+		t.Fatal("DONT_HAVE presence got dropped on marshal")
+	}
+}
+
+func TestToNetV1FallsBackToWantBlocks(t *testing.T) {
+	original := New(false)
+	original.AddEntryWithType(mkFakeCid("want-have"), 1, pb.Message_Wantlist_Have, true)
+	original.AddHave(mkFakeCid("have"))
+
+	buf := new(bytes.Buffer)
+	if err := original.ToNetV1(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := FromNet(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := copied.Wantlist()
+	if len(wl) != 1 || wl[0].WantType != pb.Message_Wantlist_Block || wl[0].SendDontHave {
+		t.Fatal("want-have should be sent as a plain want-block to 1.1.0 peers")
+	}
+	if len(copied.Haves()) != 0 {
+		t.Fatal("block presences should not be sent to 1.1.0 peers")
+	}
+}
+
+func TestWantBlockNotDowngradedToWantHave(t *testing.T) {
+	c := mkFakeCid("foo")
+	msg := New(false)
+
+	msg.AddEntry(c, 1)
+	msg.AddEntryWithType(c, 1, pb.Message_Wantlist_Have, false)
+	if msg.Wantlist()[0].WantType != pb.Message_Wantlist_Block {
+		t.Fatal("want-block was downgraded to want-have")
+	}
+
+	msg.Cancel(c)
+	msg.AddEntryWithType(c, 1, pb.Message_Wantlist_Have, false)
+	if msg.Wantlist()[0].WantType != pb.Message_Wantlist_Have {
+		t.Fatal("cancelled want should be replaceable by a want-have")
+	}
+}
+
+func TestBlockSupersedesPresence(t *testing.T) {
+	b := blocks.NewBlock([]byte("foo"))
+	msg := New(false)
+
+	msg.AddHave(b.Cid())
+	msg.AddBlock(b)
+	if len(msg.Haves()) != 0 {
+		t.Fatal("HAVE should be dropped once the block is added")
+	}
+
+	msg.AddDontHave(b.Cid())
+	if len(msg.DontHaves()) != 0 {
+		t.Fatal("presence should not be added for a block in the message")
+	}
+}
+
+func TestReceiptOnlySentInV2(t *testing.T) {
+	original := New(false)
+	receipt := &ExchangeReceipt{
+		Data:      []byte("data"),
+		Signature: []byte("signature"),
+		PublicKey: []byte("key"),
+	}
+	original.SetReceipt(receipt)
+	if original.Empty() {
+		t.Fatal("message carrying a receipt should not be empty")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := original.ToNetV2(buf); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := FromNet(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := copied.Receipt()
+	if r == nil || !bytes.Equal(r.Data, receipt.Data) ||
+		!bytes.Equal(r.Signature, receipt.Signature) || !bytes.Equal(r.PublicKey, receipt.PublicKey) {
+		t.Fatal("receipt got changed on marshal")
+	}
+
+	buf.Reset()
+	if err := original.ToNetV1(buf); err != nil {
+		t.Fatal(err)
+	}
+	copied, err = FromNet(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.Receipt() != nil {
+		t.Fatal("receipts should not be sent to 1.1.0 peers")
+	}
+}
+
+func TestNotPermittedPresence(t *testing.T) {
+	original := New(false)
+	original.AddNotPermitted(mkFakeCid("denied"))
+
+	buf := new(bytes.Buffer)
+	if err := original.ToNetV2(buf); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := FromNet(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	np := copied.NotPermitted()
+	if len(np) != 1 || !np[0].Equals(mkFakeCid("denied")) {
+		t.Fatal("NOT_PERMITTED presence got dropped on marshal")
+	}
+	if len(copied.DontHaves()) != 0 || len(copied.Haves()) != 0 {
+		t.Fatal("NOT_PERMITTED presence changed type on marshal")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	bsnet "github.com/ipfs/go-bitswap/network"
 	wantlist "github.com/ipfs/go-bitswap/wantlist"
 	logging "github.com/ipfs/go-log"
@@ -17,6 +18,9 @@ var log = logging.Logger("bitswap")
 const (
 	defaultRebroadcastInterval = 30 * time.Second
 	maxRetries                 = 10
+	// shutdownSendTimeout bounds sending the last message when the queue
+	// shuts down
+	shutdownSendTimeout = 5 * time.Second
 )
 
 // MessageNetwork is any network that can connect peers and generate a message
@@ -34,6 +38,7 @@ type MessageQueue struct {
 
 	outgoingWork chan struct{}
 	done         chan struct{}
+	stopped      chan struct{}
 
 	// do not touch out of run loop
 	wl                    *wantlist.SessionTrackedWantlist
@@ -54,6 +59,7 @@ func New(ctx context.Context, p peer.ID, network MessageNetwork) *MessageQueue {
 		p:                   p,
 		outgoingWork:        make(chan struct{}, 1),
 		done:                make(chan struct{}),
+		stopped:             make(chan struct{}),
 		rebroadcastInterval: defaultRebroadcastInterval,
 	}
 }
@@ -94,12 +100,21 @@ func (mq *MessageQueue) Startup() {
 	go mq.runQueue()
 }
 
-// Shutdown stops the processing of messages for a message queue.
+// Shutdown stops the processing of messages for a message queue. If the
+// queue has a stream open to the peer, the pending message is sent first.
 func (mq *MessageQueue) Shutdown() {
 	close(mq.done)
 }
 
+// Stopped returns a channel that is closed once the queue has stopped
+// processing messages and closed its stream.
+func (mq *MessageQueue) Stopped() <-chan struct{} {
+	return mq.stopped
+}
+
 func (mq *MessageQueue) runQueue() {
+	defer close(mq.stopped)
+	defer mq.rebroadcastTimer.Stop()
 	for {
 		select {
 		case <-mq.rebroadcastTimer.C:
@@ -107,6 +122,9 @@ func (mq *MessageQueue) runQueue() {
 		case <-mq.outgoingWork:
 			mq.sendMessage()
 		case <-mq.done:
+			if mq.sender != nil {
+				mq.flush()
+			}
 			if mq.sender != nil {
 				mq.sender.Close()
 			}
@@ -130,7 +148,7 @@ func (mq *MessageQueue) addWantlist() {
 			mq.nextMessage = bsmsg.New(false)
 		}
 		for _, e := range mq.wl.Entries() {
-			mq.nextMessage.AddEntry(e.Cid, e.Priority)
+			mq.nextMessage.AddEntryWithType(e.Cid, e.Priority, e.WantType, false)
 		}
 		select {
 		case mq.outgoingWork <- struct{}{}:
@@ -163,9 +181,13 @@ func (mq *MessageQueue) addEntries(entries []bsmsg.Entry, ses uint64) bool {
 				mq.nextMessage.Cancel(e.Cid)
 			}
 		} else {
-			if mq.wl.Add(e.Cid, e.Priority, ses) {
+			// send the entry if it's new, or if it upgrades a want-have we
+			// already sent to a want-block
+			existing, had := mq.wl.Contains(e.Cid)
+			mq.wl.AddEntry(e.Entry, ses)
+			if !had || (existing.WantType == pb.Message_Wantlist_Have && e.WantType == pb.Message_Wantlist_Block) {
 				work = true
-				mq.nextMessage.AddEntry(e.Cid, e.Priority)
+				mq.nextMessage.AddEntryWithType(e.Cid, e.Priority, e.WantType, e.SendDontHave)
 			}
 		}
 	}
@@ -201,6 +223,22 @@ func (mq *MessageQueue) sendMessage() {
 	}
 }
 
+// flush makes one attempt at sending the pending message on the open stream.
+func (mq *MessageQueue) flush() {
+	message := mq.extractOutgoingMessage()
+	if message == nil || message.Empty() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(mq.ctx, shutdownSendTimeout)
+	defer cancel()
+	if err := mq.sender.SendMsg(ctx, message); err != nil {
+		log.Infof("bitswap send error on shutdown: %s", err)
+		mq.sender.Reset()
+		mq.sender = nil
+	}
+}
+
 func (mq *MessageQueue) initializeSender() error {
 	if mq.sender != nil {
 		return nil
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+
+	proto "github.com/gogo/protobuf/proto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Messages on ProtocolBitswapCompressed are framed as the varint length of
+// the frame followed by the deflated protobuf encoding of the message, as
+// sent on ProtocolBitswapOneTwo.
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// writeCompressed writes a compressed frame of the message to w, returning
+// the size of the message before and after compression.
+func writeCompressed(w io.Writer, msg bsmsg.BitSwapMessage) (raw int, wire int, err error) {
+	pbm := msg.ToProtoV2()
+	data, err := proto.Marshal(pbm)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(binary.MaxVarintLen64 + len(data)/2)
+	fw := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(fw)
+	fw.Reset(&buf)
+	if _, err := fw.Write(data); err != nil {
+		return 0, 0, err
+	}
+	if err := fw.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(buf.Len()))
+	if _, err := w.Write(header[:n]); err != nil {
+		return 0, 0, err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return 0, 0, err
+	}
+	return len(data), n + buf.Len(), nil
+}
+
+// compressedReader reads compressed frames. It implements ggio.Reader, so
+// it can be passed to bsmsg.FromPBReader.
+type compressedReader struct {
+	r       *bufio.Reader
+	maxSize int
+
+	// sizes of the last message read, before and after compression
+	lastRaw  int
+	lastWire int
+}
+
+func newCompressedReader(r io.Reader, maxSize int) *compressedReader {
+	return &compressedReader{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+func (cr *compressedReader) ReadMsg(msg proto.Message) error {
+	size, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return err
+	}
+	if size > uint64(cr.maxSize) {
+		return fmt.Errorf("compressed message of %d bytes exceeds max size", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, frame); err != nil {
+		return err
+	}
+
+	// read one byte past the max so oversized messages can be told apart
+	fr := flate.NewReader(bytes.NewReader(frame))
+	defer fr.Close()
+	var data bytes.Buffer
+	if _, err := data.ReadFrom(io.LimitReader(fr, int64(cr.maxSize)+1)); err != nil {
+		return err
+	}
+	if data.Len() > cr.maxSize {
+		return fmt.Errorf("decompressed message exceeds max size of %d bytes", cr.maxSize)
+	}
+
+	cr.lastRaw = data.Len()
+	cr.lastWire = uvarintSize(size) + int(size)
+	return proto.Unmarshal(data.Bytes(), msg)
+}
+
+func (cr *compressedReader) Close() error {
+	return nil
+}
+
+func uvarintSize(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+// compressionStats tracks PeerCompressionStats for each peer.
+type compressionStats struct {
+	lk    sync.Mutex
+	peers map[peer.ID]*PeerCompressionStats
+}
+
+func newCompressionStats() *compressionStats {
+	return &compressionStats{peers: make(map[peer.ID]*PeerCompressionStats)}
+}
+
+func (cs *compressionStats) sent(p peer.ID, raw int, wire int) {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	s := cs.peerStats(p)
+	s.RawSent += uint64(raw)
+	s.WireSent += uint64(wire)
+}
+
+func (cs *compressionStats) received(p peer.ID, raw int, wire int) {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	s := cs.peerStats(p)
+	s.RawRecvd += uint64(raw)
+	s.WireRecvd += uint64(wire)
+}
+
+func (cs *compressionStats) peerStats(p peer.ID) *PeerCompressionStats {
+	s, ok := cs.peers[p]
+	if !ok {
+		s = &PeerCompressionStats{}
+		cs.peers[p] = s
+	}
+	return s
+}
+
+func (cs *compressionStats) remove(p peer.ID) {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	delete(cs.peers, p)
+}
+
+func (cs *compressionStats) get(p peer.ID) PeerCompressionStats {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+	if s, ok := cs.peers[p]; ok {
+		return *s
+	}
+	return PeerCompressionStats{}
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+)
+
+func TestCompressedFrameRoundTrip(t *testing.T) {
+	data := strings.Repeat("compress me ", 1000)
+	original := blockMessage(data)
+
+	buf := new(bytes.Buffer)
+	raw, wire, err := writeCompressed(buf, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wire != buf.Len() || wire >= raw {
+		t.Fatal("incorrect compressed sizes reported")
+	}
+
+	cr := newCompressedReader(buf, 1<<20)
+	m, err := bsmsg.FromPBReader(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Blocks()) != 1 || string(m.Blocks()[0].RawData()) != data {
+		t.Fatal("block data lost in compression")
+	}
+	if !m.Blocks()[0].Cid().Equals(original.Blocks()[0].Cid()) {
+		t.Fatal("block hash should be verified against uncompressed data")
+	}
+	if cr.lastRaw != raw || cr.lastWire != wire {
+		t.Fatal("reader reported incorrect sizes")
+	}
+}
+
+func TestCompressedFrameTooLarge(t *testing.T) {
+	data := strings.Repeat("a", 10000)
+	buf := new(bytes.Buffer)
+	if _, _, err := writeCompressed(buf, blockMessage(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// compressed frame fits, but the decompressed message doesn't
+	if _, err := bsmsg.FromPBReader(newCompressedReader(buf, 1000)); err == nil {
+		t.Fatal("expected error reading oversized message")
+	}
+}
@@ -17,6 +17,15 @@ var (
 	ProtocolBitswapNoVers protocol.ID = "/ipfs/bitswap"
 
 	ProtocolBitswap protocol.ID = "/ipfs/bitswap/1.1.0"
+
+	// ProtocolBitswapOneTwo adds want-have entries and HAVE / DONT_HAVE block
+	// presences to ProtocolBitswap. Peers that only speak older versions
+	// receive want-haves as want-blocks and no presences.
+	ProtocolBitswapOneTwo protocol.ID = "/ipfs/bitswap/1.2.0"
+
+	// ProtocolBitswapCompressed is ProtocolBitswapOneTwo with every message
+	// deflated. It is preferred when both peers enable it.
+	ProtocolBitswapCompressed protocol.ID = "/ipfs/bitswap/1.2.0/deflate"
 )
 
 // BitSwapNetwork provides network connectivity for BitSwap sessions.
@@ -78,3 +87,35 @@ type NetworkStats struct {
 	MessagesSent  uint64
 	MessagesRecvd uint64
 }
+
+// ProtocolReporter is implemented by networks that may speak versions of the
+// bitswap protocol older than ProtocolBitswapOneTwo with some peers.
+type ProtocolReporter interface {
+	// SupportsOneTwo reports whether the peer is known to speak
+	// ProtocolBitswapOneTwo, without which presences, block chunks and
+	// receipts don't reach it.
+	SupportsOneTwo(peer.ID) bool
+}
+
+// CompressionStatsReporter is implemented by networks that compress
+// messages when the remote peer supports it.
+type CompressionStatsReporter interface {
+	// CompressionStats returns the compression stats for messages exchanged
+	// with the given peer.
+	CompressionStats(peer.ID) PeerCompressionStats
+}
+
+// PeerCompressionStats counts the bytes of compressed messages exchanged
+// with a peer, before (Raw) and after (Wire) compression.
+type PeerCompressionStats struct {
+	RawSent   uint64
+	WireSent  uint64
+	RawRecvd  uint64
+	WireRecvd uint64
+}
+
+// BytesSaved returns how many bytes compression kept off the wire. It is
+// negative if compression made messages bigger.
+func (s PeerCompressionStats) BytesSaved() int64 {
+	return int64(s.RawSent+s.RawRecvd) - int64(s.WireSent+s.WireRecvd)
+}
@@ -25,12 +25,36 @@ var log = logging.Logger("bitswap_network")
 
 var sendMessageTimeout = time.Minute * 10
 
+// Option defines the functional option type that can be used to configure
+// the network returned by NewFromIpfsHost.
+type Option func(*impl)
+
+// Compression enables ProtocolBitswapCompressed: it is accepted from peers
+// and preferred when opening streams to peers that support it. Compression
+// is disabled by default, as it mostly costs CPU for blocks that are already
+// compressed.
+func Compression() Option {
+	return func(bsnet *impl) {
+		bsnet.compression = true
+	}
+}
+
 // NewFromIpfsHost returns a BitSwapNetwork supported by underlying IPFS host.
-func NewFromIpfsHost(host host.Host, r routing.ContentRouting) BitSwapNetwork {
+func NewFromIpfsHost(host host.Host, r routing.ContentRouting, options ...Option) BitSwapNetwork {
 	bitswapNetwork := impl{
-		host:    host,
-		routing: r,
+		host:             host,
+		routing:          r,
+		streams:          newStreamPool(),
+		compressionStats: newCompressionStats(),
+		chunks:           bsmsg.NewChunkAssembler(bsmsg.DefaultMaxPendingChunkBytes),
+	}
+	for _, option := range options {
+		option(&bitswapNetwork)
+	}
+	if bitswapNetwork.compression {
+		host.SetStreamHandler(ProtocolBitswapCompressed, bitswapNetwork.handleNewStream)
 	}
+	host.SetStreamHandler(ProtocolBitswapOneTwo, bitswapNetwork.handleNewStream)
 	host.SetStreamHandler(ProtocolBitswap, bitswapNetwork.handleNewStream)
 	host.SetStreamHandler(ProtocolBitswapOne, bitswapNetwork.handleNewStream)
 	host.SetStreamHandler(ProtocolBitswapNoVers, bitswapNetwork.handleNewStream)
@@ -49,11 +73,22 @@ type impl struct {
 	// inbound messages from the network are forwarded to the receiver
 	receiver Receiver
 
+	// outgoing streams reused by SendMessage
+	streams *streamPool
+
 	stats NetworkStats
+
+	// whether ProtocolBitswapCompressed is used
+	compression      bool
+	compressionStats *compressionStats
+
+	// reassembles blocks received in chunks
+	chunks *bsmsg.ChunkAssembler
 }
 
 type streamMessageSender struct {
-	s inet.Stream
+	bsnet *impl
+	s     inet.Stream
 }
 
 func (s *streamMessageSender) Close() error {
@@ -65,10 +100,10 @@ func (s *streamMessageSender) Reset() error {
 }
 
 func (s *streamMessageSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
-	return msgToStream(ctx, s.s, msg)
+	return s.bsnet.msgToStream(ctx, s.s, msg)
 }
 
-func msgToStream(ctx context.Context, s inet.Stream, msg bsmsg.BitSwapMessage) error {
+func (bsnet *impl) msgToStream(ctx context.Context, s inet.Stream, msg bsmsg.BitSwapMessage) error {
 	deadline := time.Now().Add(sendMessageTimeout)
 	if dl, ok := ctx.Deadline(); ok {
 		deadline = dl
@@ -78,7 +113,25 @@ func msgToStream(ctx context.Context, s inet.Stream, msg bsmsg.BitSwapMessage) e
 		log.Warningf("error setting deadline: %s", err)
 	}
 
+	// blocks too large for one message are sent in chunks, which only
+	// bitswap 1.2.0 understands
 	switch s.Protocol() {
+	case ProtocolBitswapCompressed:
+		for _, part := range bsmsg.SplitLargeBlocks(msg, bsmsg.DefaultBlockChunkSize) {
+			raw, wire, err := writeCompressed(s, part)
+			if err != nil {
+				log.Debugf("error: %s", err)
+				return err
+			}
+			bsnet.compressionStats.sent(s.Conn().RemotePeer(), raw, wire)
+		}
+	case ProtocolBitswapOneTwo:
+		for _, part := range bsmsg.SplitLargeBlocks(msg, bsmsg.DefaultBlockChunkSize) {
+			if err := part.ToNetV2(s); err != nil {
+				log.Debugf("error: %s", err)
+				return err
+			}
+		}
 	case ProtocolBitswap:
 		if err := msg.ToNetV1(s); err != nil {
 			log.Debugf("error: %s", err)
@@ -105,33 +158,66 @@ func (bsnet *impl) NewMessageSender(ctx context.Context, p peer.ID) (MessageSend
 		return nil, err
 	}
 
-	return &streamMessageSender{s: s}, nil
+	return &streamMessageSender{bsnet: bsnet, s: s}, nil
 }
 
 func (bsnet *impl) newStreamToPeer(ctx context.Context, p peer.ID) (inet.Stream, error) {
-	return bsnet.host.NewStream(ctx, p, ProtocolBitswap, ProtocolBitswapOne, ProtocolBitswapNoVers)
+	if bsnet.compression {
+		return bsnet.host.NewStream(ctx, p, ProtocolBitswapCompressed, ProtocolBitswapOneTwo, ProtocolBitswap, ProtocolBitswapOne, ProtocolBitswapNoVers)
+	}
+	return bsnet.host.NewStream(ctx, p, ProtocolBitswapOneTwo, ProtocolBitswap, ProtocolBitswapOne, ProtocolBitswapNoVers)
 }
 
+// SendMessage sends a message over the pooled stream to the peer, opening
+// one if there is none or the pooled one is no longer usable. If writing to
+// a reused stream fails, the stream is reset and the message is sent once
+// more over a fresh stream. The peer's slot is dropped from the pool when no
+// stream could be used, so that unreachable peers don't keep one.
 func (bsnet *impl) SendMessage(
 	ctx context.Context,
 	p peer.ID,
 	outgoing bsmsg.BitSwapMessage) error {
 
-	s, err := bsnet.newStreamToPeer(ctx, p)
-	if err != nil {
-		return err
-	}
+	ps := bsnet.streams.acquire(p)
+	defer ps.lk.Unlock()
 
-	if err = msgToStream(ctx, s, outgoing); err != nil {
-		s.Reset()
-		return err
-	}
-	atomic.AddUint64(&bsnet.stats.MessagesSent, 1)
+	for {
+		reused := ps.s != nil && bsnet.streamHealthy(p, ps.s)
+		if !reused {
+			ps.reset()
+			s, err := bsnet.newStreamToPeer(ctx, p)
+			if err != nil {
+				ps.remove()
+				return err
+			}
+			ps.s = s
+		}
+
+		err := bsnet.msgToStream(ctx, ps.s, outgoing)
+		if err == nil {
+			atomic.AddUint64(&bsnet.stats.MessagesSent, 1)
+			ps.use()
+			return nil
+		}
+		ps.reset()
 
-	// TODO(https://github.com/libp2p/go-libp2p-net/issues/28): Avoid this goroutine.
-	go inet.AwaitEOF(s)
-	return s.Close()
+		if !reused || ctx.Err() != nil {
+			ps.remove()
+			return err
+		}
+		log.Debugf("pooled stream to %s failed, retrying on a new stream: %s", p, err)
+	}
+}
 
+// streamHealthy checks that the connection a pooled stream was opened on is
+// still one of the live connections to the peer.
+func (bsnet *impl) streamHealthy(p peer.ID, s inet.Stream) bool {
+	for _, c := range bsnet.host.Network().ConnsToPeer(p) {
+		if c == s.Conn() {
+			return true
+		}
+	}
+	return false
 }
 
 func (bsnet *impl) SetDelegate(r Receiver) {
@@ -177,7 +263,14 @@ func (bsnet *impl) handleNewStream(s inet.Stream) {
 		return
 	}
 
-	reader := ggio.NewDelimitedReader(s, inet.MessageSizeMax)
+	var reader ggio.Reader
+	var compressed *compressedReader
+	if s.Protocol() == ProtocolBitswapCompressed {
+		compressed = newCompressedReader(s, inet.MessageSizeMax)
+		reader = compressed
+	} else {
+		reader = ggio.NewDelimitedReader(s, inet.MessageSizeMax)
+	}
 	for {
 		received, err := bsmsg.FromPBReader(reader)
 		if err != nil {
@@ -190,6 +283,17 @@ func (bsnet *impl) handleNewStream(s inet.Stream) {
 		}
 
 		p := s.Conn().RemotePeer()
+		if compressed != nil {
+			bsnet.compressionStats.received(p, compressed.lastRaw, compressed.lastWire)
+		}
+		received, err = bsnet.chunks.Assemble(p, received)
+		if err != nil {
+			log.Debugf("bitswap net handleNewStream from %s dropped block chunks: %s", p, err)
+		}
+		if received.Empty() {
+			// only part of a block so far
+			continue
+		}
 		ctx := context.Background()
 		log.Debugf("bitswap net handleNewStream from %s", s.Conn().RemotePeer())
 		bsnet.receiver.ReceiveMessage(ctx, p, received)
@@ -201,6 +305,20 @@ func (bsnet *impl) ConnectionManager() ifconnmgr.ConnManager {
 	return bsnet.host.ConnManager()
 }
 
+// SupportsOneTwo reports whether the peerstore lists ProtocolBitswapOneTwo
+// or ProtocolBitswapCompressed for the peer, as announced by the peer or
+// negotiated on a stream we opened to it.
+func (bsnet *impl) SupportsOneTwo(p peer.ID) bool {
+	protos, err := bsnet.host.Peerstore().SupportsProtocols(p, string(ProtocolBitswapOneTwo), string(ProtocolBitswapCompressed))
+	return err == nil && len(protos) > 0
+}
+
+// CompressionStats returns the compression stats for messages exchanged
+// with the peer over ProtocolBitswapCompressed since it connected.
+func (bsnet *impl) CompressionStats(p peer.ID) PeerCompressionStats {
+	return bsnet.compressionStats.get(p)
+}
+
 func (bsnet *impl) Stats() NetworkStats {
 	return NetworkStats{
 		MessagesRecvd: atomic.LoadUint64(&bsnet.stats.MessagesRecvd),
@@ -219,6 +337,11 @@ func (nn *netNotifiee) Connected(n inet.Network, v inet.Conn) {
 }
 
 func (nn *netNotifiee) Disconnected(n inet.Network, v inet.Conn) {
+	nn.impl().streams.connClosed(v.RemotePeer(), v)
+	if n.Connectedness(v.RemotePeer()) != inet.Connected {
+		nn.impl().chunks.PeerGone(v.RemotePeer())
+		nn.impl().compressionStats.remove(v.RemotePeer())
+	}
 	nn.impl().receiver.PeerDisconnected(v.RemotePeer())
 }
 
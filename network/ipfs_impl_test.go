@@ -0,0 +1,383 @@
+package network
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+
+	blocks "github.com/ipfs/go-block-format"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+type receiver struct {
+	lk        sync.Mutex
+	received  []bsmsg.BitSwapMessage
+	connected map[peer.ID]bool
+	// number of PeerDisconnected calls
+	disconnects int
+	messages    chan struct{}
+}
+
+func newReceiver() *receiver {
+	return &receiver{
+		connected: make(map[peer.ID]bool),
+		messages:  make(chan struct{}, 16),
+	}
+}
+
+func (r *receiver) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage) {
+	r.lk.Lock()
+	r.received = append(r.received, incoming)
+	r.lk.Unlock()
+	r.messages <- struct{}{}
+}
+
+func (r *receiver) ReceiveError(err error) {}
+
+func (r *receiver) PeerConnected(p peer.ID) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.connected[p] = true
+}
+
+func (r *receiver) PeerDisconnected(p peer.ID) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	delete(r.connected, p)
+	r.disconnects++
+}
+
+func (r *receiver) isConnected(p peer.ID) bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.connected[p]
+}
+
+func (r *receiver) waitForMessages(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.messages:
+		case <-time.After(time.Second):
+			t.Fatal("did not receive message")
+		}
+	}
+}
+
+func setupNetworks(ctx context.Context, t *testing.T, options ...Option) (mocknet.Mocknet, BitSwapNetwork, *receiver) {
+	return setupNetworksWithOptions(ctx, t, options, options)
+}
+
+func setupNetworksWithOptions(ctx context.Context, t *testing.T, senderOptions []Option, receiverOptions []Option) (mocknet.Mocknet, BitSwapNetwork, *receiver) {
+	mn, err := mocknet.FullMeshLinked(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	sender := NewFromIpfsHost(hosts[0], nil, senderOptions...)
+	sender.SetDelegate(newReceiver())
+	r := newReceiver()
+	NewFromIpfsHost(hosts[1], nil, receiverOptions...).SetDelegate(r)
+	if _, err := mn.ConnectPeers(hosts[0].ID(), hosts[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	return mn, sender, r
+}
+
+func blockMessage(data string) bsmsg.BitSwapMessage {
+	msg := bsmsg.New(false)
+	msg.AddBlock(blocks.NewBlock([]byte(data)))
+	return msg
+}
+
+func openStreams(mn mocknet.Mocknet, from peer.ID, to peer.ID) []inet.Stream {
+	var streams []inet.Stream
+	for _, c := range mn.Net(from).ConnsToPeer(to) {
+		for _, s := range c.GetStreams() {
+			if s.Protocol() == ProtocolBitswapCompressed || s.Protocol() == ProtocolBitswapOneTwo {
+				streams = append(streams, s)
+			}
+		}
+	}
+	return streams
+}
+
+func TestSendMessageReusesStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, r := setupNetworks(ctx, t)
+	hosts := mn.Hosts()
+
+	for _, data := range []string{"a", "b", "c"} {
+		if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.waitForMessages(t, 3)
+
+	if n := len(openStreams(mn, hosts[0].ID(), hosts[1].ID())); n != 1 {
+		t.Fatalf("expected a single stream for all messages, got %d", n)
+	}
+	if sender.Stats().MessagesSent != 3 {
+		t.Fatal("did not count sent messages")
+	}
+}
+
+func TestSendMessageAfterReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, r := setupNetworks(ctx, t)
+	hosts := mn.Hosts()
+
+	if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage("a")); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+
+	if err := mn.DisconnectPeers(hosts[0].ID(), hosts[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mn.ConnectPeers(hosts[0].ID(), hosts[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pooled stream died with the old connection, so a new one should
+	// be opened over the new connection
+	if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage("b")); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+}
+
+func TestIdleStreamsAreClosed(t *testing.T) {
+	oldTimeout := sendStreamIdleTimeout
+	sendStreamIdleTimeout = 20 * time.Millisecond
+	defer func() { sendStreamIdleTimeout = oldTimeout }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, r := setupNetworks(ctx, t)
+	hosts := mn.Hosts()
+
+	if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage("a")); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	if n := len(openStreams(mn, hosts[0].ID(), hosts[1].ID())); n != 0 {
+		t.Fatalf("idle stream was not closed, %d open", n)
+	}
+
+	// sending again opens a new stream
+	if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage("b")); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+}
+
+func TestFailedDialDropsPooledStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, _ := setupNetworks(ctx, t)
+	hosts := mn.Hosts()
+
+	if err := mn.UnlinkPeers(hosts[0].ID(), hosts[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.DisconnectPeers(hosts[0].ID(), hosts[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage("a")); err == nil {
+		t.Fatal("expected sending to an unreachable peer to fail")
+	}
+
+	pool := sender.(*impl).streams
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	if len(pool.senders) != 0 {
+		t.Fatal("expected the slot of the unreachable peer to be dropped")
+	}
+}
+
+func TestCompressionDisabledByDefault(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, r := setupNetworksWithOptions(ctx, t, nil, []Option{Compression()})
+	hosts := mn.Hosts()
+
+	if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage("a")); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+
+	streams := openStreams(mn, hosts[0].ID(), hosts[1].ID())
+	if len(streams) != 1 || streams[0].Protocol() != ProtocolBitswapOneTwo {
+		t.Fatal("should not have offered compression")
+	}
+}
+
+func TestCompressedMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, r := setupNetworks(ctx, t, Compression())
+	hosts := mn.Hosts()
+
+	data := strings.Repeat(`{"name": "manifest", "entries": []}`, 100)
+	if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage(data)); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+
+	streams := openStreams(mn, hosts[0].ID(), hosts[1].ID())
+	if len(streams) != 1 || streams[0].Protocol() != ProtocolBitswapCompressed {
+		t.Fatal("should have negotiated compression")
+	}
+
+	r.lk.Lock()
+	received := r.received[0].Blocks()
+	r.lk.Unlock()
+	if len(received) != 1 || string(received[0].RawData()) != data {
+		t.Fatal("block was not decompressed")
+	}
+
+	stats := sender.(CompressionStatsReporter).CompressionStats(hosts[1].ID())
+	if stats.RawSent <= uint64(len(data)) || stats.BytesSaved() <= 0 {
+		t.Fatal("compression savings were not counted")
+	}
+
+	if err := mn.DisconnectPeers(hosts[0].ID(), hosts[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	stats = sender.(CompressionStatsReporter).CompressionStats(hosts[1].ID())
+	if stats != (PeerCompressionStats{}) {
+		t.Fatal("compression stats were not dropped on disconnect")
+	}
+}
+
+func TestCompressionFallsBackToUncompressed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, r := setupNetworksWithOptions(ctx, t, []Option{Compression()}, nil)
+	hosts := mn.Hosts()
+
+	if err := sender.SendMessage(ctx, hosts[1].ID(), blockMessage("a")); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+
+	streams := openStreams(mn, hosts[0].ID(), hosts[1].ID())
+	if len(streams) != 1 || streams[0].Protocol() != ProtocolBitswapOneTwo {
+		t.Fatal("should have fallen back to uncompressed protocol")
+	}
+	stats := sender.(CompressionStatsReporter).CompressionStats(hosts[1].ID())
+	if stats.RawSent != 0 {
+		t.Fatal("uncompressed messages should not count towards compression stats")
+	}
+}
+
+func TestSendLargeBlockInChunks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, r := setupNetworks(ctx, t)
+	hosts := mn.Hosts()
+
+	data := make([]byte, 5*bsmsg.DefaultBlockChunkSize/2)
+	rand.Read(data)
+	large := blocks.NewBlock(data)
+	msg := bsmsg.New(false)
+	msg.AddBlock(large)
+	if err := sender.SendMessage(ctx, hosts[1].ID(), msg); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+
+	r.lk.Lock()
+	received := r.received[0].Blocks()
+	r.lk.Unlock()
+	if len(received) != 1 || !received[0].Cid().Equals(large.Cid()) {
+		t.Fatal("large block was not reassembled")
+	}
+}
+
+func TestInterruptedChunkedSendIsResent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, sender, r := setupNetworks(ctx, t)
+	hosts := mn.Hosts()
+
+	data := make([]byte, 5*bsmsg.DefaultBlockChunkSize/2)
+	rand.Read(data)
+	large := blocks.NewBlock(data)
+	msg := bsmsg.New(false)
+	msg.AddBlock(large)
+	parts := bsmsg.SplitLargeBlocks(msg, bsmsg.DefaultBlockChunkSize)
+
+	// the first chunk makes it through before the stream fails
+	s, err := hosts[0].NewStream(ctx, hosts[1].ID(), ProtocolBitswapOneTwo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parts[0].ToNetV2(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockMessage("a").ToNetV2(s); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+	s.Reset()
+
+	// the block is sent again from the start over a new stream
+	if err := sender.SendMessage(ctx, hosts[1].ID(), msg); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForMessages(t, 1)
+
+	r.lk.Lock()
+	received := r.received[1].Blocks()
+	r.lk.Unlock()
+	if len(received) != 1 || !received[0].Cid().Equals(large.Cid()) {
+		t.Fatal("resent block was not reassembled")
+	}
+}
+
+func TestSupportsOneTwo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, err := mocknet.FullMeshLinked(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	local := NewFromIpfsHost(hosts[0], nil)
+	local.SetDelegate(newReceiver())
+	NewFromIpfsHost(hosts[1], nil).SetDelegate(newReceiver())
+	NewFromIpfsHost(hosts[2], nil).SetDelegate(newReceiver())
+	hosts[2].RemoveStreamHandler(ProtocolBitswapOneTwo)
+	for _, h := range hosts[1:] {
+		if _, err := mn.ConnectPeers(hosts[0].ID(), h.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sending negotiates the protocol
+	for _, h := range hosts[1:] {
+		if err := local.SendMessage(ctx, h.ID(), blockMessage("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pr := local.(ProtocolReporter)
+	if !pr.SupportsOneTwo(hosts[1].ID()) {
+		t.Fatal("expected peer to speak bitswap 1.2.0")
+	}
+	if pr.SupportsOneTwo(hosts[2].ID()) {
+		t.Fatal("expected peer not to speak bitswap 1.2.0")
+	}
+}
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"sync"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// sendStreamIdleTimeout is how long a pooled stream may go unused before it
+// is closed.
+var sendStreamIdleTimeout = time.Minute
+
+// streamPool keeps one outgoing stream per peer open between calls to
+// SendMessage, so that the task workers don't open and close a stream for
+// every envelope.
+type streamPool struct {
+	lk      sync.Mutex
+	senders map[peer.ID]*pooledStream
+}
+
+// pooledStream is the stream SendMessage writes to a single peer. Its lock
+// serializes writes from concurrent task workers.
+type pooledStream struct {
+	pool *streamPool
+	p    peer.ID
+
+	lk       sync.Mutex
+	s        inet.Stream
+	lastUsed time.Time
+	idle     *time.Timer
+	// removed is set once the slot has been dropped from the pool
+	removed bool
+}
+
+func newStreamPool() *streamPool {
+	return &streamPool{
+		senders: make(map[peer.ID]*pooledStream),
+	}
+}
+
+// acquire returns the locked stream slot for a peer, creating it if
+// needed. The caller must unlock the slot when done with its stream.
+func (sp *streamPool) acquire(p peer.ID) *pooledStream {
+	for {
+		sp.lk.Lock()
+		ps, ok := sp.senders[p]
+		if !ok {
+			ps = &pooledStream{pool: sp, p: p}
+			sp.senders[p] = ps
+		}
+		sp.lk.Unlock()
+
+		ps.lk.Lock()
+		if !ps.removed {
+			return ps
+		}
+		// raced with the slot being dropped, get a new one
+		ps.lk.Unlock()
+	}
+}
+
+// connClosed resets the pooled stream to a peer if it was opened over the
+// given connection.
+func (sp *streamPool) connClosed(p peer.ID, c inet.Conn) {
+	sp.lk.Lock()
+	ps, ok := sp.senders[p]
+	sp.lk.Unlock()
+	if !ok {
+		return
+	}
+
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	if ps.s != nil && ps.s.Conn() == c {
+		ps.reset()
+		ps.remove()
+	}
+}
+
+// use records that the stream was just written to, and (re)arms the idle
+// timer that closes it.
+func (ps *pooledStream) use() {
+	ps.lastUsed = time.Now()
+	if ps.idle == nil {
+		ps.idle = time.AfterFunc(sendStreamIdleTimeout, ps.expire)
+	} else {
+		ps.idle.Reset(sendStreamIdleTimeout)
+	}
+}
+
+// expire closes the stream if it has not been used for sendStreamIdleTimeout.
+func (ps *pooledStream) expire() {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	if ps.s == nil {
+		return
+	}
+	if idle := time.Since(ps.lastUsed); idle < sendStreamIdleTimeout {
+		ps.idle.Reset(sendStreamIdleTimeout - idle)
+		return
+	}
+	s := ps.s
+	ps.s = nil
+	ps.remove()
+	// TODO(https://github.com/libp2p/go-libp2p-net/issues/28): Avoid this goroutine.
+	go inet.AwaitEOF(s)
+	s.Close()
+}
+
+// remove drops the slot from the pool. Must be called with the slot locked.
+func (ps *pooledStream) remove() {
+	ps.removed = true
+	if ps.idle != nil {
+		ps.idle.Stop()
+	}
+	ps.pool.lk.Lock()
+	if ps.pool.senders[ps.p] == ps {
+		delete(ps.pool.senders, ps.p)
+	}
+	ps.pool.lk.Unlock()
+}
+
+// reset drops the stream after a failure.
+func (ps *pooledStream) reset() {
+	if ps.s != nil {
+		ps.s.Reset()
+		ps.s = nil
+	}
+}
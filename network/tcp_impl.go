@@ -0,0 +1,550 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+
+	ggio "github.com/gogo/protobuf/io"
+	cid "github.com/ipfs/go-cid"
+	ifconnmgr "github.com/libp2p/go-libp2p-interface-connmgr"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// maxPeerIDSize bounds the peer ID a remote may send in the handshake.
+const maxPeerIDSize = 256
+
+// ErrNoAddress is returned when connecting to a peer that is not in the
+// address book.
+var ErrNoAddress = errors.New("no address for peer")
+
+// ErrNetworkClosed is returned when sending over a closed TCPNetwork.
+var ErrNetworkClosed = errors.New("network closed")
+
+// AddressBook is a static mapping of peers to the TCP addresses they listen
+// on.
+type AddressBook struct {
+	lk    sync.RWMutex
+	addrs map[peer.ID]string
+}
+
+// NewAddressBook returns an empty AddressBook.
+func NewAddressBook() *AddressBook {
+	return &AddressBook{addrs: make(map[peer.ID]string)}
+}
+
+// Add sets the address of a peer.
+func (ab *AddressBook) Add(p peer.ID, addr string) {
+	ab.lk.Lock()
+	defer ab.lk.Unlock()
+	ab.addrs[p] = addr
+}
+
+// Addr returns the address of a peer, if it is known.
+func (ab *AddressBook) Addr(p peer.ID) (string, bool) {
+	ab.lk.RLock()
+	defer ab.lk.RUnlock()
+	addr, ok := ab.addrs[p]
+	return addr, ok
+}
+
+// ProviderTable is a local record of which peers provide which blocks. It
+// stands in for content routing on networks without a DHT, and may be
+// shared by several TCPNetworks in the same process.
+type ProviderTable struct {
+	lk        sync.RWMutex
+	providers map[cid.Cid][]peer.ID
+}
+
+// NewProviderTable returns an empty ProviderTable.
+func NewProviderTable() *ProviderTable {
+	return &ProviderTable{providers: make(map[cid.Cid][]peer.ID)}
+}
+
+// AddProvider records that a peer provides a block.
+func (pt *ProviderTable) AddProvider(k cid.Cid, p peer.ID) {
+	pt.lk.Lock()
+	defer pt.lk.Unlock()
+	for _, existing := range pt.providers[k] {
+		if existing == p {
+			return
+		}
+	}
+	pt.providers[k] = append(pt.providers[k], p)
+}
+
+// Providers returns the peers recorded as providing a block.
+func (pt *ProviderTable) Providers(k cid.Cid) []peer.ID {
+	pt.lk.RLock()
+	defer pt.lk.RUnlock()
+	providers := make([]peer.ID, len(pt.providers[k]))
+	copy(providers, pt.providers[k])
+	return providers
+}
+
+// TCPNetwork is a BitSwapNetwork that exchanges the same length-delimited
+// protobuf messages as the libp2p network, but over plain TCP connections
+// between peers in a static address book. It is meant for trusted meshes:
+// peers identify themselves with a bare peer ID when connecting, and
+// nothing is authenticated or encrypted.
+type TCPNetwork struct {
+	self      peer.ID
+	addrs     *AddressBook
+	providers *ProviderTable
+	listener  net.Listener
+
+	// inbound messages from the network are forwarded to the receiver
+	receiver Receiver
+
+	stats NetworkStats
+
+	// reassembles blocks received in chunks
+	chunks *bsmsg.ChunkAssembler
+
+	lk sync.Mutex
+	// inbound connections that haven't completed the handshake yet
+	accepted map[net.Conn]struct{}
+	// open connections, in either direction, and the peer on the other end
+	conns map[net.Conn]peer.ID
+	// number of open connections per peer
+	connCounts map[peer.ID]int
+	// outgoing connections reused by SendMessage
+	senders map[peer.ID]*tcpMessageSender
+	closed  bool
+
+	wg sync.WaitGroup
+}
+
+// NewTCPNetwork listens on listenAddr and returns a TCPNetwork for the
+// local peer self. Peers are dialled at the addresses in addrs, and
+// FindProvidersAsync and Provide read and write providers.
+func NewTCPNetwork(self peer.ID, listenAddr string, addrs *AddressBook, providers *ProviderTable) (*TCPNetwork, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tn := &TCPNetwork{
+		self:       self,
+		addrs:      addrs,
+		providers:  providers,
+		listener:   listener,
+		accepted:   make(map[net.Conn]struct{}),
+		conns:      make(map[net.Conn]peer.ID),
+		connCounts: make(map[peer.ID]int),
+		senders:    make(map[peer.ID]*tcpMessageSender),
+		chunks:     bsmsg.NewChunkAssembler(bsmsg.DefaultMaxPendingChunkBytes),
+	}
+	tn.wg.Add(1)
+	go tn.acceptConns()
+	return tn, nil
+}
+
+// Addr returns the address the network is listening on.
+func (tn *TCPNetwork) Addr() net.Addr {
+	return tn.listener.Addr()
+}
+
+// Close stops listening and closes all connections.
+func (tn *TCPNetwork) Close() error {
+	tn.lk.Lock()
+	if tn.closed {
+		tn.lk.Unlock()
+		return nil
+	}
+	tn.closed = true
+	var conns []net.Conn
+	for c := range tn.accepted {
+		conns = append(conns, c)
+	}
+	for c := range tn.conns {
+		conns = append(conns, c)
+	}
+	tn.lk.Unlock()
+
+	err := tn.listener.Close()
+	for _, c := range conns {
+		c.Close()
+	}
+	tn.wg.Wait()
+	return err
+}
+
+func (tn *TCPNetwork) SetDelegate(r Receiver) {
+	tn.receiver = r
+}
+
+// ConnectTo dials the peer, unless there already is a connection to it.
+func (tn *TCPNetwork) ConnectTo(ctx context.Context, p peer.ID) error {
+	tn.lk.Lock()
+	connected := tn.connCounts[p] > 0
+	tn.lk.Unlock()
+	if connected {
+		return nil
+	}
+
+	ms, err := tn.senderFor(ctx, p)
+	if err != nil {
+		return err
+	}
+	ms.lk.Unlock()
+	return nil
+}
+
+func (tn *TCPNetwork) NewMessageSender(ctx context.Context, p peer.ID) (MessageSender, error) {
+	c, err := tn.dial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpMessageSender{tn: tn, conn: c}, nil
+}
+
+// SendMessage sends a message over the pooled connection to the peer,
+// dialling one if needed. If writing to a reused connection fails, the
+// message is sent once more over a fresh connection.
+func (tn *TCPNetwork) SendMessage(
+	ctx context.Context,
+	p peer.ID,
+	outgoing bsmsg.BitSwapMessage) error {
+
+	var failed *tcpMessageSender
+	for attempt := 0; ; attempt++ {
+		ms, err := tn.senderFor(ctx, p)
+		if failed != nil {
+			// closed once the new connection is open, so that a failed
+			// write isn't reported as the peer going away
+			failed.Reset()
+		}
+		if err != nil {
+			return err
+		}
+		err = ms.sendMsg(ctx, outgoing)
+		if err == nil {
+			ms.lk.Unlock()
+			return nil
+		}
+		tn.dropSender(p, ms)
+		ms.lk.Unlock()
+
+		if attempt > 0 || ctx.Err() != nil {
+			ms.Reset()
+			return err
+		}
+		log.Debugf("tcp connection to %s failed, retrying on a new connection: %s", p, err)
+		failed = ms
+	}
+}
+
+// senderFor returns the locked pooled sender for a peer, dialling it if
+// there is none.
+func (tn *TCPNetwork) senderFor(ctx context.Context, p peer.ID) (*tcpMessageSender, error) {
+	tn.lk.Lock()
+	ms, ok := tn.senders[p]
+	tn.lk.Unlock()
+	if ok {
+		ms.lk.Lock()
+		return ms, nil
+	}
+
+	c, err := tn.dial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	ms = &tcpMessageSender{tn: tn, conn: c}
+	ms.lk.Lock()
+
+	tn.lk.Lock()
+	if existing, ok := tn.senders[p]; ok {
+		// raced with another dial, use the pooled connection instead
+		tn.lk.Unlock()
+		ms.lk.Unlock()
+		ms.Close()
+		existing.lk.Lock()
+		return existing, nil
+	}
+	tn.senders[p] = ms
+	tn.lk.Unlock()
+	return ms, nil
+}
+
+// dropSender stops reusing a sender. The caller resets it.
+func (tn *TCPNetwork) dropSender(p peer.ID, ms *tcpMessageSender) {
+	tn.lk.Lock()
+	if tn.senders[p] == ms {
+		delete(tn.senders, p)
+	}
+	tn.lk.Unlock()
+}
+
+// dial opens a connection to the peer and introduces ourselves.
+func (tn *TCPNetwork) dial(ctx context.Context, p peer.ID) (net.Conn, error) {
+	addr, ok := tn.addrs.Addr(p)
+	if !ok {
+		return nil, ErrNoAddress
+	}
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePeerID(c, tn.self); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !tn.connOpened(c, p) {
+		c.Close()
+		return nil, ErrNetworkClosed
+	}
+	go tn.awaitClose(c)
+	return c, nil
+}
+
+// awaitClose waits for an outgoing connection to be closed by either end.
+// The remote never writes to it, so reads only return once it is gone.
+func (tn *TCPNetwork) awaitClose(c net.Conn) {
+	defer tn.wg.Done()
+	io.Copy(ioutil.Discard, c)
+	c.Close()
+	tn.connClosed(c)
+}
+
+func (tn *TCPNetwork) acceptConns() {
+	defer tn.wg.Done()
+	for {
+		c, err := tn.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		tn.lk.Lock()
+		if tn.closed {
+			tn.lk.Unlock()
+			c.Close()
+			return
+		}
+		tn.accepted[c] = struct{}{}
+		tn.wg.Add(1)
+		tn.lk.Unlock()
+		go tn.handleConn(c)
+	}
+}
+
+// handleConn reads messages from an inbound connection until it is closed.
+func (tn *TCPNetwork) handleConn(c net.Conn) {
+	defer tn.wg.Done()
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+	p, err := readPeerID(br)
+	if err != nil {
+		log.Debugf("bitswap tcp handshake error: %s", err)
+		tn.lk.Lock()
+		delete(tn.accepted, c)
+		tn.lk.Unlock()
+		return
+	}
+	if !tn.connOpened(c, p) {
+		return
+	}
+	defer tn.wg.Done()
+	defer tn.connClosed(c)
+
+	if tn.receiver == nil {
+		return
+	}
+
+	reader := ggio.NewDelimitedReader(br, inet.MessageSizeMax)
+	for {
+		received, err := bsmsg.FromPBReader(reader)
+		if err != nil {
+			if err != io.EOF {
+				go tn.receiver.ReceiveError(err)
+				log.Debugf("bitswap tcp handleConn from %s error: %s", p, err)
+			}
+			return
+		}
+
+		received, err = tn.chunks.Assemble(p, received)
+		if err != nil {
+			log.Debugf("bitswap tcp handleConn from %s dropped block chunks: %s", p, err)
+		}
+		if received.Empty() {
+			// only part of a block so far
+			continue
+		}
+
+		log.Debugf("bitswap tcp handleConn from %s", p)
+		tn.receiver.ReceiveMessage(context.Background(), p, received)
+		atomic.AddUint64(&tn.stats.MessagesRecvd, 1)
+	}
+}
+
+// connOpened tracks a new connection, and tells the receiver about the
+// peer if it is the first connection to it. It returns false if the
+// network is closed. Otherwise the connection counts towards Close's wait
+// group until the caller calls wg.Done.
+func (tn *TCPNetwork) connOpened(c net.Conn, p peer.ID) bool {
+	tn.lk.Lock()
+	if tn.closed {
+		tn.lk.Unlock()
+		return false
+	}
+	tn.wg.Add(1)
+	delete(tn.accepted, c)
+	tn.conns[c] = p
+	tn.connCounts[p]++
+	first := tn.connCounts[p] == 1
+	tn.lk.Unlock()
+
+	if first && tn.receiver != nil {
+		tn.receiver.PeerConnected(p)
+	}
+	return true
+}
+
+// connClosed stops tracking a connection, and tells the receiver the peer
+// is gone once its last connection is closed.
+func (tn *TCPNetwork) connClosed(c net.Conn) {
+	tn.lk.Lock()
+	p, ok := tn.conns[c]
+	if !ok {
+		tn.lk.Unlock()
+		return
+	}
+	delete(tn.conns, c)
+	if ms, ok := tn.senders[p]; ok && ms.conn == c {
+		// don't reuse a connection the remote went away from
+		delete(tn.senders, p)
+	}
+	tn.connCounts[p]--
+	last := tn.connCounts[p] == 0
+	if last {
+		delete(tn.connCounts, p)
+	}
+	tn.lk.Unlock()
+
+	if last {
+		tn.chunks.PeerGone(p)
+		if tn.receiver != nil {
+			tn.receiver.PeerDisconnected(p)
+		}
+	}
+}
+
+func (tn *TCPNetwork) ConnectionManager() ifconnmgr.ConnManager {
+	return &ifconnmgr.NullConnMgr{}
+}
+
+func (tn *TCPNetwork) Stats() NetworkStats {
+	return NetworkStats{
+		MessagesRecvd: atomic.LoadUint64(&tn.stats.MessagesRecvd),
+		MessagesSent:  atomic.LoadUint64(&tn.stats.MessagesSent),
+	}
+}
+
+// FindProvidersAsync returns a channel of providers for the given key from
+// the provider table.
+func (tn *TCPNetwork) FindProvidersAsync(ctx context.Context, k cid.Cid, max int) <-chan peer.ID {
+	out := make(chan peer.ID, max)
+	defer close(out)
+	for _, p := range tn.providers.Providers(k) {
+		if p == tn.self {
+			continue // ignore self as provider
+		}
+		if len(out) == max {
+			break
+		}
+		out <- p
+	}
+	return out
+}
+
+// Provide records the local peer as a provider of the key in the provider
+// table.
+func (tn *TCPNetwork) Provide(ctx context.Context, k cid.Cid) error {
+	tn.providers.AddProvider(k, tn.self)
+	return nil
+}
+
+type tcpMessageSender struct {
+	tn   *TCPNetwork
+	conn net.Conn
+	// serializes writes to conn
+	lk sync.Mutex
+}
+
+func (ms *tcpMessageSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	return ms.sendMsg(ctx, msg)
+}
+
+func (ms *tcpMessageSender) sendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
+	deadline := time.Now().Add(sendMessageTimeout)
+	if dl, ok := ctx.Deadline(); ok {
+		deadline = dl
+	}
+
+	if err := ms.conn.SetWriteDeadline(deadline); err != nil {
+		log.Warningf("error setting deadline: %s", err)
+	}
+	for _, part := range bsmsg.SplitLargeBlocks(msg, bsmsg.DefaultBlockChunkSize) {
+		if err := part.ToNetV2(ms.conn); err != nil {
+			log.Debugf("error: %s", err)
+			return err
+		}
+	}
+	if err := ms.conn.SetWriteDeadline(time.Time{}); err != nil {
+		log.Warningf("error resetting deadline: %s", err)
+	}
+	atomic.AddUint64(&ms.tn.stats.MessagesSent, 1)
+	return nil
+}
+
+// Close closes the sender's connection. The connection stops counting
+// towards the peer's once awaitClose sees it closed, which only reports the
+// peer gone if no other connection to it is open.
+func (ms *tcpMessageSender) Close() error {
+	return ms.conn.Close()
+}
+
+func (ms *tcpMessageSender) Reset() error {
+	return ms.Close()
+}
+
+func writePeerID(w io.Writer, p peer.ID) error {
+	buf := make([]byte, binary.MaxVarintLen64+len(p))
+	n := binary.PutUvarint(buf, uint64(len(p)))
+	n += copy(buf[n:], p)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+func readPeerID(r *bufio.Reader) (peer.ID, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if size == 0 || size > maxPeerIDSize {
+		return "", fmt.Errorf("invalid peer ID size %d", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return peer.ID(buf), nil
+}
+
+var _ BitSwapNetwork = (*TCPNetwork)(nil)
@@ -0,0 +1,207 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-bitswap/testutil"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func setupTCPNetworks(t *testing.T, n int) ([]peer.ID, []*TCPNetwork, []*receiver) {
+	addrs := NewAddressBook()
+	providers := NewProviderTable()
+	peers := testutil.GeneratePeers(n)
+	var nets []*TCPNetwork
+	var receivers []*receiver
+	for _, p := range peers {
+		tn, err := NewTCPNetwork(p, "127.0.0.1:0", addrs, providers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs.Add(p, tn.Addr().String())
+		r := newReceiver()
+		tn.SetDelegate(r)
+		nets = append(nets, tn)
+		receivers = append(receivers, r)
+	}
+	return peers, nets, receivers
+}
+
+func closeTCPNetworks(nets []*TCPNetwork) {
+	for _, tn := range nets {
+		tn.Close()
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTCPSendMessage(t *testing.T) {
+	ctx := context.Background()
+	peers, nets, receivers := setupTCPNetworks(t, 2)
+	defer closeTCPNetworks(nets)
+
+	block := blocks.NewBlock([]byte("block"))
+	have := blocks.NewBlock([]byte("have")).Cid()
+	msg := blockMessage("block")
+	msg.AddHave(have)
+	for i := 0; i < 2; i++ {
+		if err := nets[0].SendMessage(ctx, peers[1], msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receivers[1].waitForMessages(t, 2)
+
+	receivers[1].lk.Lock()
+	received := receivers[1].received[0]
+	receivers[1].lk.Unlock()
+	if len(received.Blocks()) != 1 || !received.Blocks()[0].Cid().Equals(block.Cid()) {
+		t.Fatal("did not receive block")
+	}
+	if len(received.Haves()) != 1 || !received.Haves()[0].Equals(have) {
+		t.Fatal("did not receive block presence")
+	}
+
+	if !receivers[0].isConnected(peers[1]) || !receivers[1].isConnected(peers[0]) {
+		t.Fatal("peers were not told about the connection")
+	}
+	if nets[0].Stats().MessagesSent != 2 || nets[1].Stats().MessagesRecvd != 2 {
+		t.Fatal("did not count messages")
+	}
+}
+
+func TestTCPMessageSender(t *testing.T) {
+	ctx := context.Background()
+	peers, nets, receivers := setupTCPNetworks(t, 2)
+	defer closeTCPNetworks(nets)
+
+	ms, err := nets[0].NewMessageSender(ctx, peers[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SendMsg(ctx, blockMessage("block")); err != nil {
+		t.Fatal(err)
+	}
+	receivers[1].waitForMessages(t, 1)
+
+	ms.Close()
+	waitFor(t, func() bool { return !receivers[1].isConnected(peers[0]) },
+		"peer was not told about disconnect")
+}
+
+// failingConn fails every write.
+type failingConn struct {
+	net.Conn
+}
+
+func (failingConn) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestTCPFailedWriteNotDisconnect(t *testing.T) {
+	ctx := context.Background()
+	peers, nets, receivers := setupTCPNetworks(t, 2)
+	defer closeTCPNetworks(nets)
+
+	if err := nets[0].SendMessage(ctx, peers[1], blockMessage("block")); err != nil {
+		t.Fatal(err)
+	}
+	receivers[1].waitForMessages(t, 1)
+
+	nets[0].lk.Lock()
+	ms := nets[0].senders[peers[1]]
+	nets[0].lk.Unlock()
+	ms.lk.Lock()
+	ms.conn = failingConn{ms.conn}
+	ms.lk.Unlock()
+
+	// the message is sent again over a new connection, and the broken one
+	// is closed without the peer being reported gone
+	if err := nets[0].SendMessage(ctx, peers[1], blockMessage("other block")); err != nil {
+		t.Fatal(err)
+	}
+	receivers[1].waitForMessages(t, 1)
+	waitFor(t, func() bool {
+		nets[0].lk.Lock()
+		defer nets[0].lk.Unlock()
+		return len(nets[0].conns) == 1
+	}, "broken connection was not closed")
+
+	receivers[0].lk.Lock()
+	defer receivers[0].lk.Unlock()
+	if receivers[0].disconnects != 0 || !receivers[0].connected[peers[1]] {
+		t.Fatal("failed write should not disconnect the peer")
+	}
+}
+
+func TestTCPUnknownPeer(t *testing.T) {
+	ctx := context.Background()
+	_, nets, _ := setupTCPNetworks(t, 1)
+	defer closeTCPNetworks(nets)
+
+	err := nets[0].SendMessage(ctx, testutil.GeneratePeers(1)[0], blockMessage("block"))
+	if err != ErrNoAddress {
+		t.Fatal("expected error sending to peer without address")
+	}
+}
+
+func TestTCPProviders(t *testing.T) {
+	ctx := context.Background()
+	peers, nets, _ := setupTCPNetworks(t, 3)
+	defer closeTCPNetworks(nets)
+
+	c := blocks.NewBlock([]byte("block")).Cid()
+	for _, tn := range nets[:2] {
+		if err := tn.Provide(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var found []peer.ID
+	for p := range nets[0].FindProvidersAsync(ctx, c, 10) {
+		found = append(found, p)
+	}
+	if len(found) != 1 || found[0] != peers[1] {
+		t.Fatal("should find other providers only")
+	}
+
+	if len(nets[2].FindProvidersAsync(ctx, c, 1)) != 1 {
+		t.Fatal("should not return more than max providers")
+	}
+	if len(nets[2].FindProvidersAsync(ctx, cid.Cid{}, 1)) != 0 {
+		t.Fatal("found providers for unprovided block")
+	}
+}
+
+func TestTCPCloseDisconnectsPeers(t *testing.T) {
+	ctx := context.Background()
+	peers, nets, receivers := setupTCPNetworks(t, 2)
+	defer closeTCPNetworks(nets)
+
+	if err := nets[0].ConnectTo(ctx, peers[1]); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return receivers[1].isConnected(peers[0]) },
+		"peer was not told about connection")
+
+	nets[0].Close()
+	waitFor(t, func() bool { return !receivers[1].isConnected(peers[0]) },
+		"peer was not told about disconnect")
+	if err := nets[0].SendMessage(ctx, peers[1], blockMessage("block")); err != ErrNetworkClosed {
+		t.Fatal("expected error sending over closed network")
+	}
+}
@@ -23,6 +23,7 @@ type PeerQueue interface {
 	Startup()
 	AddWantlist(initialWants *wantlist.SessionTrackedWantlist)
 	Shutdown()
+	Stopped() <-chan struct{}
 }
 
 // PeerQueueFactory provides a function that will create a PeerQueue.
@@ -43,6 +44,10 @@ type PeerManager struct {
 	peerQueues   map[peer.ID]*peerQueueInstance
 	peerQueuesLk sync.RWMutex
 
+	// queues of disconnected peers that may not have stopped yet
+	stopping []PeerQueue
+	closed   bool
+
 	createPeerQueue PeerQueueFactory
 	ctx             context.Context
 }
@@ -71,6 +76,10 @@ func (pm *PeerManager) ConnectedPeers() []peer.ID {
 // of wants.
 func (pm *PeerManager) Connected(p peer.ID, initialWants *wantlist.SessionTrackedWantlist) {
 	pm.peerQueuesLk.Lock()
+	if pm.closed {
+		pm.peerQueuesLk.Unlock()
+		return
+	}
 
 	pq := pm.getOrCreate(p)
 
@@ -100,12 +109,47 @@ func (pm *PeerManager) Disconnected(p peer.ID) {
 	}
 
 	delete(pm.peerQueues, p)
+	pm.trackStopping(pq.pq)
 	pm.peerQueuesLk.Unlock()
 
 	pq.pq.Shutdown()
 
 }
 
+// Shutdown stops the queues of all peers, letting them send their pending
+// messages, and waits for them to stop. Peers connecting afterwards are
+// ignored.
+func (pm *PeerManager) Shutdown() {
+	pm.peerQueuesLk.Lock()
+	pm.closed = true
+	queues := pm.stopping
+	pm.stopping = nil
+	for p, pqi := range pm.peerQueues {
+		delete(pm.peerQueues, p)
+		pqi.pq.Shutdown()
+		queues = append(queues, pqi.pq)
+	}
+	pm.peerQueuesLk.Unlock()
+
+	for _, pq := range queues {
+		<-pq.Stopped()
+	}
+}
+
+// trackStopping remembers a queue being shut down, forgetting those that
+// have stopped since.
+func (pm *PeerManager) trackStopping(pq PeerQueue) {
+	stopping := pm.stopping[:0]
+	for _, spq := range pm.stopping {
+		select {
+		case <-spq.Stopped():
+		default:
+			stopping = append(stopping, spq)
+		}
+	}
+	pm.stopping = append(stopping, pq)
+}
+
 // SendMessage is called to send a message to all or some peers in the pool;
 // if targets is nil, it sends to all.
 func (pm *PeerManager) SendMessage(entries []bsmsg.Entry, targets []peer.ID, from uint64) {
@@ -118,6 +162,10 @@ func (pm *PeerManager) SendMessage(entries []bsmsg.Entry, targets []peer.ID, fro
 	} else {
 		for _, t := range targets {
 			pm.peerQueuesLk.Lock()
+			if pm.closed {
+				pm.peerQueuesLk.Unlock()
+				return
+			}
 			pqi := pm.getOrCreate(t)
 			pm.peerQueuesLk.Unlock()
 			pqi.pq.AddMessage(entries, from)
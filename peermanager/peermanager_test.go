@@ -27,6 +27,12 @@ type fakePeer struct {
 func (fp *fakePeer) Startup()  {}
 func (fp *fakePeer) Shutdown() {}
 
+func (fp *fakePeer) Stopped() <-chan struct{} {
+	stopped := make(chan struct{})
+	close(stopped)
+	return stopped
+}
+
 func (fp *fakePeer) AddMessage(entries []bsmsg.Entry, ses uint64) {
 	fp.messagesSent <- messageSent{fp.p, entries, ses}
 }
@@ -71,6 +71,8 @@ type cancelRequestMessage struct {
 // - manage timeouts
 type ProviderQueryManager struct {
 	ctx                          context.Context
+	cancel                       func()
+	running                      sync.WaitGroup
 	network                      ProviderQueryNetwork
 	providerQueryMessages        chan providerQueryMessage
 	providerRequestsProcessing   chan *findProviderRequest
@@ -86,8 +88,10 @@ type ProviderQueryManager struct {
 // New initializes a new ProviderQueryManager for a given context and a given
 // network provider.
 func New(ctx context.Context, network ProviderQueryNetwork) *ProviderQueryManager {
+	ctx, cancel := context.WithCancel(ctx)
 	return &ProviderQueryManager{
 		ctx:                          ctx,
+		cancel:                       cancel,
 		network:                      network,
 		providerQueryMessages:        make(chan providerQueryMessage, 16),
 		providerRequestsProcessing:   make(chan *findProviderRequest),
@@ -99,9 +103,17 @@ func New(ctx context.Context, network ProviderQueryNetwork) *ProviderQueryManage
 
 // Startup starts processing for the ProviderQueryManager.
 func (pqm *ProviderQueryManager) Startup() {
+	pqm.running.Add(1)
 	go pqm.run()
 }
 
+// Shutdown cancels all provider queries, closing the channels returned by
+// FindProvidersAsync, and waits for the ProviderQueryManager to stop.
+func (pqm *ProviderQueryManager) Shutdown() {
+	pqm.cancel()
+	pqm.running.Wait()
+}
+
 type inProgressRequest struct {
 	providersSoFar []peer.ID
 	incoming       chan peer.ID
@@ -159,6 +171,7 @@ func (pqm *ProviderQueryManager) receiveProviders(sessionCtx context.Context, k
 	incomingProviders := receivedInProgressRequest.incoming
 
 	go func() {
+		defer pqm.running.Done()
 		defer close(returnedProviders)
 		outgoingProviders := func() chan<- peer.ID {
 			if len(receivedProviders) == 0 {
@@ -217,6 +230,7 @@ func (pqm *ProviderQueryManager) cancelProviderRequest(k cid.Cid, incomingProvid
 }
 
 func (pqm *ProviderQueryManager) findProviderWorker() {
+	defer pqm.running.Done()
 	// findProviderWorker just cycles through incoming provider queries one
 	// at a time. We have six of these workers running at once
 	// to let requests go in parallel but keep them rate limited
@@ -267,6 +281,7 @@ func (pqm *ProviderQueryManager) findProviderWorker() {
 }
 
 func (pqm *ProviderQueryManager) providerRequestBufferWorker() {
+	defer pqm.running.Done()
 	// the provider request buffer worker just maintains an unbounded
 	// buffer for incoming provider queries and dispatches to the find
 	// provider workers as they become available
@@ -310,8 +325,10 @@ func (pqm *ProviderQueryManager) cleanupInProcessRequests() {
 }
 
 func (pqm *ProviderQueryManager) run() {
+	defer pqm.running.Done()
 	defer pqm.cleanupInProcessRequests()
 
+	pqm.running.Add(1 + maxInProcessRequests)
 	go pqm.providerRequestBufferWorker()
 	for i := 0; i < maxInProcessRequests; i++ {
 		go pqm.findProviderWorker()
@@ -390,12 +407,16 @@ func (npqm *newProvideQueryMessage) handle(pqm *ProviderQueryManager) {
 	}
 	inProgressChan := make(chan peer.ID)
 	requestStatus.listeners[inProgressChan] = struct{}{}
+	// count the goroutine the requester starts to receive the providers
+	// here, while the run loop is still counted
+	pqm.running.Add(1)
 	select {
 	case npqm.inProgressRequestChan <- inProgressRequest{
 		providersSoFar: requestStatus.providersSoFar,
 		incoming:       inProgressChan,
 	}:
 	case <-pqm.ctx.Done():
+		pqm.running.Done()
 	}
 }
 
@@ -4,7 +4,9 @@ import cid "github.com/ipfs/go-cid"
 
 type cidQueue struct {
 	elems []cid.Cid
-	eset  *cid.Set
+	// urgent elements are popped before the others
+	urgent []cid.Cid
+	eset   *cid.Set
 }
 
 func newCidQueue() *cidQueue {
@@ -13,13 +15,18 @@ func newCidQueue() *cidQueue {
 
 func (cq *cidQueue) Pop() cid.Cid {
 	for {
-		if len(cq.elems) == 0 {
+		var out cid.Cid
+		switch {
+		case len(cq.urgent) > 0:
+			out = cq.urgent[0]
+			cq.urgent = cq.urgent[1:]
+		case len(cq.elems) > 0:
+			out = cq.elems[0]
+			cq.elems = cq.elems[1:]
+		default:
 			return cid.Cid{}
 		}
 
-		out := cq.elems[0]
-		cq.elems = cq.elems[1:]
-
 		if cq.eset.Has(out) {
 			cq.eset.Remove(out)
 			return out
@@ -33,6 +40,14 @@ func (cq *cidQueue) Push(c cid.Cid) {
 	}
 }
 
+// PushUrgent adds c after the other urgent elements but before the rest, or
+// moves it there if it's already queued.
+func (cq *cidQueue) PushUrgent(c cid.Cid) {
+	// an entry left behind in elems is skipped once c is popped
+	cq.eset.Add(c)
+	cq.urgent = append(cq.urgent, c)
+}
+
 func (cq *cidQueue) Remove(c cid.Cid) {
 	cq.eset.Remove(c)
 }
@@ -12,8 +12,6 @@ import (
 	logging "github.com/ipfs/go-log"
 	loggables "github.com/libp2p/go-libp2p-loggables"
 	peer "github.com/libp2p/go-libp2p-peer"
-
-	bssrs "github.com/ipfs/go-bitswap/sessionrequestsplitter"
 )
 
 const (
@@ -25,6 +23,7 @@ const (
 // from given peers.
 type WantManager interface {
 	WantBlocks(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64)
+	WantHaves(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64)
 	CancelWants(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64)
 }
 
@@ -33,14 +32,18 @@ type WantManager interface {
 type PeerManager interface {
 	FindMorePeers(context.Context, cid.Cid)
 	GetOptimizedPeers() []peer.ID
+	GetPeersWithBlock(cid.Cid) []peer.ID
 	RecordPeerRequests([]peer.ID, []cid.Cid)
-	RecordPeerResponse(peer.ID, cid.Cid)
+	RecordPeerResponse(p peer.ID, k cid.Cid, size int)
+	RecordPeerHaves(peer.ID, []cid.Cid)
+	RecordPeerDontHaves(peer.ID, []cid.Cid)
+	RecordCancels([]cid.Cid)
+	AddPeers([]peer.ID)
 }
 
-// RequestSplitter provides an interface for splitting
-// a request for Cids up among peers.
+// RequestSplitter provides an interface for tracking how many duplicate
+// blocks a session receives.
 type RequestSplitter interface {
-	SplitRequest([]peer.ID, []cid.Cid) []*bssrs.PartialRequest
 	RecordDuplicateBlock()
 	RecordUniqueBlock()
 }
@@ -56,6 +59,18 @@ type blkRecv struct {
 	counterMessage bool
 }
 
+type reasonReq struct {
+	keys []cid.Cid
+	resp chan map[cid.Cid]error
+}
+
+type presenceRecv struct {
+	from         peer.ID
+	haves        []cid.Cid
+	dontHaves    []cid.Cid
+	notPermitted []cid.Cid
+}
+
 // Session holds state for an individual bitswap transfer operation.
 // This allows bitswap to make smarter decisions about who to send wantlist
 // info to, and who to request blocks from.
@@ -68,48 +83,122 @@ type Session struct {
 
 	// channels
 	incoming      chan blkRecv
+	presences     chan presenceRecv
 	newReqs       chan []cid.Cid
+	urgentReqs    chan []cid.Cid
 	cancelKeys    chan []cid.Cid
 	interestReqs  chan interestReq
 	latencyReqs   chan chan time.Duration
 	tickDelayReqs chan time.Duration
+	statReqs      chan chan Stat
+	reasonReqs    chan reasonReq
+	// progressFuncReqs is unbuffered so the function is set once
+	// SetProgressFunc returns
+	progressFuncReqs chan ProgressFunc
 
 	// do not touch outside run loop
-	tofetch       *cidQueue
-	interest      *lru.Cache
-	pastWants     *cidQueue
-	liveWants     map[cid.Cid]time.Time
-	tick          *time.Timer
-	baseTickDelay time.Duration
-	latTotal      time.Duration
-	fetchcnt      int
+	tofetch   *cidQueue
+	interest  *lru.Cache
+	pastWants *cidQueue
+	liveWants map[cid.Cid]time.Time
+	// wantBlockPeers tracks the peer each live want was sent to as a
+	// want-block
+	wantBlockPeers map[cid.Cid]peer.ID
+	tick           *time.Timer
+	baseTickDelay  time.Duration
+	latTotal       time.Duration
+	fetchcnt       int
+	// asked tracks the peers each wanted block was asked of directly or
+	// that answered for it, and refused the ones that won't send it to us
+	asked   map[cid.Cid]map[peer.ID]struct{}
+	refused map[cid.Cid]map[peer.ID]struct{}
+	// counters reported by Stat
+	started         time.Time
+	blocksReceived  int
+	dataReceived    uint64
+	dupBlksReceived int
+	dupDataReceived uint64
+	peerStats       map[peer.ID]PeerStat
+	progress        ProgressFunc
+
+	// configuration
+	provSearchDelay         time.Duration
+	broadcastLiveWantsLimit int
+	targetedLiveWantsLimit  int
+
+	// closed once the run loop has shut down
+	stopped chan struct{}
 	// identifiers
 	notif notifications.PubSub
 	uuid  logging.Loggable
 	id    uint64
 }
 
+// Option configures a session.
+type Option func(*Session)
+
+// ProviderSearchDelay sets how long the session waits for blocks before
+// searching for more providers.
+func ProviderSearchDelay(delay time.Duration) Option {
+	return func(s *Session) {
+		s.provSearchDelay = delay
+	}
+}
+
+// BroadcastLiveWantsLimit sets how many wants the session keeps live while
+// it has no peers to target.
+func BroadcastLiveWantsLimit(limit int) Option {
+	return func(s *Session) {
+		s.broadcastLiveWantsLimit = limit
+	}
+}
+
+// TargetedLiveWantsLimit sets how many wants the session keeps live once it
+// has peers to target.
+func TargetedLiveWantsLimit(limit int) Option {
+	return func(s *Session) {
+		s.targetedLiveWantsLimit = limit
+	}
+}
+
 // New creates a new bitswap session whose lifetime is bounded by the
 // given context.
-func New(ctx context.Context, id uint64, wm WantManager, pm PeerManager, srs RequestSplitter) *Session {
+func New(ctx context.Context, id uint64, wm WantManager, pm PeerManager, srs RequestSplitter, options ...Option) *Session {
 	s := &Session{
-		liveWants:     make(map[cid.Cid]time.Time),
-		newReqs:       make(chan []cid.Cid),
-		cancelKeys:    make(chan []cid.Cid),
-		tofetch:       newCidQueue(),
-		pastWants:     newCidQueue(),
-		interestReqs:  make(chan interestReq),
-		latencyReqs:   make(chan chan time.Duration),
-		tickDelayReqs: make(chan time.Duration),
-		ctx:           ctx,
-		wm:            wm,
-		pm:            pm,
-		srs:           srs,
-		incoming:      make(chan blkRecv),
-		notif:         notifications.New(),
-		uuid:          loggables.Uuid("GetBlockRequest"),
-		baseTickDelay: time.Millisecond * 500,
-		id:            id,
+		liveWants:               make(map[cid.Cid]time.Time),
+		wantBlockPeers:          make(map[cid.Cid]peer.ID),
+		asked:                   make(map[cid.Cid]map[peer.ID]struct{}),
+		refused:                 make(map[cid.Cid]map[peer.ID]struct{}),
+		newReqs:                 make(chan []cid.Cid),
+		urgentReqs:              make(chan []cid.Cid),
+		cancelKeys:              make(chan []cid.Cid),
+		tofetch:                 newCidQueue(),
+		pastWants:               newCidQueue(),
+		interestReqs:            make(chan interestReq),
+		latencyReqs:             make(chan chan time.Duration),
+		tickDelayReqs:           make(chan time.Duration),
+		statReqs:                make(chan chan Stat),
+		reasonReqs:              make(chan reasonReq),
+		progressFuncReqs:        make(chan ProgressFunc),
+		started:                 time.Now(),
+		peerStats:               make(map[peer.ID]PeerStat),
+		ctx:                     ctx,
+		wm:                      wm,
+		pm:                      pm,
+		srs:                     srs,
+		incoming:                make(chan blkRecv),
+		presences:               make(chan presenceRecv),
+		notif:                   notifications.New(),
+		stopped:                 make(chan struct{}),
+		uuid:                    loggables.Uuid("GetBlockRequest"),
+		baseTickDelay:           time.Millisecond * 500,
+		id:                      id,
+		provSearchDelay:         provSearchDelay,
+		broadcastLiveWantsLimit: broadcastLiveWantsLimit,
+		targetedLiveWantsLimit:  targetedLiveWantsLimit,
+	}
+	for _, option := range options {
+		option(s)
 	}
 
 	cache, _ := lru.New(2048)
@@ -131,6 +220,15 @@ func (s *Session) ReceiveBlockFrom(from peer.ID, blk blocks.Block) {
 
 }
 
+// ReceivePresencesFrom receives HAVE, DONT_HAVE and NOT_PERMITTED presences
+// from the given peer.
+func (s *Session) ReceivePresencesFrom(from peer.ID, haves []cid.Cid, dontHaves []cid.Cid, notPermitted []cid.Cid) {
+	select {
+	case s.presences <- presenceRecv{from: from, haves: haves, dontHaves: dontHaves, notPermitted: notPermitted}:
+	case <-s.ctx.Done():
+	}
+}
+
 // UpdateReceiveCounters updates receive counters for a block,
 // which may be a duplicate and adjusts the split factor based on that.
 func (s *Session) UpdateReceiveCounters(blk blocks.Block) {
@@ -179,8 +277,64 @@ func (s *Session) GetBlock(parent context.Context, k cid.Cid) (blocks.Block, err
 // returns a channel that found blocks will be returned on. No order is
 // guaranteed on the returned blocks.
 func (s *Session) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks.Block, error) {
+	return s.getBlocks(ctx, keys, s.newReqs)
+}
+
+// GetBlocksOrdered fetches a set of blocks within the context of this session
+// and returns a channel on which they are returned in the order of keys. Only
+// window blocks are wanted at a time, ahead of the session's other wants, and
+// the next one once the first of them was returned. If the blocks channel
+// closes before every block was returned, the error channel says why.
+func (s *Session) GetBlocksOrdered(ctx context.Context, keys []cid.Cid, window int) (<-chan blocks.Block, <-chan error) {
+	return bsgetter.AsyncGetBlocksOrdered(ctx, keys, window,
+		func(ctx context.Context, keys []cid.Cid) (<-chan blocks.Block, error) {
+			return s.getBlocks(ctx, keys, s.urgentReqs)
+		},
+	)
+}
+
+// getBlocks fetches a set of blocks, sending the keys to the run loop on the
+// given channel of requests.
+func (s *Session) getBlocks(ctx context.Context, keys []cid.Cid, reqs chan<- []cid.Cid) (<-chan blocks.Block, error) {
 	ctx = logging.ContextWithLoggable(ctx, s.uuid)
 	return bsgetter.AsyncGetBlocks(ctx, keys, s.notif,
+		func(ctx context.Context, keys []cid.Cid) {
+			select {
+			case reqs <- keys:
+			case <-ctx.Done():
+			case <-s.ctx.Done():
+			}
+		},
+		func(keys []cid.Cid) {
+			select {
+			case s.cancelKeys <- keys:
+			case <-s.ctx.Done():
+			}
+		},
+	)
+}
+
+// FetchBlock fetches a single block. If the block can't be fetched, the error
+// is a *bsgetter.FetchError saying why.
+func (s *Session) FetchBlock(ctx context.Context, k cid.Cid) (blocks.Block, error) {
+	results, err := s.FetchBlocks(ctx, []cid.Cid{k})
+	if err != nil {
+		return nil, err
+	}
+	r := <-results
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.Block, nil
+}
+
+// FetchBlocks fetches a set of blocks within the context of this session and
+// returns a channel with a result for each of the keys, repeats included: the
+// block, or why it could not be fetched by the time ctx ended. Failures are only told apart
+// while the session runs, they are reported as cancelled once it shut down.
+func (s *Session) FetchBlocks(ctx context.Context, keys []cid.Cid) (<-chan bsgetter.Result, error) {
+	ctx = logging.ContextWithLoggable(ctx, s.uuid)
+	return bsgetter.AsyncFetchBlocks(ctx, keys, s.notif,
 		func(ctx context.Context, keys []cid.Cid) {
 			select {
 			case s.newReqs <- keys:
@@ -194,9 +348,44 @@ func (s *Session) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks.
 			case <-s.ctx.Done():
 			}
 		},
+		s.failureReasons,
 	)
 }
 
+// failureReasons returns why the given blocks weren't fetched yet.
+func (s *Session) failureReasons(keys []cid.Cid) map[cid.Cid]error {
+	resp := make(chan map[cid.Cid]error, 1)
+	select {
+	case s.reasonReqs <- reasonReq{keys, resp}:
+	case <-s.ctx.Done():
+		return cancelledReasons(keys)
+	}
+
+	select {
+	case reasons := <-resp:
+		return reasons
+	case <-s.ctx.Done():
+		return cancelledReasons(keys)
+	}
+}
+
+func cancelledReasons(keys []cid.Cid) map[cid.Cid]error {
+	reasons := make(map[cid.Cid]error, len(keys))
+	for _, k := range keys {
+		reasons[k] = bsgetter.ErrCancelled
+	}
+	return reasons
+}
+
+// GetBlocksFrom is like GetBlocks, but first adds the given providers of the
+// blocks to the session so the blocks are asked of them right away.
+func (s *Session) GetBlocksFrom(ctx context.Context, keys []cid.Cid, providers []peer.ID) (<-chan blocks.Block, error) {
+	if len(providers) > 0 {
+		s.pm.AddPeers(providers)
+	}
+	return s.GetBlocks(ctx, keys)
+}
+
 // GetAverageLatency returns the average latency for block requests.
 func (s *Session) GetAverageLatency() time.Duration {
 	resp := make(chan time.Duration)
@@ -224,15 +413,23 @@ func (s *Session) SetBaseTickDelay(baseTickDelay time.Duration) {
 
 var provSearchDelay = time.Second
 
-// SetProviderSearchDelay overwrites the global provider search delay
+// SetProviderSearchDelay overwrites the global provider search delay, used
+// by sessions created without the ProviderSearchDelay option
 func SetProviderSearchDelay(newProvSearchDelay time.Duration) {
 	provSearchDelay = newProvSearchDelay
 }
 
+// Stopped returns a channel that is closed once the session has shut down,
+// after its context was cancelled and its live wants were cancelled.
+func (s *Session) Stopped() <-chan struct{} {
+	return s.stopped
+}
+
 // Session run loop -- everything function below here should not be called
 // of this loop
 func (s *Session) run(ctx context.Context) {
-	s.tick = time.NewTimer(provSearchDelay)
+	defer close(s.stopped)
+	s.tick = time.NewTimer(s.provSearchDelay)
 	for {
 		select {
 		case blk := <-s.incoming:
@@ -241,8 +438,12 @@ func (s *Session) run(ctx context.Context) {
 			} else {
 				s.handleIncomingBlock(ctx, blk)
 			}
+		case pr := <-s.presences:
+			s.handleIncomingPresences(ctx, pr)
 		case keys := <-s.newReqs:
-			s.handleNewRequest(ctx, keys)
+			s.handleNewRequest(ctx, keys, false)
+		case keys := <-s.urgentReqs:
+			s.handleNewRequest(ctx, keys, true)
 		case keys := <-s.cancelKeys:
 			s.handleCancel(keys)
 		case <-s.tick.C:
@@ -253,6 +454,12 @@ func (s *Session) run(ctx context.Context) {
 			resp <- s.averageLatency()
 		case baseTickDelay := <-s.tickDelayReqs:
 			s.baseTickDelay = baseTickDelay
+		case resp := <-s.statReqs:
+			resp <- s.stat()
+		case req := <-s.reasonReqs:
+			req.resp <- s.reasons(req.keys)
+		case f := <-s.progressFuncReqs:
+			s.progress = f
 		case <-ctx.Done():
 			s.handleShutdown()
 			return
@@ -264,15 +471,81 @@ func (s *Session) handleIncomingBlock(ctx context.Context, blk blkRecv) {
 	s.tick.Stop()
 
 	if blk.from != "" {
-		s.pm.RecordPeerResponse(blk.from, blk.blk.Cid())
+		s.pm.RecordPeerResponse(blk.from, blk.blk.Cid(), len(blk.blk.RawData()))
 	}
 
-	s.receiveBlock(ctx, blk.blk)
+	s.receiveBlock(ctx, blk.from, blk.blk)
 
 	s.resetTick()
 }
 
-func (s *Session) handleNewRequest(ctx context.Context, keys []cid.Cid) {
+func (s *Session) handleIncomingPresences(ctx context.Context, pr presenceRecv) {
+	haves := s.filterWanted(pr.haves)
+	dontHaves := s.filterWanted(pr.dontHaves)
+	notPermitted := s.filterWanted(pr.notPermitted)
+	for _, c := range haves {
+		s.markAsked(c, pr.from)
+	}
+	for _, c := range dontHaves {
+		s.markAsked(c, pr.from)
+	}
+	for _, c := range notPermitted {
+		s.markAsked(c, pr.from)
+		refused, ok := s.refused[c]
+		if !ok {
+			refused = make(map[peer.ID]struct{})
+			s.refused[c] = refused
+		}
+		refused[pr.from] = struct{}{}
+	}
+	// a peer that won't send us a block is as good as one without it
+	dontHaves = append(dontHaves, notPermitted...)
+	if len(haves) > 0 {
+		s.pm.RecordPeerHaves(pr.from, haves)
+	}
+	if len(dontHaves) > 0 {
+		s.pm.RecordPeerDontHaves(pr.from, dontHaves)
+	}
+
+	// ask the peer for live wants no one has been asked for yet
+	var wants []cid.Cid
+	for _, c := range haves {
+		if _, ok := s.liveWants[c]; !ok {
+			continue
+		}
+		if _, ok := s.wantBlockPeers[c]; ok {
+			continue
+		}
+		wants = append(wants, c)
+	}
+	if len(wants) > 0 {
+		s.wantBlocksFrom(ctx, pr.from, wants)
+	}
+
+	// move wants the peer turned down on to another peer that has the block
+	for _, c := range dontHaves {
+		if p, ok := s.wantBlockPeers[c]; !ok || p != pr.from {
+			continue
+		}
+		delete(s.wantBlockPeers, c)
+		s.wm.CancelWants(ctx, []cid.Cid{c}, []peer.ID{pr.from}, s.id)
+		if p, ok := leastLoaded(s.pm.GetPeersWithBlock(c), pr.from, s.wantBlockLoad()); ok {
+			s.wantBlocksFrom(ctx, p, []cid.Cid{c})
+		}
+	}
+}
+
+func (s *Session) filterWanted(ks []cid.Cid) []cid.Cid {
+	var wanted []cid.Cid
+	for _, c := range ks {
+		if s.cidIsWanted(c) {
+			wanted = append(wanted, c)
+		}
+	}
+	return wanted
+}
+
+func (s *Session) handleNewRequest(ctx context.Context, keys []cid.Cid, urgent bool) {
 	for _, k := range keys {
 		s.interest.Add(k, nil)
 	}
@@ -287,14 +560,40 @@ func (s *Session) handleNewRequest(ctx context.Context, keys []cid.Cid) {
 		s.wantBlocks(ctx, now)
 	}
 	for _, k := range keys {
-		s.tofetch.Push(k)
+		if urgent {
+			s.tofetch.PushUrgent(k)
+		} else {
+			s.tofetch.Push(k)
+		}
 	}
 }
 
 func (s *Session) handleCancel(keys []cid.Cid) {
 	for _, c := range keys {
 		s.tofetch.Remove(c)
+		s.forgetAsked(c)
+	}
+	s.pm.RecordCancels(keys)
+}
+
+// reasons returns why the given blocks weren't received yet: every peer
+// asked for them refused to send them, or no peer to ask for them was found,
+// or else the peers being asked didn't send them in time.
+func (s *Session) reasons(keys []cid.Cid) map[cid.Cid]error {
+	noPeers := len(s.pm.GetOptimizedPeers()) == 0
+	reasons := make(map[cid.Cid]error, len(keys))
+	for _, c := range keys {
+		withBlock := len(s.pm.GetPeersWithBlock(c)) > 0
+		switch {
+		case len(s.refused[c]) > 0 && len(s.refused[c]) == len(s.asked[c]):
+			reasons[c] = bsgetter.ErrRejected
+		case noPeers && len(s.asked[c]) == 0 && !withBlock:
+			reasons[c] = bsgetter.ErrNoProviders
+		default:
+			reasons[c] = bsgetter.ErrTimeout
+		}
 	}
+	return reasons
 }
 
 func (s *Session) handleTick(ctx context.Context) {
@@ -308,7 +607,23 @@ func (s *Session) handleTick(ctx context.Context) {
 
 	// Broadcast these keys to everyone we're connected to
 	s.pm.RecordPeerRequests(nil, live)
-	s.wm.WantBlocks(ctx, live, nil, s.id)
+	s.wm.WantHaves(ctx, live, nil, s.id)
+
+	// the peers we asked for these blocks haven't delivered yet, also ask
+	// other peers that told us they have them
+	load := s.wantBlockLoad()
+	retries := make(map[peer.ID][]cid.Cid)
+	for _, c := range live {
+		p, ok := leastLoaded(s.pm.GetPeersWithBlock(c), s.wantBlockPeers[c], load)
+		if !ok {
+			continue
+		}
+		load[p]++
+		retries[p] = append(retries[p], c)
+	}
+	for p, ks := range retries {
+		s.wantBlocksFrom(ctx, p, ks)
+	}
 
 	if len(live) > 0 {
 		s.pm.FindMorePeers(ctx, live[0])
@@ -335,7 +650,7 @@ func (s *Session) cidIsWanted(c cid.Cid) bool {
 	return ok
 }
 
-func (s *Session) receiveBlock(ctx context.Context, blk blocks.Block) {
+func (s *Session) receiveBlock(ctx context.Context, from peer.ID, blk blocks.Block) {
 	c := blk.Cid()
 	if s.cidIsWanted(c) {
 		s.srs.RecordUniqueBlock()
@@ -343,10 +658,13 @@ func (s *Session) receiveBlock(ctx context.Context, blk blocks.Block) {
 		if ok {
 			s.latTotal += time.Since(tval)
 			delete(s.liveWants, c)
+			delete(s.wantBlockPeers, c)
 		} else {
 			s.tofetch.Remove(c)
 		}
+		s.forgetAsked(c)
 		s.fetchcnt++
+		s.recordReceived(from, blk)
 		s.notif.Publish(blk)
 
 		toAdd := s.wantBudget()
@@ -369,25 +687,110 @@ func (s *Session) updateReceiveCounters(ctx context.Context, blk blkRecv) {
 	ks := blk.blk.Cid()
 	if s.pastWants.Has(ks) {
 		s.srs.RecordDuplicateBlock()
+		s.recordDuplicate(blk.blk)
 	}
 }
 
+// wantBlocks makes the given keys live wants. Each block is asked of a single
+// peer: one that told us it has the block if there is one, or else one of
+// the session's peers, which the other session peers are asked whether they
+// have the block in case it doesn't. Blocks no peer is known for are
+// broadcast as want-haves.
 func (s *Session) wantBlocks(ctx context.Context, ks []cid.Cid) {
 	now := time.Now()
 	for _, c := range ks {
 		s.liveWants[c] = now
 	}
-	peers := s.pm.GetOptimizedPeers()
-	if len(peers) > 0 {
-		splitRequests := s.srs.SplitRequest(peers, ks)
-		for _, splitRequest := range splitRequests {
-			s.pm.RecordPeerRequests(splitRequest.Peers, splitRequest.Keys)
-			s.wm.WantBlocks(ctx, splitRequest.Keys, splitRequest.Peers, s.id)
+
+	sessionPeers := s.pm.GetOptimizedPeers()
+	load := s.wantBlockLoad()
+	wantBlocks := make(map[peer.ID][]cid.Cid)
+	var wantHaves []cid.Cid
+	var broadcast []cid.Cid
+	for _, c := range ks {
+		if p, ok := leastLoaded(s.pm.GetPeersWithBlock(c), "", load); ok {
+			load[p]++
+			wantBlocks[p] = append(wantBlocks[p], c)
+		} else if p, ok := leastLoaded(sessionPeers, "", load); ok {
+			load[p]++
+			wantBlocks[p] = append(wantBlocks[p], c)
+			wantHaves = append(wantHaves, c)
+		} else {
+			broadcast = append(broadcast, c)
+		}
+	}
+
+	for p, ks := range wantBlocks {
+		s.wantBlocksFrom(ctx, p, ks)
+	}
+	// the want-blocks are queued first, so the peers they went to don't get
+	// these as want-haves
+	if len(wantHaves) > 0 && len(sessionPeers) > 1 {
+		for _, c := range wantHaves {
+			for _, p := range sessionPeers {
+				s.markAsked(c, p)
+			}
+		}
+		s.wm.WantHaves(ctx, wantHaves, sessionPeers, s.id)
+	}
+	if len(broadcast) > 0 {
+		s.pm.RecordPeerRequests(nil, broadcast)
+		s.wm.WantHaves(ctx, broadcast, nil, s.id)
+	}
+}
+
+// wantBlocksFrom asks a single peer to send the given blocks.
+func (s *Session) wantBlocksFrom(ctx context.Context, p peer.ID, ks []cid.Cid) {
+	for _, c := range ks {
+		s.wantBlockPeers[c] = p
+		s.markAsked(c, p)
+	}
+	s.pm.RecordPeerRequests([]peer.ID{p}, ks)
+	s.wm.WantBlocks(ctx, ks, []peer.ID{p}, s.id)
+}
+
+// markAsked records that the block was asked of the peer, or that the peer
+// answered for it.
+func (s *Session) markAsked(c cid.Cid, p peer.ID) {
+	asked, ok := s.asked[c]
+	if !ok {
+		asked = make(map[peer.ID]struct{})
+		s.asked[c] = asked
+	}
+	asked[p] = struct{}{}
+}
+
+// forgetAsked drops who was asked for a block no longer wanted.
+func (s *Session) forgetAsked(c cid.Cid) {
+	delete(s.asked, c)
+	delete(s.refused, c)
+}
+
+// wantBlockLoad returns the number of blocks asked of each peer that haven't
+// arrived yet.
+func (s *Session) wantBlockLoad() map[peer.ID]int {
+	load := make(map[peer.ID]int)
+	for _, p := range s.wantBlockPeers {
+		load[p]++
+	}
+	return load
+}
+
+// leastLoaded returns the peer with the fewest outstanding blocks, preferring
+// peers earlier in the list.
+func leastLoaded(peers []peer.ID, exclude peer.ID, load map[peer.ID]int) (peer.ID, bool) {
+	var best peer.ID
+	found := false
+	for _, p := range peers {
+		if p == exclude {
+			continue
+		}
+		if !found || load[p] < load[best] {
+			best = p
+			found = true
 		}
-	} else {
-		s.pm.RecordPeerRequests(nil, ks)
-		s.wm.WantBlocks(ctx, ks, nil, s.id)
 	}
+	return best, found
 }
 
 func (s *Session) averageLatency() time.Duration {
@@ -396,7 +799,7 @@ func (s *Session) averageLatency() time.Duration {
 
 func (s *Session) resetTick() {
 	if s.latTotal == 0 {
-		s.tick.Reset(provSearchDelay)
+		s.tick.Reset(s.provSearchDelay)
 	} else {
 		avLat := s.averageLatency()
 		s.tick.Reset(s.baseTickDelay + (3 * avLat))
@@ -407,9 +810,9 @@ func (s *Session) wantBudget() int {
 	live := len(s.liveWants)
 	var budget int
 	if len(s.pm.GetOptimizedPeers()) > 0 {
-		budget = targetedLiveWantsLimit - live
+		budget = s.targetedLiveWantsLimit - live
 	} else {
-		budget = broadcastLiveWantsLimit - live
+		budget = s.broadcastLiveWantsLimit - live
 	}
 	if budget < 0 {
 		budget = 0
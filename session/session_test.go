@@ -2,13 +2,14 @@ package session
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/ipfs/go-block-format"
 
-	bssrs "github.com/ipfs/go-bitswap/sessionrequestsplitter"
+	bsgetter "github.com/ipfs/go-bitswap/getter"
 	"github.com/ipfs/go-bitswap/testutil"
 	cid "github.com/ipfs/go-cid"
 	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
@@ -22,6 +23,7 @@ type wantReq struct {
 
 type fakeWantManager struct {
 	wantReqs   chan wantReq
+	haveReqs   chan wantReq
 	cancelReqs chan wantReq
 }
 
@@ -32,6 +34,13 @@ func (fwm *fakeWantManager) WantBlocks(ctx context.Context, cids []cid.Cid, peer
 	}
 }
 
+func (fwm *fakeWantManager) WantHaves(ctx context.Context, cids []cid.Cid, peers []peer.ID, ses uint64) {
+	select {
+	case fwm.haveReqs <- wantReq{cids, peers}:
+	case <-ctx.Done():
+	}
+}
+
 func (fwm *fakeWantManager) CancelWants(ctx context.Context, cids []cid.Cid, peers []peer.ID, ses uint64) {
 	select {
 	case fwm.cancelReqs <- wantReq{cids, peers}:
@@ -42,6 +51,7 @@ func (fwm *fakeWantManager) CancelWants(ctx context.Context, cids []cid.Cid, pee
 type fakePeerManager struct {
 	lk                     sync.RWMutex
 	peers                  []peer.ID
+	haves                  map[cid.Cid][]peer.ID
 	findMorePeersRequested chan struct{}
 }
 
@@ -58,18 +68,52 @@ func (fpm *fakePeerManager) GetOptimizedPeers() []peer.ID {
 	return fpm.peers
 }
 
+func (fpm *fakePeerManager) GetPeersWithBlock(c cid.Cid) []peer.ID {
+	fpm.lk.Lock()
+	defer fpm.lk.Unlock()
+	return fpm.haves[c]
+}
+
 func (fpm *fakePeerManager) RecordPeerRequests([]peer.ID, []cid.Cid) {}
-func (fpm *fakePeerManager) RecordPeerResponse(p peer.ID, c cid.Cid) {
+func (fpm *fakePeerManager) AddPeers(ps []peer.ID) {
+	fpm.lk.Lock()
+	fpm.peers = append(fpm.peers, ps...)
+	fpm.lk.Unlock()
+}
+func (fpm *fakePeerManager) RecordPeerResponse(p peer.ID, c cid.Cid, size int) {
 	fpm.lk.Lock()
 	fpm.peers = append(fpm.peers, p)
 	fpm.lk.Unlock()
 }
 
-type fakeRequestSplitter struct {
+func (fpm *fakePeerManager) RecordPeerHaves(p peer.ID, cids []cid.Cid) {
+	fpm.lk.Lock()
+	defer fpm.lk.Unlock()
+	if fpm.haves == nil {
+		fpm.haves = make(map[cid.Cid][]peer.ID)
+	}
+	for _, c := range cids {
+		fpm.haves[c] = append(fpm.haves[c], p)
+	}
 }
 
-func (frs *fakeRequestSplitter) SplitRequest(peers []peer.ID, keys []cid.Cid) []*bssrs.PartialRequest {
-	return []*bssrs.PartialRequest{&bssrs.PartialRequest{Peers: peers, Keys: keys}}
+func (fpm *fakePeerManager) RecordPeerDontHaves(p peer.ID, cids []cid.Cid) {
+	fpm.lk.Lock()
+	defer fpm.lk.Unlock()
+	for _, c := range cids {
+		var peers []peer.ID
+		for _, hp := range fpm.haves[c] {
+			if hp != p {
+				peers = append(peers, hp)
+			}
+		}
+		fpm.haves[c] = peers
+	}
+}
+
+func (*fakePeerManager) RecordCancels([]cid.Cid) {}
+
+type fakeRequestSplitter struct {
 }
 
 func (frs *fakeRequestSplitter) RecordDuplicateBlock() {}
@@ -79,8 +123,9 @@ func TestSessionGetBlocks(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
 	defer cancel()
 	wantReqs := make(chan wantReq, 1)
+	haveReqs := make(chan wantReq, 1)
 	cancelReqs := make(chan wantReq, 1)
-	fwm := &fakeWantManager{wantReqs, cancelReqs}
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
 	fpm := &fakePeerManager{}
 	frs := &fakeRequestSplitter{}
 	id := testutil.GenerateSessionID()
@@ -98,17 +143,34 @@ func TestSessionGetBlocks(t *testing.T) {
 	}
 
 	// check initial want request
-	receivedWantReq := <-fwm.wantReqs
+	receivedWantReq := <-fwm.haveReqs
 
 	if len(receivedWantReq.cids) != broadcastLiveWantsLimit {
 		t.Fatal("did not enqueue correct initial number of wants")
 	}
 	if receivedWantReq.peers != nil {
-		t.Fatal("first want request should be a broadcast")
+		t.Fatal("first want request should be a want-have broadcast")
 	}
 
-	// now receive the first set of blocks
+	// peers tell us they have the blocks, each block should be asked of
+	// the peer that has it only
 	peers := testutil.GeneratePeers(broadcastLiveWantsLimit)
+	for i, p := range peers {
+		session.ReceivePresencesFrom(p, []cid.Cid{receivedWantReq.cids[i]}, nil, nil)
+		select {
+		case wantBlock := <-wantReqs:
+			if len(wantBlock.peers) != 1 || wantBlock.peers[0] != p {
+				t.Fatal("block should only be asked of the peer that has it")
+			}
+			if len(wantBlock.cids) != 1 || !wantBlock.cids[0].Equals(receivedWantReq.cids[i]) {
+				t.Fatal("peer was asked for the wrong block")
+			}
+		case <-ctx.Done():
+			t.Fatal("did not ask peer for block")
+		}
+	}
+
+	// now receive the first set of blocks
 	var newCancelReqs []wantReq
 	var newBlockReqs []wantReq
 	var receivedBlocks []blocks.Block
@@ -153,11 +215,11 @@ func TestSessionGetBlocks(t *testing.T) {
 	if len(newCancelReqs) != broadcastLiveWantsLimit {
 		t.Fatal("did not cancel each block once it was received")
 	}
-	// new session reqs should be targeted
+	// new session reqs should be targeted, to a single peer per block
 	var newCidsRequested []cid.Cid
 	for _, w := range newBlockReqs {
-		if len(w.peers) == 0 {
-			t.Fatal("should not have broadcast again after initial broadcast")
+		if len(w.peers) != 1 {
+			t.Fatal("should have asked a single session peer for blocks")
 		}
 		newCidsRequested = append(newCidsRequested, w.cids...)
 	}
@@ -186,13 +248,45 @@ func TestSessionGetBlocks(t *testing.T) {
 	}
 }
 
+func TestSessionWantLimitOptions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wantReqs := make(chan wantReq, 1)
+	haveReqs := make(chan wantReq, 1)
+	cancelReqs := make(chan wantReq, 1)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs, BroadcastLiveWantsLimit(2))
+	blockGenerator := blocksutil.NewBlockGenerator()
+	blks := blockGenerator.Blocks(broadcastLiveWantsLimit)
+	var cids []cid.Cid
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+	if _, err := session.GetBlocks(ctx, cids); err != nil {
+		t.Fatal("error getting blocks")
+	}
+
+	select {
+	case receivedWantReq := <-fwm.haveReqs:
+		if len(receivedWantReq.cids) != 2 {
+			t.Fatalf("expected 2 initial wants, got %d", len(receivedWantReq.cids))
+		}
+	case <-ctx.Done():
+		t.Fatal("did not send initial wants")
+	}
+}
+
 func TestSessionFindMorePeers(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 900*time.Millisecond)
 	defer cancel()
 	wantReqs := make(chan wantReq, 1)
+	haveReqs := make(chan wantReq, 1)
 	cancelReqs := make(chan wantReq, 1)
-	fwm := &fakeWantManager{wantReqs, cancelReqs}
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
 	fpm := &fakePeerManager{findMorePeersRequested: make(chan struct{}, 1)}
 	frs := &fakeRequestSplitter{}
 	id := testutil.GenerateSessionID()
@@ -211,7 +305,7 @@ func TestSessionFindMorePeers(t *testing.T) {
 
 	// clear the initial block of wants
 	select {
-	case <-wantReqs:
+	case <-haveReqs:
 	case <-ctx.Done():
 		t.Fatal("Did not make first want request ")
 	}
@@ -240,7 +334,7 @@ func TestSessionFindMorePeers(t *testing.T) {
 
 	// verify a broadcast was made
 	select {
-	case receivedWantReq := <-wantReqs:
+	case receivedWantReq := <-haveReqs:
 		if len(receivedWantReq.cids) < broadcastLiveWantsLimit {
 			t.Fatal("did not rebroadcast whole live list")
 		}
@@ -258,3 +352,477 @@ func TestSessionFindMorePeers(t *testing.T) {
 		t.Fatal("Did not find more peers")
 	}
 }
+
+func TestSessionDontHaveMovesWantToOtherPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	wantReqs := make(chan wantReq, 1)
+	haveReqs := make(chan wantReq, 1)
+	cancelReqs := make(chan wantReq, 1)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	blockGenerator := blocksutil.NewBlockGenerator()
+	blks := blockGenerator.Blocks(2)
+	c := blks[0].Cid()
+	_, err := session.GetBlocks(ctx, []cid.Cid{c})
+	if err != nil {
+		t.Fatal("error getting blocks")
+	}
+
+	select {
+	case <-haveReqs:
+	case <-ctx.Done():
+		t.Fatal("did not broadcast want-have")
+	}
+
+	peers := testutil.GeneratePeers(2)
+	session.ReceivePresencesFrom(peers[0], []cid.Cid{c}, nil, nil)
+	select {
+	case wantBlock := <-wantReqs:
+		if len(wantBlock.peers) != 1 || wantBlock.peers[0] != peers[0] {
+			t.Fatal("block should be asked of the first peer that has it")
+		}
+	case <-ctx.Done():
+		t.Fatal("did not ask peer for block")
+	}
+
+	// a second peer having the block should not duplicate the want-block
+	session.ReceivePresencesFrom(peers[1], []cid.Cid{c}, nil, nil)
+	// round trip through the run loop so the HAVE is handled
+	session.InterestedIn(blks[1].Cid())
+	select {
+	case <-wantReqs:
+		t.Fatal("block should only be asked of one peer at a time")
+	default:
+	}
+
+	session.ReceivePresencesFrom(peers[0], nil, []cid.Cid{c}, nil)
+	select {
+	case cancelReq := <-cancelReqs:
+		if len(cancelReq.peers) != 1 || cancelReq.peers[0] != peers[0] {
+			t.Fatal("want should be cancelled with the peer that doesn't have the block")
+		}
+	case <-ctx.Done():
+		t.Fatal("did not cancel want")
+	}
+	select {
+	case wantBlock := <-wantReqs:
+		if len(wantBlock.peers) != 1 || wantBlock.peers[0] != peers[1] {
+			t.Fatal("block should be asked of the other peer that has it")
+		}
+	case <-ctx.Done():
+		t.Fatal("did not move want to other peer")
+	}
+}
+
+type splitFactorRequestSplitter struct {
+	fakeRequestSplitter
+}
+
+func (srs *splitFactorRequestSplitter) SplitFactor() int { return 3 }
+
+func TestSessionStat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	wantReqs := make(chan wantReq, 10)
+	haveReqs := make(chan wantReq, 10)
+	cancelReqs := make(chan wantReq, 10)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &splitFactorRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	progress := make(chan Stat, 10)
+	session.SetProgressFunc(func(st Stat) { progress <- st })
+
+	blockGenerator := blocksutil.NewBlockGenerator()
+	blks := blockGenerator.Blocks(broadcastLiveWantsLimit + 2)
+	var cids []cid.Cid
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+	_, err := session.GetBlocks(ctx, cids)
+	if err != nil {
+		t.Fatal("error getting blocks")
+	}
+
+	st := session.Stat()
+	if st.LiveWants != broadcastLiveWantsLimit || st.PendingWants != 2 {
+		t.Fatalf("expected %d live and 2 pending wants, got %d and %d", broadcastLiveWantsLimit, st.LiveWants, st.PendingWants)
+	}
+	if st.SplitFactor != 3 {
+		t.Fatal("expected split factor of the request splitter, got", st.SplitFactor)
+	}
+
+	p := testutil.GeneratePeers(1)[0]
+	session.UpdateReceiveCounters(blks[0])
+	session.ReceiveBlockFrom(p, blks[0])
+	select {
+	case st = <-progress:
+	case <-ctx.Done():
+		t.Fatal("progress not reported")
+	}
+	size := uint64(len(blks[0].RawData()))
+	if st.BlocksReceived != 1 || st.DataReceived != size {
+		t.Fatal("expected progress to count the received block")
+	}
+	if ps := st.Peers[p]; ps.BlocksReceived != 1 || ps.DataReceived != size {
+		t.Fatal("expected progress to count the block for the peer")
+	}
+
+	// the same block arriving again is a duplicate
+	session.UpdateReceiveCounters(blks[0])
+	st = session.Stat()
+	if st.BlocksReceived != 1 || st.DupBlksReceived != 1 || st.DupDataReceived != size {
+		t.Fatal("expected duplicate to be counted apart")
+	}
+	// with a peer to target, the pending wants became live
+	if st.LiveWants != len(blks)-1 || st.PendingWants != 0 {
+		t.Fatal("expected pending wants to become live")
+	}
+
+	cancel()
+	<-session.Stopped()
+	if st = session.Stat(); st.BlocksReceived != 1 {
+		t.Fatal("expected final stat once the session stopped")
+	}
+}
+
+func TestSessionGetBlocksFromProviders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	wantReqs := make(chan wantReq, 1)
+	haveReqs := make(chan wantReq, 1)
+	cancelReqs := make(chan wantReq, 1)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	blockGenerator := blocksutil.NewBlockGenerator()
+	c := blockGenerator.Next().Cid()
+	provider := testutil.GeneratePeers(1)[0]
+
+	_, err := session.GetBlocksFrom(ctx, []cid.Cid{c}, []peer.ID{provider})
+	if err != nil {
+		t.Fatal("error getting blocks")
+	}
+	select {
+	case wantBlock := <-wantReqs:
+		if len(wantBlock.peers) != 1 || wantBlock.peers[0] != provider {
+			t.Fatal("block should be asked of the provider")
+		}
+	case <-haveReqs:
+		t.Fatal("block should not be broadcast")
+	case <-ctx.Done():
+		t.Fatal("did not ask provider for block")
+	}
+}
+
+func TestSessionFetchBlocksReportsFailures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wantReqs := make(chan wantReq, 10)
+	haveReqs := make(chan wantReq, 10)
+	cancelReqs := make(chan wantReq, 10)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	blockGenerator := blocksutil.NewBlockGenerator()
+	blks := blockGenerator.Blocks(6)
+	var cids []cid.Cid
+	for _, block := range blks {
+		cids = append(cids, block.Cid())
+	}
+
+	fetchCtx, fetchCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer fetchCancel()
+	results, err := session.FetchBlocks(fetchCtx, cids)
+	if err != nil {
+		t.Fatal("error fetching blocks")
+	}
+	peers := testutil.GeneratePeers(2)
+	// the first peer has the first block but never sends it, and doesn't
+	// have the second; no one is found for the third; the fourth arrives;
+	// both peers refuse to send the fifth, only one the sixth while the
+	// other doesn't have it
+	session.ReceivePresencesFrom(peers[0], cids[:1], cids[1:2], cids[4:6])
+	session.ReceivePresencesFrom(peers[1], nil, cids[5:6], cids[4:5])
+	session.ReceiveBlockFrom("", blks[3])
+
+	expected := map[cid.Cid]error{
+		cids[0]: bsgetter.ErrTimeout,
+		cids[1]: bsgetter.ErrTimeout,
+		cids[2]: bsgetter.ErrNoProviders,
+		cids[3]: nil,
+		cids[4]: bsgetter.ErrRejected,
+		cids[5]: bsgetter.ErrTimeout,
+	}
+	for r := range results {
+		reason, ok := expected[r.Cid]
+		if !ok {
+			t.Fatal("unexpected result for", r.Cid)
+		}
+		delete(expected, r.Cid)
+		if reason == nil {
+			if r.Err != nil || r.Block == nil {
+				t.Fatal("expected block", r.Cid)
+			}
+			continue
+		}
+		if r.Err == nil || !errors.Is(r.Err, reason) {
+			t.Fatalf("expected %s to fail with %s, got %v", r.Cid, reason, r.Err)
+		}
+	}
+	if len(expected) != 0 {
+		t.Fatal("missing results")
+	}
+
+	// a cancelled fetch fails with the cancellation
+	fetchCtx, fetchCancel = context.WithCancel(ctx)
+	fetchCancel()
+	if _, err := session.FetchBlock(fetchCtx, cids[0]); !errors.Is(err, bsgetter.ErrCancelled) {
+		t.Fatal("expected cancelled fetch, got", err)
+	}
+}
+
+func TestSessionFetchBlocksRepeatedKeys(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wantReqs := make(chan wantReq, 10)
+	haveReqs := make(chan wantReq, 10)
+	cancelReqs := make(chan wantReq, 10)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	blockGenerator := blocksutil.NewBlockGenerator()
+	blks := blockGenerator.Blocks(2)
+	a, b := blks[0].Cid(), blks[1].Cid()
+
+	fetchCtx, fetchCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer fetchCancel()
+	results, err := session.FetchBlocks(fetchCtx, []cid.Cid{a, b, a, b, a})
+	if err != nil {
+		t.Fatal("error fetching blocks")
+	}
+	session.ReceiveBlockFrom("", blks[0])
+
+	fetched, failed := 0, 0
+	for r := range results {
+		switch {
+		case r.Cid.Equals(a) && r.Block != nil:
+			fetched++
+		case r.Cid.Equals(b) && r.Err != nil:
+			failed++
+		default:
+			t.Fatalf("unexpected result %+v", r)
+		}
+	}
+	if fetched != 3 || failed != 2 {
+		t.Fatalf("expected a result per requested key, got %d fetched and %d failed", fetched, failed)
+	}
+}
+
+func TestSessionGetBlocksOrdered(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wantReqs := make(chan wantReq, 20)
+	haveReqs := make(chan wantReq, 20)
+	cancelReqs := make(chan wantReq, 20)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	blockGenerator := blocksutil.NewBlockGenerator()
+	unordered := blockGenerator.Blocks(broadcastLiveWantsLimit + 2)
+	ordered := blockGenerator.Blocks(3)
+	cidsOf := func(blks []blocks.Block) []cid.Cid {
+		var cids []cid.Cid
+		for _, b := range blks {
+			cids = append(cids, b.Cid())
+		}
+		return cids
+	}
+
+	// fill the live wants so the rest waits
+	if _, err := session.GetBlocks(ctx, cidsOf(unordered)); err != nil {
+		t.Fatal("error getting blocks")
+	}
+	<-haveReqs
+	out, errs := session.GetBlocksOrdered(ctx, cidsOf(ordered), 2)
+	for session.Stat().PendingWants != 4 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("ordered window not requested")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// the window is wanted ahead of the unordered blocks
+	session.ReceiveBlockFrom("", unordered[0])
+	select {
+	case broadcast := <-haveReqs:
+		if len(broadcast.cids) != 1 || !broadcast.cids[0].Equals(ordered[0].Cid()) {
+			t.Fatal("expected first ordered block to be wanted next")
+		}
+	case <-ctx.Done():
+		t.Fatal("did not want next block")
+	}
+
+	// blocks arriving out of order are delivered in order
+	session.ReceiveBlockFrom("", ordered[1])
+	select {
+	case <-out:
+		t.Fatal("block delivered before an earlier one")
+	case <-time.After(10 * time.Millisecond):
+	}
+	session.ReceiveBlockFrom("", ordered[0])
+	for i := 0; i < 2; i++ {
+		select {
+		case blk := <-out:
+			if !blk.Cid().Equals(ordered[i].Cid()) {
+				t.Fatal("blocks delivered out of order")
+			}
+		case <-ctx.Done():
+			t.Fatal("block not delivered")
+		}
+	}
+
+	// the window moved on to the last block
+	for !session.InterestedIn(ordered[2].Cid()) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("last block not requested")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	session.ReceiveBlockFrom("", ordered[2])
+	select {
+	case blk := <-out:
+		if !blk.Cid().Equals(ordered[2].Cid()) {
+			t.Fatal("blocks delivered out of order")
+		}
+	case <-ctx.Done():
+		t.Fatal("block not delivered")
+	}
+	if _, ok := <-out; ok {
+		t.Fatal("channel should be closed once all blocks were delivered")
+	}
+	if err, ok := <-errs; ok {
+		t.Fatal("expected no error once all blocks were delivered, got", err)
+	}
+}
+
+func TestSessionGetBlocksOrderedRepeatedBlock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wantReqs := make(chan wantReq, 20)
+	haveReqs := make(chan wantReq, 20)
+	cancelReqs := make(chan wantReq, 20)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	blockGenerator := blocksutil.NewBlockGenerator()
+	blks := blockGenerator.Blocks(2)
+	keys := []cid.Cid{blks[0].Cid(), blks[0].Cid(), blks[1].Cid()}
+
+	out, _ := session.GetBlocksOrdered(ctx, keys, 3)
+	for !session.InterestedIn(blks[1].Cid()) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("window not requested")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	session.ReceiveBlockFrom("", blks[1])
+	session.ReceiveBlockFrom("", blks[0])
+	for _, k := range keys {
+		select {
+		case blk := <-out:
+			if !blk.Cid().Equals(k) {
+				t.Fatal("blocks delivered out of order")
+			}
+		case <-ctx.Done():
+			t.Fatal("block not delivered")
+		}
+	}
+}
+
+func TestSessionGetBlocksOrderedRepeatedBlockOutsideWindow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wantReqs := make(chan wantReq, 20)
+	haveReqs := make(chan wantReq, 20)
+	cancelReqs := make(chan wantReq, 20)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	blockGenerator := blocksutil.NewBlockGenerator()
+	blks := blockGenerator.Blocks(2)
+	keys := []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[0].Cid()}
+
+	out, errs := session.GetBlocksOrdered(ctx, keys, 1)
+	for i, blk := range blks {
+		for !session.InterestedIn(blk.Cid()) {
+			select {
+			case <-ctx.Done():
+				t.Fatal("block not requested")
+			case <-time.After(time.Millisecond):
+			}
+		}
+		session.ReceiveBlockFrom("", blk)
+		if received := <-out; !received.Cid().Equals(keys[i]) {
+			t.Fatal("blocks delivered out of order")
+		}
+	}
+
+	// the repeat is delivered without getting the block again
+	select {
+	case blk := <-out:
+		if !blk.Cid().Equals(blks[0].Cid()) {
+			t.Fatal("blocks delivered out of order")
+		}
+	case <-ctx.Done():
+		t.Fatal("repeated block not delivered")
+	}
+	if err, ok := <-errs; ok {
+		t.Fatal("expected no error, got", err)
+	}
+}
+
+func TestSessionGetBlocksOrderedReportsError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wantReqs := make(chan wantReq, 20)
+	haveReqs := make(chan wantReq, 20)
+	cancelReqs := make(chan wantReq, 20)
+	fwm := &fakeWantManager{wantReqs, haveReqs, cancelReqs}
+	fpm := &fakePeerManager{}
+	frs := &fakeRequestSplitter{}
+	id := testutil.GenerateSessionID()
+	session := New(ctx, id, fwm, fpm, frs)
+	blockGenerator := blocksutil.NewBlockGenerator()
+	blks := blockGenerator.Blocks(2)
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer reqCancel()
+	out, errs := session.GetBlocksOrdered(reqCtx, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, 2)
+	if _, ok := <-out; ok {
+		t.Fatal("expected no block")
+	}
+	if err := <-errs; err != context.DeadlineExceeded {
+		t.Fatal("expected the request to report its timeout, got", err)
+	}
+}
@@ -0,0 +1,108 @@
+package session
+
+import (
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Stat is a snapshot of the progress of a session.
+type Stat struct {
+	BlocksReceived  int
+	DataReceived    uint64
+	DupBlksReceived int
+	DupDataReceived uint64
+	// LiveWants is the number of blocks asked of peers and not received yet
+	LiveWants int
+	// PendingWants is the number of blocks waiting to become live wants
+	PendingWants int
+	// Peers is what each peer sent the session, duplicates excluded
+	Peers map[peer.ID]PeerStat
+	// SplitFactor is the current split factor of the session's request
+	// splitter, zero if it doesn't report one
+	SplitFactor int
+	// Elapsed is the time since the session started
+	Elapsed time.Duration
+}
+
+// PeerStat is what a peer contributed to a session.
+type PeerStat struct {
+	BlocksReceived int
+	DataReceived   uint64
+}
+
+// ProgressFunc is called with the progress of a session every time it
+// receives a block it wants.
+type ProgressFunc func(Stat)
+
+// splitFactorer is implemented by request splitters that can report their
+// split factor.
+type splitFactorer interface {
+	SplitFactor() int
+}
+
+// Stat returns the progress of the session so far. It keeps returning the
+// final progress once the session has shut down.
+func (s *Session) Stat() Stat {
+	resp := make(chan Stat, 1)
+	select {
+	case s.statReqs <- resp:
+		return <-resp
+	case <-s.stopped:
+		// the run loop has exited and doesn't touch the counters anymore
+		return s.stat()
+	}
+}
+
+// SetProgressFunc sets the function called with the progress of the session
+// every time it receives a block it wants, nil for none. The function is
+// called from the session's run loop: it must not block or call the session.
+func (s *Session) SetProgressFunc(f ProgressFunc) {
+	select {
+	case s.progressFuncReqs <- f:
+	case <-s.ctx.Done():
+	}
+}
+
+// recordReceived counts a block the session wanted and got from a peer.
+func (s *Session) recordReceived(from peer.ID, blk blocks.Block) {
+	size := uint64(len(blk.RawData()))
+	s.blocksReceived++
+	s.dataReceived += size
+	if from != "" {
+		ps := s.peerStats[from]
+		ps.BlocksReceived++
+		ps.DataReceived += size
+		s.peerStats[from] = ps
+	}
+	if s.progress != nil {
+		s.progress(s.stat())
+	}
+}
+
+// recordDuplicate counts a block the session got again.
+func (s *Session) recordDuplicate(blk blocks.Block) {
+	s.dupBlksReceived++
+	s.dupDataReceived += uint64(len(blk.RawData()))
+}
+
+func (s *Session) stat() Stat {
+	st := Stat{
+		BlocksReceived:  s.blocksReceived,
+		DataReceived:    s.dataReceived,
+		DupBlksReceived: s.dupBlksReceived,
+		DupDataReceived: s.dupDataReceived,
+		LiveWants:       len(s.liveWants),
+		PendingWants:    s.tofetch.Len(),
+		Peers:           make(map[peer.ID]PeerStat, len(s.peerStats)),
+		Elapsed:         time.Since(s.started),
+	}
+	for p, ps := range s.peerStats {
+		st.Peers[p] = ps
+	}
+	if sf, ok := s.srs.(splitFactorer); ok {
+		st.SplitFactor = sf.SplitFactor()
+	}
+	return st
+}
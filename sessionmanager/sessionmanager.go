@@ -17,9 +17,16 @@ type Session interface {
 	exchange.Fetcher
 	InterestedIn(cid.Cid) bool
 	ReceiveBlockFrom(peer.ID, blocks.Block)
+	ReceivePresencesFrom(from peer.ID, haves []cid.Cid, dontHaves []cid.Cid, notPermitted []cid.Cid)
 	UpdateReceiveCounters(blocks.Block)
 }
 
+// stopper is implemented by session components that can be waited on once
+// their context is cancelled.
+type stopper interface {
+	Stopped() <-chan struct{}
+}
+
 type sesTrk struct {
 	session Session
 	pm      bssession.PeerManager
@@ -39,6 +46,7 @@ type PeerManagerFactory func(ctx context.Context, id uint64) bssession.PeerManag
 // sessions.
 type SessionManager struct {
 	ctx                    context.Context
+	cancel                 func()
 	sessionFactory         SessionFactory
 	peerManagerFactory     PeerManagerFactory
 	requestSplitterFactory RequestSplitterFactory
@@ -46,6 +54,8 @@ type SessionManager struct {
 	// Sessions
 	sessLk   sync.Mutex
 	sessions []sesTrk
+	closed   bool
+	running  sync.WaitGroup
 
 	// Session Index
 	sessIDLk sync.Mutex
@@ -54,8 +64,10 @@ type SessionManager struct {
 
 // New creates a new SessionManager.
 func New(ctx context.Context, sessionFactory SessionFactory, peerManagerFactory PeerManagerFactory, requestSplitterFactory RequestSplitterFactory) *SessionManager {
+	ctx, cancel := context.WithCancel(ctx)
 	return &SessionManager{
 		ctx:                    ctx,
+		cancel:                 cancel,
 		sessionFactory:         sessionFactory,
 		peerManagerFactory:     peerManagerFactory,
 		requestSplitterFactory: requestSplitterFactory,
@@ -63,31 +75,67 @@ func New(ctx context.Context, sessionFactory SessionFactory, peerManagerFactory
 }
 
 // NewSession initializes a session with the given context, and adds to the
-// session manager.
+// session manager. Once the session manager is shut down, the sessions it
+// returns are already cancelled.
 func (sm *SessionManager) NewSession(ctx context.Context) exchange.Fetcher {
+	return sm.NewSessionWithPeers(ctx, nil)
+}
+
+// NewSessionWithPeers is like NewSession, but the session starts with the
+// given peers, so it asks them for blocks without waiting to discover them.
+func (sm *SessionManager) NewSessionWithPeers(ctx context.Context, peers []peer.ID) exchange.Fetcher {
 	id := sm.GetNextSessionID()
 	sessionctx, cancel := context.WithCancel(ctx)
 
+	sm.sessLk.Lock()
+	defer sm.sessLk.Unlock()
+
 	pm := sm.peerManagerFactory(sessionctx, id)
+	if len(peers) > 0 {
+		pm.AddPeers(peers)
+	}
 	srs := sm.requestSplitterFactory(sessionctx)
 	session := sm.sessionFactory(sessionctx, id, pm, srs)
+	if sm.closed {
+		cancel()
+		return session
+	}
+
 	tracked := sesTrk{session, pm, srs}
-	sm.sessLk.Lock()
 	sm.sessions = append(sm.sessions, tracked)
-	sm.sessLk.Unlock()
+	sm.running.Add(1)
 	go func() {
-		defer cancel()
+		defer sm.running.Done()
 		select {
 		case <-sm.ctx.Done():
-			sm.removeSession(tracked)
 		case <-ctx.Done():
-			sm.removeSession(tracked)
 		}
+		sm.removeSession(tracked)
+		cancel()
+		waitStopped(session, pm, srs)
 	}()
 
 	return session
 }
 
+// Shutdown cancels all sessions and waits for them to shut down.
+func (sm *SessionManager) Shutdown() {
+	sm.sessLk.Lock()
+	sm.closed = true
+	sm.sessLk.Unlock()
+
+	sm.cancel()
+	sm.running.Wait()
+}
+
+func waitStopped(components ...interface{}) {
+	for _, c := range components {
+		if s, ok := c.(stopper); ok {
+			<-s.Stopped()
+		}
+	}
+}
+
 func (sm *SessionManager) removeSession(session sesTrk) {
 	sm.sessLk.Lock()
 	defer sm.sessLk.Unlock()
@@ -122,6 +170,33 @@ func (sm *SessionManager) ReceiveBlockFrom(from peer.ID, blk blocks.Block) {
 	}
 }
 
+// ReceivePresencesFrom receives HAVE, DONT_HAVE and NOT_PERMITTED presences
+// from a peer and dispatches those for blocks a session is interested in to
+// that session.
+func (sm *SessionManager) ReceivePresencesFrom(from peer.ID, haves []cid.Cid, dontHaves []cid.Cid, notPermitted []cid.Cid) {
+	sm.sessLk.Lock()
+	defer sm.sessLk.Unlock()
+
+	for _, s := range sm.sessions {
+		sesHaves := interestedKeys(s.session, haves)
+		sesDontHaves := interestedKeys(s.session, dontHaves)
+		sesNotPermitted := interestedKeys(s.session, notPermitted)
+		if len(sesHaves) > 0 || len(sesDontHaves) > 0 || len(sesNotPermitted) > 0 {
+			s.session.ReceivePresencesFrom(from, sesHaves, sesDontHaves, sesNotPermitted)
+		}
+	}
+}
+
+func interestedKeys(s Session, ks []cid.Cid) []cid.Cid {
+	var interested []cid.Cid
+	for _, k := range ks {
+		if s.InterestedIn(k) {
+			interested = append(interested, k)
+		}
+	}
+	return interested
+}
+
 // UpdateReceiveCounters records the fact that a block was received, allowing
 // sessions to track duplicates
 func (sm *SessionManager) UpdateReceiveCounters(blk blocks.Block) {
@@ -17,6 +17,7 @@ import (
 type fakeSession struct {
 	interested            bool
 	receivedBlock         bool
+	receivedPresences     bool
 	updateReceiveCounters bool
 	id                    uint64
 	pm                    *fakePeerManager
@@ -31,16 +32,25 @@ func (*fakeSession) GetBlocks(context.Context, []cid.Cid) (<-chan blocks.Block,
 }
 func (fs *fakeSession) InterestedIn(cid.Cid) bool              { return fs.interested }
 func (fs *fakeSession) ReceiveBlockFrom(peer.ID, blocks.Block) { fs.receivedBlock = true }
-func (fs *fakeSession) UpdateReceiveCounters(blocks.Block)     { fs.updateReceiveCounters = true }
+func (fs *fakeSession) ReceivePresencesFrom(peer.ID, []cid.Cid, []cid.Cid, []cid.Cid) {
+	fs.receivedPresences = true
+}
+func (fs *fakeSession) UpdateReceiveCounters(blocks.Block) { fs.updateReceiveCounters = true }
 
 type fakePeerManager struct {
-	id uint64
+	id    uint64
+	peers []peer.ID
 }
 
-func (*fakePeerManager) FindMorePeers(context.Context, cid.Cid)  {}
-func (*fakePeerManager) GetOptimizedPeers() []peer.ID            { return nil }
-func (*fakePeerManager) RecordPeerRequests([]peer.ID, []cid.Cid) {}
-func (*fakePeerManager) RecordPeerResponse(peer.ID, cid.Cid)     {}
+func (*fakePeerManager) FindMorePeers(context.Context, cid.Cid)   {}
+func (*fakePeerManager) GetOptimizedPeers() []peer.ID             { return nil }
+func (*fakePeerManager) GetPeersWithBlock(cid.Cid) []peer.ID      { return nil }
+func (*fakePeerManager) RecordPeerRequests([]peer.ID, []cid.Cid)  {}
+func (*fakePeerManager) RecordPeerResponse(peer.ID, cid.Cid, int) {}
+func (*fakePeerManager) RecordPeerHaves(peer.ID, []cid.Cid)       {}
+func (*fakePeerManager) RecordPeerDontHaves(peer.ID, []cid.Cid)   {}
+func (*fakePeerManager) RecordCancels([]cid.Cid)                  {}
+func (fpm *fakePeerManager) AddPeers(ps []peer.ID)                { fpm.peers = append(fpm.peers, ps...) }
 
 type fakeRequestSplitter struct {
 }
@@ -64,7 +74,7 @@ func sessionFactory(ctx context.Context, id uint64, pm bssession.PeerManager, sr
 }
 
 func peerManagerFactory(ctx context.Context, id uint64) bssession.PeerManager {
-	return &fakePeerManager{id}
+	return &fakePeerManager{id: id}
 }
 
 func requestSplitterFactory(ctx context.Context) bssession.RequestSplitter {
@@ -77,7 +87,7 @@ func TestAddingSessions(t *testing.T) {
 	defer cancel()
 	sm := New(ctx, sessionFactory, peerManagerFactory, requestSplitterFactory)
 
-	p := peer.ID(123)
+	p := peer.ID("123")
 	block := blocks.NewBlock([]byte("block"))
 	// we'll be interested in all blocks for this test
 	nextInterestedIn = true
@@ -113,7 +123,7 @@ func TestReceivingBlocksWhenNotInterested(t *testing.T) {
 	defer cancel()
 	sm := New(ctx, sessionFactory, peerManagerFactory, requestSplitterFactory)
 
-	p := peer.ID(123)
+	p := peer.ID("123")
 	block := blocks.NewBlock([]byte("block"))
 	// we'll be interested in all blocks for this test
 	nextInterestedIn = false
@@ -131,12 +141,32 @@ func TestReceivingBlocksWhenNotInterested(t *testing.T) {
 	}
 }
 
+func TestReceivingPresencesWhenNotInterested(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sm := New(ctx, sessionFactory, peerManagerFactory, requestSplitterFactory)
+
+	p := peer.ID("123")
+	block := blocks.NewBlock([]byte("block"))
+	nextInterestedIn = false
+	firstSession := sm.NewSession(ctx).(*fakeSession)
+	nextInterestedIn = true
+	secondSession := sm.NewSession(ctx).(*fakeSession)
+
+	sm.ReceivePresencesFrom(p, []cid.Cid{block.Cid()}, nil, nil)
+	if firstSession.receivedPresences ||
+		!secondSession.receivedPresences {
+		t.Fatal("did not receive presences only for interested sessions")
+	}
+}
+
 func TestRemovingPeersWhenManagerContextCancelled(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	sm := New(ctx, sessionFactory, peerManagerFactory, requestSplitterFactory)
 
-	p := peer.ID(123)
+	p := peer.ID("123")
 	block := blocks.NewBlock([]byte("block"))
 	// we'll be interested in all blocks for this test
 	nextInterestedIn = true
@@ -161,7 +191,7 @@ func TestRemovingPeersWhenSessionContextCancelled(t *testing.T) {
 	defer cancel()
 	sm := New(ctx, sessionFactory, peerManagerFactory, requestSplitterFactory)
 
-	p := peer.ID(123)
+	p := peer.ID("123")
 	block := blocks.NewBlock([]byte("block"))
 	// we'll be interested in all blocks for this test
 	nextInterestedIn = true
@@ -180,3 +210,19 @@ func TestRemovingPeersWhenSessionContextCancelled(t *testing.T) {
 		t.Fatal("received blocks for sessions that are canceled")
 	}
 }
+
+func TestNewSessionWithPeers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sm := New(ctx, sessionFactory, peerManagerFactory, requestSplitterFactory)
+
+	peers := []peer.ID{peer.ID("123"), peer.ID("456")}
+	session := sm.NewSessionWithPeers(ctx, peers).(*fakeSession)
+	if len(session.pm.peers) != 2 || session.pm.peers[0] != peers[0] || session.pm.peers[1] != peers[1] {
+		t.Fatal("session should start with the given peers")
+	}
+	if session = sm.NewSession(ctx).(*fakeSession); len(session.pm.peers) != 0 {
+		t.Fatal("session should start without peers")
+	}
+}
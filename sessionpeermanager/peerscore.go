@@ -0,0 +1,167 @@
+package sessionpeermanager
+
+import (
+	"sort"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+const (
+	// scoreAlpha is the weight of a new sample in the moving averages
+	scoreAlpha = 0.3
+	// scoreBlockSize is the block size the score estimates the time to
+	// receive
+	scoreBlockSize = 256 * 1024
+)
+
+// PeerScore is how fast a peer answers the session.
+type PeerScore struct {
+	Peer peer.ID
+	// Latency is the moving average of the time the peer takes to answer a
+	// request, zero if it never answered one we sent.
+	Latency time.Duration
+	// Throughput is the moving average of the rate in bytes per second at
+	// which the peer sends us blocks, from when we asked for them to when
+	// they arrived, zero until it sent one we asked for.
+	Throughput float64
+	// Score is the estimated time to get a block from the peer, based on
+	// the throughput once it is known and on the latency until then, zero
+	// if neither is known. Lower is better.
+	Score time.Duration
+}
+
+// peerData holds the measurements of a peer.
+type peerData struct {
+	latency    time.Duration
+	hasLatency bool
+	throughput float64
+}
+
+func (pd *peerData) recordLatency(latency time.Duration) {
+	if !pd.hasLatency {
+		pd.latency = latency
+		pd.hasLatency = true
+		return
+	}
+	pd.latency = time.Duration(scoreAlpha*float64(latency) + (1-scoreAlpha)*float64(pd.latency))
+}
+
+// recordBlock records a block of the given size received elapsed after it
+// was asked for.
+func (pd *peerData) recordBlock(elapsed time.Duration, size int) {
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed.Seconds()
+	if pd.throughput == 0 {
+		pd.throughput = rate
+	} else {
+		pd.throughput = scoreAlpha*rate + (1-scoreAlpha)*pd.throughput
+	}
+}
+
+// score returns the estimated time to get a block from the peer, false if
+// neither its throughput nor its latency is known. The throughput is
+// measured from the requests, so it already accounts for the latency; peers
+// whose throughput isn't known yet are scored on latency alone.
+func (pd *peerData) score() (time.Duration, bool) {
+	if pd.throughput > 0 {
+		return time.Duration(scoreBlockSize / pd.throughput * float64(time.Second)), true
+	}
+	return pd.latency, pd.hasLatency
+}
+
+// requestTime returns when the block was last asked of the peer, or of all
+// peers if it wasn't asked of the peer in particular.
+func (spm *SessionPeerManager) requestTime(p peer.ID, k cid.Cid) (time.Time, bool) {
+	sent, ok := spm.requests[k]
+	if !ok {
+		return time.Time{}, false
+	}
+	if t, ok := sent[p]; ok {
+		return t, true
+	}
+	t, ok := sent[""]
+	return t, ok
+}
+
+// recordAnswer measures the latency of a peer answering requests for the
+// given blocks at once, from the most recent of the requests.
+func (spm *SessionPeerManager) recordAnswer(p peer.ID, ks []cid.Cid, now time.Time) {
+	var latest time.Time
+	for _, k := range ks {
+		if t, ok := spm.requestTime(p, k); ok && t.After(latest) {
+			latest = t
+		}
+	}
+	if !latest.IsZero() {
+		spm.peerData(p).recordLatency(now.Sub(latest))
+	}
+}
+
+// forgetRequest drops when the block was asked of the peer.
+func (spm *SessionPeerManager) forgetRequest(p peer.ID, k cid.Cid) {
+	sent, ok := spm.requests[k]
+	if !ok {
+		return
+	}
+	delete(sent, p)
+	if len(sent) == 0 {
+		delete(spm.requests, k)
+	}
+}
+
+func (spm *SessionPeerManager) peerData(p peer.ID) *peerData {
+	pd, ok := spm.peerStats[p]
+	if !ok {
+		pd = &peerData{}
+		spm.peerStats[p] = pd
+	}
+	return pd
+}
+
+// rankedOptimizedPeers returns a copy of the optimized peers, the peers with
+// a score first from best to worst, then the others most recently
+// responsive first.
+func (spm *SessionPeerManager) rankedOptimizedPeers() []peer.ID {
+	ranked := make([]peer.ID, len(spm.optimizedPeersArr))
+	copy(ranked, spm.optimizedPeersArr)
+	scores := make(map[peer.ID]time.Duration, len(ranked))
+	for _, p := range ranked {
+		if pd, ok := spm.peerStats[p]; ok {
+			if score, ok := pd.score(); ok {
+				scores[p] = score
+			}
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		si, iok := scores[ranked[i]]
+		sj, jok := scores[ranked[j]]
+		if iok != jok {
+			return iok
+		}
+		return iok && si < sj
+	})
+	return ranked
+}
+
+type peerScoresReqMessage struct {
+	resp chan<- []PeerScore
+}
+
+func (psrm *peerScoresReqMessage) handle(spm *SessionPeerManager) {
+	ranked := spm.rankedOptimizedPeers()
+	scores := make([]PeerScore, 0, len(ranked))
+	for _, p := range ranked {
+		ps := PeerScore{Peer: p}
+		if pd, ok := spm.peerStats[p]; ok {
+			ps.Latency = pd.latency
+			ps.Throughput = pd.throughput
+			ps.Score, _ = pd.score()
+		}
+		scores = append(scores, ps)
+	}
+	psrm.resp <- scores
+}
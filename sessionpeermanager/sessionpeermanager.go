@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log"
 
@@ -29,6 +31,11 @@ type PeerProviderFinder interface {
 	FindProvidersAsync(context.Context, cid.Cid) <-chan peer.ID
 }
 
+// PeerConnector is an interface for connecting to peers
+type PeerConnector interface {
+	ConnectTo(context.Context, peer.ID) error
+}
+
 type peerMessage interface {
 	handle(spm *SessionPeerManager)
 }
@@ -39,19 +46,44 @@ type SessionPeerManager struct {
 	ctx            context.Context
 	tagger         PeerTagger
 	providerFinder PeerProviderFinder
+	connector      PeerConnector
 	tag            string
 	id             uint64
 
 	peerMessages chan peerMessage
 
+	// provider searches and connections to added peers are started from the
+	// run loop, which waits for them before closing stopped
+	searches sync.WaitGroup
+	stopped  chan struct{}
+
 	// do not touch outside of run loop
 	activePeers         map[peer.ID]bool
 	unoptimizedPeersArr []peer.ID
 	optimizedPeersArr   []peer.ID
+	// peerHaves tracks which peers told us they have a block we haven't
+	// received yet
+	peerHaves map[cid.Cid]map[peer.ID]struct{}
+	// requests tracks when each block we're waiting for was last asked of
+	// each peer, under the empty peer ID when it was asked of all peers
+	requests map[cid.Cid]map[peer.ID]time.Time
+	// peerStats holds the measurements of the peers that answered us
+	peerStats map[peer.ID]*peerData
+}
+
+// Option configures a SessionPeerManager.
+type Option func(*SessionPeerManager)
+
+// Connector makes the SessionPeerManager connect to the peers added to the
+// session as soon as they are added.
+func Connector(c PeerConnector) Option {
+	return func(spm *SessionPeerManager) {
+		spm.connector = c
+	}
 }
 
 // New creates a new SessionPeerManager
-func New(ctx context.Context, id uint64, tagger PeerTagger, providerFinder PeerProviderFinder) *SessionPeerManager {
+func New(ctx context.Context, id uint64, tagger PeerTagger, providerFinder PeerProviderFinder, options ...Option) *SessionPeerManager {
 	spm := &SessionPeerManager{
 		id:             id,
 		ctx:            ctx,
@@ -59,6 +91,14 @@ func New(ctx context.Context, id uint64, tagger PeerTagger, providerFinder PeerP
 		providerFinder: providerFinder,
 		peerMessages:   make(chan peerMessage, 16),
 		activePeers:    make(map[peer.ID]bool),
+		peerHaves:      make(map[cid.Cid]map[peer.ID]struct{}),
+		requests:       make(map[cid.Cid]map[peer.ID]time.Time),
+		peerStats:      make(map[peer.ID]*peerData),
+		stopped:        make(chan struct{}),
+	}
+
+	for _, option := range options {
+		option(spm)
 	}
 
 	spm.tag = fmt.Sprint("bs-ses-", id)
@@ -67,28 +107,84 @@ func New(ctx context.Context, id uint64, tagger PeerTagger, providerFinder PeerP
 	return spm
 }
 
-// RecordPeerResponse records that a peer received a block, and adds to it
-// the list of peers if it wasn't already added
-func (spm *SessionPeerManager) RecordPeerResponse(p peer.ID, k cid.Cid) {
+// RecordPeerResponse records that we received a block of the given size from
+// a peer, measuring the peer's latency and throughput, and adds it to the
+// list of peers if it wasn't already added
+func (spm *SessionPeerManager) RecordPeerResponse(p peer.ID, k cid.Cid, size int) {
+	select {
+	case spm.peerMessages <- &peerResponseMessage{p, k, size, time.Now()}:
+	case <-spm.ctx.Done():
+	}
+}
 
-	// at the moment, we're just adding peers here
-	// in the future, we'll actually use this to record metrics
+// AddPeers adds peers known to have the blocks of the session to it and
+// connects to them. The peers are ranked in the given order as if they had
+// just responded, unless they already responded.
+func (spm *SessionPeerManager) AddPeers(ps []peer.ID) {
 	select {
-	case spm.peerMessages <- &peerResponseMessage{p}:
+	case spm.peerMessages <- &addPeersMessage{ps}:
 	case <-spm.ctx.Done():
 	}
 }
 
-// RecordPeerRequests records that a given set of peers requested the given cids
+// RecordPeerHaves records that a peer told us it has the given blocks. The
+// peer is added to the session, and ranked as if it had just responded.
+func (spm *SessionPeerManager) RecordPeerHaves(p peer.ID, ks []cid.Cid) {
+	select {
+	case spm.peerMessages <- &peerHavesMessage{p, ks, time.Now()}:
+	case <-spm.ctx.Done():
+	}
+}
+
+// RecordPeerDontHaves records that a peer told us it doesn't have the given
+// blocks.
+func (spm *SessionPeerManager) RecordPeerDontHaves(p peer.ID, ks []cid.Cid) {
+	select {
+	case spm.peerMessages <- &peerDontHavesMessage{p, ks}:
+	case <-spm.ctx.Done():
+	}
+}
+
+// RecordCancels records that the session no longer waits for the given
+// blocks.
+func (spm *SessionPeerManager) RecordCancels(ks []cid.Cid) {
+	select {
+	case spm.peerMessages <- &cancelsMessage{ks}:
+	case <-spm.ctx.Done():
+	}
+}
+
+// GetPeersWithBlock returns the peers that told us they have the given
+// block, best first.
+func (spm *SessionPeerManager) GetPeersWithBlock(k cid.Cid) []peer.ID {
+	resp := make(chan []peer.ID, 1)
+	select {
+	case spm.peerMessages <- &peersWithBlockReqMessage{k, resp}:
+	case <-spm.ctx.Done():
+		return nil
+	}
+
+	select {
+	case peers := <-resp:
+		return peers
+	case <-spm.ctx.Done():
+		return nil
+	}
+}
+
+// RecordPeerRequests records that the given cids were asked of the given
+// peers, or of all peers if none are given, to measure how long the peers
+// take to answer
 func (spm *SessionPeerManager) RecordPeerRequests(p []peer.ID, ks []cid.Cid) {
-	// at the moment, we're not doing anything here
-	// soon we'll use this to track latency by peer
+	select {
+	case spm.peerMessages <- &peerRequestsMessage{p, ks, time.Now()}:
+	case <-spm.ctx.Done():
+	}
 }
 
-// GetOptimizedPeers returns the best peers available for a session
+// GetOptimizedPeers returns the best peers available for a session: the
+// peers that answered us, best scored first, then others picked at random
 func (spm *SessionPeerManager) GetOptimizedPeers() []peer.ID {
-	// right now this just returns all peers, but soon we might return peers
-	// ordered by optimization, or only a subset
 	resp := make(chan []peer.ID, 1)
 	select {
 	case spm.peerMessages <- &peerReqMessage{resp}:
@@ -104,28 +200,67 @@ func (spm *SessionPeerManager) GetOptimizedPeers() []peer.ID {
 	}
 }
 
+// PeerScores returns the measurements and scores of the peers that answered
+// the session, in the order GetOptimizedPeers returns them.
+func (spm *SessionPeerManager) PeerScores() []PeerScore {
+	resp := make(chan []PeerScore, 1)
+	select {
+	case spm.peerMessages <- &peerScoresReqMessage{resp}:
+	case <-spm.ctx.Done():
+		return nil
+	}
+
+	select {
+	case scores := <-resp:
+		return scores
+	case <-spm.ctx.Done():
+		return nil
+	}
+}
+
 // FindMorePeers attempts to find more peers for a session by searching for
 // providers for the given Cid
 func (spm *SessionPeerManager) FindMorePeers(ctx context.Context, c cid.Cid) {
-	go func(k cid.Cid) {
-		for p := range spm.providerFinder.FindProvidersAsync(ctx, k) {
-
-			select {
-			case spm.peerMessages <- &peerFoundMessage{p}:
-			case <-ctx.Done():
-			case <-spm.ctx.Done():
-			}
+	select {
+	case spm.peerMessages <- &findMorePeersMessage{ctx, c}:
+	case <-spm.ctx.Done():
+	}
+}
+
+// Stopped returns a channel that is closed once the SessionPeerManager has
+// shut down, after its context was cancelled.
+func (spm *SessionPeerManager) Stopped() <-chan struct{} {
+	return spm.stopped
+}
+
+func (spm *SessionPeerManager) findMorePeers(ctx context.Context, k cid.Cid) {
+	defer spm.searches.Done()
+	for p := range spm.providerFinder.FindProvidersAsync(ctx, k) {
+
+		select {
+		case spm.peerMessages <- &peerFoundMessage{p}:
+		case <-ctx.Done():
+		case <-spm.ctx.Done():
 		}
-	}(c)
+	}
+}
+
+func (spm *SessionPeerManager) connect(p peer.ID) {
+	defer spm.searches.Done()
+	if err := spm.connector.ConnectTo(spm.ctx, p); err != nil {
+		log.Debugf("failed to connect to session peer %s: %s", p, err)
+	}
 }
 
 func (spm *SessionPeerManager) run(ctx context.Context) {
+	defer close(spm.stopped)
 	for {
 		select {
 		case pm := <-spm.peerMessages:
 			pm.handle(spm)
 		case <-ctx.Done():
 			spm.handleShutdown()
+			spm.searches.Wait()
 			return
 		}
 	}
@@ -164,6 +299,16 @@ func (spm *SessionPeerManager) removeUnoptimizedPeer(p peer.ID) {
 	}
 }
 
+type findMorePeersMessage struct {
+	ctx context.Context
+	k   cid.Cid
+}
+
+func (fmpm *findMorePeersMessage) handle(spm *SessionPeerManager) {
+	spm.searches.Add(1)
+	go spm.findMorePeers(fmpm.ctx, fmpm.k)
+}
+
 type peerFoundMessage struct {
 	p peer.ID
 }
@@ -177,13 +322,68 @@ func (pfm *peerFoundMessage) handle(spm *SessionPeerManager) {
 	}
 }
 
+type addPeersMessage struct {
+	peers []peer.ID
+}
+
+func (apm *addPeersMessage) handle(spm *SessionPeerManager) {
+	// optimized peers are inserted first, so the first peer ends up first
+	for i := len(apm.peers) - 1; i >= 0; i-- {
+		p := apm.peers[i]
+		if isOptimized, ok := spm.activePeers[p]; ok && isOptimized {
+			continue
+		}
+		spm.recordResponsivePeer(p)
+		if spm.connector != nil {
+			spm.searches.Add(1)
+			go spm.connect(p)
+		}
+	}
+}
+
+type peerRequestsMessage struct {
+	peers []peer.ID
+	ks    []cid.Cid
+	now   time.Time
+}
+
+func (prm *peerRequestsMessage) handle(spm *SessionPeerManager) {
+	peers := prm.peers
+	if len(peers) == 0 {
+		peers = []peer.ID{""}
+	}
+	for _, k := range prm.ks {
+		sent, ok := spm.requests[k]
+		if !ok {
+			sent = make(map[peer.ID]time.Time)
+			spm.requests[k] = sent
+		}
+		for _, p := range peers {
+			sent[p] = prm.now
+		}
+	}
+}
+
 type peerResponseMessage struct {
-	p peer.ID
+	p    peer.ID
+	k    cid.Cid
+	size int
+	now  time.Time
 }
 
 func (prm *peerResponseMessage) handle(spm *SessionPeerManager) {
+	spm.recordAnswer(prm.p, []cid.Cid{prm.k}, prm.now)
+	if sent, ok := spm.requestTime(prm.p, prm.k); ok {
+		spm.peerData(prm.p).recordBlock(prm.now.Sub(sent), prm.size)
+	}
+	// once we have the block, which peers have it and when we asked for it
+	// no longer matter
+	delete(spm.peerHaves, prm.k)
+	delete(spm.requests, prm.k)
+	spm.recordResponsivePeer(prm.p)
+}
 
-	p := prm.p
+func (spm *SessionPeerManager) recordResponsivePeer(p peer.ID) {
 	isOptimized, ok := spm.activePeers[p]
 	if !ok {
 		spm.activePeers[p] = true
@@ -199,6 +399,85 @@ func (prm *peerResponseMessage) handle(spm *SessionPeerManager) {
 	spm.insertOptimizedPeer(p)
 }
 
+type peerHavesMessage struct {
+	p   peer.ID
+	ks  []cid.Cid
+	now time.Time
+}
+
+func (phm *peerHavesMessage) handle(spm *SessionPeerManager) {
+	spm.recordAnswer(phm.p, phm.ks, phm.now)
+	for _, k := range phm.ks {
+		// the block is timed from when it's asked of the peer
+		spm.forgetRequest(phm.p, k)
+		peers, ok := spm.peerHaves[k]
+		if !ok {
+			peers = make(map[peer.ID]struct{})
+			spm.peerHaves[k] = peers
+		}
+		peers[phm.p] = struct{}{}
+	}
+	spm.recordResponsivePeer(phm.p)
+}
+
+type peerDontHavesMessage struct {
+	p  peer.ID
+	ks []cid.Cid
+}
+
+func (pdhm *peerDontHavesMessage) handle(spm *SessionPeerManager) {
+	for _, k := range pdhm.ks {
+		spm.forgetRequest(pdhm.p, k)
+		peers, ok := spm.peerHaves[k]
+		if !ok {
+			continue
+		}
+		delete(peers, pdhm.p)
+		if len(peers) == 0 {
+			delete(spm.peerHaves, k)
+		}
+	}
+}
+
+type cancelsMessage struct {
+	ks []cid.Cid
+}
+
+func (cm *cancelsMessage) handle(spm *SessionPeerManager) {
+	for _, k := range cm.ks {
+		delete(spm.requests, k)
+	}
+}
+
+type peersWithBlockReqMessage struct {
+	k    cid.Cid
+	resp chan<- []peer.ID
+}
+
+func (pwbrm *peersWithBlockReqMessage) handle(spm *SessionPeerManager) {
+	peers := spm.peerHaves[pwbrm.k]
+	if len(peers) == 0 {
+		pwbrm.resp <- nil
+		return
+	}
+
+	// optimized peers first, in the order they're ranked
+	out := make([]peer.ID, 0, len(peers))
+	ranked := make(map[peer.ID]struct{}, len(peers))
+	for _, p := range spm.rankedOptimizedPeers() {
+		if _, ok := peers[p]; ok {
+			out = append(out, p)
+			ranked[p] = struct{}{}
+		}
+	}
+	for p := range peers {
+		if _, ok := ranked[p]; !ok {
+			out = append(out, p)
+		}
+	}
+	pwbrm.resp <- out
+}
+
 type peerReqMessage struct {
 	resp chan<- []peer.ID
 }
@@ -214,7 +493,7 @@ func (prm *peerReqMessage) handle(spm *SessionPeerManager) {
 	for i := range extraPeers {
 		extraPeers[i] = spm.unoptimizedPeersArr[randomOrder[i]]
 	}
-	prm.resp <- append(spm.optimizedPeersArr, extraPeers...)
+	prm.resp <- append(spm.rankedOptimizedPeers(), extraPeers...)
 }
 
 func (spm *SessionPeerManager) handleShutdown() {
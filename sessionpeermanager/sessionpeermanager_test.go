@@ -123,7 +123,7 @@ func TestRecordingReceivedBlocks(t *testing.T) {
 	id := testutil.GenerateSessionID()
 
 	sessionPeerManager := New(ctx, id, fpt, fppf)
-	sessionPeerManager.RecordPeerResponse(p, c)
+	sessionPeerManager.RecordPeerResponse(p, c, 1024)
 	time.Sleep(10 * time.Millisecond)
 	sessionPeers := sessionPeerManager.GetOptimizedPeers()
 	if len(sessionPeers) != 1 {
@@ -166,24 +166,25 @@ func TestOrderingPeers(t *testing.T) {
 	peer2 := peers[rand.Intn(100)]
 	peer3 := peers[rand.Intn(100)]
 	time.Sleep(1 * time.Millisecond)
-	sessionPeerManager.RecordPeerResponse(peer1, c[0])
+	sessionPeerManager.RecordPeerResponse(peer1, c[0], 1024)
 	time.Sleep(1 * time.Millisecond)
-	sessionPeerManager.RecordPeerResponse(peer2, c[0])
+	sessionPeerManager.RecordPeerResponse(peer2, c[0], 1024)
 	time.Sleep(1 * time.Millisecond)
-	sessionPeerManager.RecordPeerResponse(peer3, c[0])
+	sessionPeerManager.RecordPeerResponse(peer3, c[0], 1024)
 
 	sessionPeers := sessionPeerManager.GetOptimizedPeers()
 	if len(sessionPeers) != maxOptimizedPeers {
 		t.Fatal("Should not return more than the max of optimized peers")
 	}
 
-	// should prioritize peers which have received blocks
-	if (sessionPeers[0] != peer3) || (sessionPeers[1] != peer2) || (sessionPeers[2] != peer1) {
+	// should prioritize peers which have received blocks, the one that
+	// answered the broadcast first as the others' latency isn't known
+	if (sessionPeers[0] != peer1) || (sessionPeers[1] != peer3) || (sessionPeers[2] != peer2) {
 		t.Fatal("Did not prioritize peers that received blocks")
 	}
 
 	// Receive a second time from same node
-	sessionPeerManager.RecordPeerResponse(peer3, c[0])
+	sessionPeerManager.RecordPeerResponse(peer3, c[0], 1024)
 
 	// call again
 	nextSessionPeers := sessionPeerManager.GetOptimizedPeers()
@@ -192,7 +193,7 @@ func TestOrderingPeers(t *testing.T) {
 	}
 
 	// should not duplicate
-	if (nextSessionPeers[0] != peer3) || (nextSessionPeers[1] != peer2) || (nextSessionPeers[2] != peer1) {
+	if (nextSessionPeers[0] != peer1) || (nextSessionPeers[1] != peer3) || (nextSessionPeers[2] != peer2) {
 		t.Fatal("Did dedup peers which received multiple blocks")
 	}
 
@@ -239,3 +240,174 @@ func TestUntaggingPeers(t *testing.T) {
 		t.Fatal("Peers were not untagged!")
 	}
 }
+
+func TestRecordingPeerHaves(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+	fpt := &fakePeerTagger{}
+	fppf := &fakePeerProviderFinder{}
+	c := testutil.GenerateCids(1)[0]
+	id := testutil.GenerateSessionID()
+
+	sessionPeerManager := New(ctx, id, fpt, fppf)
+	sessionPeerManager.RecordPeerHaves(peers[0], []cid.Cid{c})
+	sessionPeerManager.RecordPeerHaves(peers[1], []cid.Cid{c})
+	withBlock := sessionPeerManager.GetPeersWithBlock(c)
+	if len(withBlock) != 2 {
+		t.Fatal("did not record peers that have block")
+	}
+	if len(sessionPeerManager.GetOptimizedPeers()) != 2 {
+		t.Fatal("peers that have block should be added to session")
+	}
+
+	sessionPeerManager.RecordPeerDontHaves(peers[0], []cid.Cid{c})
+	withBlock = sessionPeerManager.GetPeersWithBlock(c)
+	if len(withBlock) != 1 || withBlock[0] != peers[1] {
+		t.Fatal("peer that does not have block should be removed")
+	}
+
+	sessionPeerManager.RecordPeerResponse(peers[1], c, 1024)
+	if len(sessionPeerManager.GetPeersWithBlock(c)) != 0 {
+		t.Fatal("should forget peers with block once it was received")
+	}
+}
+
+func TestOrderingPeersByScore(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers := testutil.GeneratePeers(3)
+	fpt := &fakePeerTagger{}
+	fppf := &fakePeerProviderFinder{}
+	c := testutil.GenerateCids(4)
+	id := testutil.GenerateSessionID()
+	sessionPeerManager := New(ctx, id, fpt, fppf)
+
+	// the first peer is slow to answer, the second fast, the third never
+	// answers a request we sent
+	sessionPeerManager.RecordPeerRequests([]peer.ID{peers[0]}, c[:1])
+	time.Sleep(20 * time.Millisecond)
+	sessionPeerManager.RecordPeerRequests([]peer.ID{peers[1]}, c[1:2])
+	sessionPeerManager.RecordPeerResponse(peers[1], c[1], 1024)
+	sessionPeerManager.RecordPeerResponse(peers[0], c[0], 1024)
+	sessionPeerManager.RecordPeerResponse(peers[2], c[2], 1024)
+
+	sessionPeers := sessionPeerManager.GetOptimizedPeers()
+	if len(sessionPeers) != 3 || sessionPeers[0] != peers[1] || sessionPeers[1] != peers[0] || sessionPeers[2] != peers[2] {
+		t.Fatal("peers should be ordered by latency, unmeasured peers last")
+	}
+
+	scores := sessionPeerManager.PeerScores()
+	if len(scores) != 3 || scores[0].Peer != peers[1] {
+		t.Fatal("scores should be listed in the order of the peers")
+	}
+	if scores[1].Latency < 20*time.Millisecond || scores[1].Score < scores[1].Latency {
+		t.Fatal("expected latency of the slow peer to be measured")
+	}
+	if scores[2].Latency != 0 || scores[2].Score != 0 {
+		t.Fatal("expected no score for the peer without measured latency")
+	}
+
+	// throughput is measured from the request, so blocks arriving together
+	// don't make the peer look faster than it was
+	if tp := scores[1].Throughput; tp == 0 || tp > 1024/0.02 {
+		t.Fatal("expected throughput of the slow peer to be measured from the request, got", tp)
+	}
+	// which already includes the latency
+	if expected := time.Duration(scoreBlockSize / scores[1].Throughput * float64(time.Second)); scores[1].Score != expected {
+		t.Fatalf("expected the score to be the time to get a block at the throughput, got %s instead of %s", scores[1].Score, expected)
+	}
+	sessionPeerManager.RecordPeerResponse(peers[0], c[3], 1024)
+	if scores = sessionPeerManager.PeerScores(); scores[1].Throughput > 1024/0.02 {
+		t.Fatal("expected a block we didn't ask for not to count, got", scores[1].Throughput)
+	}
+	if scores[2].Throughput != 0 {
+		t.Fatal("expected no throughput for the peer that sent nothing we asked for")
+	}
+}
+
+func TestRequestsForgotten(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peers := testutil.GeneratePeers(2)
+	c := testutil.GenerateCids(3)
+	spm := New(ctx, testutil.GenerateSessionID(), &fakePeerTagger{}, &fakePeerProviderFinder{})
+
+	spm.RecordPeerRequests(peers, c)
+	spm.RecordPeerDontHaves(peers[0], c[:1])
+	spm.RecordPeerDontHaves(peers[1], c[:1])
+	spm.RecordPeerHaves(peers[0], c[1:2])
+	spm.RecordCancels(c[2:])
+
+	remaining := make(chan map[cid.Cid]map[peer.ID]time.Time)
+	spm.peerMessages <- &requestsReqMessage{remaining}
+	requests := <-remaining
+	if len(requests) != 1 || len(requests[c[1]]) != 1 {
+		t.Fatal("expected only the request for the block the other peer may send to remain, got", requests)
+	}
+}
+
+// requestsReqMessage copies the requests spm tracks, for tests.
+type requestsReqMessage struct {
+	resp chan<- map[cid.Cid]map[peer.ID]time.Time
+}
+
+func (rrm *requestsReqMessage) handle(spm *SessionPeerManager) {
+	requests := make(map[cid.Cid]map[peer.ID]time.Time, len(spm.requests))
+	for k, sent := range spm.requests {
+		requests[k] = make(map[peer.ID]time.Time, len(sent))
+		for p, t := range sent {
+			requests[k][p] = t
+		}
+	}
+	rrm.resp <- requests
+}
+
+type fakePeerConnector struct {
+	connected chan peer.ID
+}
+
+func (fpc *fakePeerConnector) ConnectTo(ctx context.Context, p peer.ID) error {
+	select {
+	case fpc.connected <- p:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func TestAddingPeers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peers := testutil.GeneratePeers(3)
+	fpt := &fakePeerTagger{}
+	fppf := &fakePeerProviderFinder{}
+	fpc := &fakePeerConnector{make(chan peer.ID, 3)}
+	id := testutil.GenerateSessionID()
+	sessionPeerManager := New(ctx, id, fpt, fppf, Connector(fpc))
+
+	sessionPeerManager.RecordPeerResponse(peers[2], testutil.GenerateCids(1)[0], 1024)
+	sessionPeerManager.AddPeers(peers[:2])
+	sessionPeers := sessionPeerManager.GetOptimizedPeers()
+	if len(sessionPeers) != 3 || sessionPeers[0] != peers[0] || sessionPeers[1] != peers[1] {
+		t.Fatal("added peers should be ranked first in the given order")
+	}
+	if fpt.count() != 3 {
+		t.Fatal("added peers should be tagged")
+	}
+
+	connected := make(map[peer.ID]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-fpc.connected:
+			connected[p] = true
+		case <-time.After(time.Second):
+			t.Fatal("did not connect to added peers")
+		}
+	}
+	if !connected[peers[0]] || !connected[peers[1]] {
+		t.Fatal("connected to the wrong peers")
+	}
+}
@@ -30,6 +30,7 @@ type srsMessage interface {
 type SessionRequestSplitter struct {
 	ctx      context.Context
 	messages chan srsMessage
+	stopped  chan struct{}
 
 	// data, do not touch outside run loop
 	receivedCount          int
@@ -42,6 +43,7 @@ func New(ctx context.Context) *SessionRequestSplitter {
 	srs := &SessionRequestSplitter{
 		ctx:      ctx,
 		messages: make(chan srsMessage, 10),
+		stopped:  make(chan struct{}),
 		split:    initialSplit,
 	}
 	go srs.run()
@@ -85,7 +87,31 @@ func (srs *SessionRequestSplitter) RecordUniqueBlock() {
 	}
 }
 
+// SplitFactor returns the number of groups requests are currently split
+// into, zero once the SessionRequestSplitter has shut down.
+func (srs *SessionRequestSplitter) SplitFactor() int {
+	resp := make(chan int, 1)
+	select {
+	case srs.messages <- &splitFactorMessage{resp}:
+	case <-srs.ctx.Done():
+		return 0
+	}
+	select {
+	case split := <-resp:
+		return split
+	case <-srs.ctx.Done():
+		return 0
+	}
+}
+
+// Stopped returns a channel that is closed once the SessionRequestSplitter
+// has shut down, after its context was cancelled.
+func (srs *SessionRequestSplitter) Stopped() <-chan struct{} {
+	return srs.stopped
+}
+
 func (srs *SessionRequestSplitter) run() {
+	defer close(srs.stopped)
 	for {
 		select {
 		case message := <-srs.messages:
@@ -125,6 +151,14 @@ func (s *splitRequestMessage) handle(srs *SessionRequestSplitter) {
 	s.resp <- splitRequests
 }
 
+type splitFactorMessage struct {
+	resp chan int
+}
+
+func (s *splitFactorMessage) handle(srs *SessionRequestSplitter) {
+	s.resp <- srs.split
+}
+
 type recordDuplicateMessage struct{}
 
 func (r *recordDuplicateMessage) handle(srs *SessionRequestSplitter) {
@@ -76,6 +76,9 @@ func TestSplittingRequestsIncreasingSplitDueToDupes(t *testing.T) {
 	if len(partialRequests) != maxSplit {
 		t.Fatal("Did not adjust split up as duplicates came in")
 	}
+	if srs.SplitFactor() != maxSplit {
+		t.Fatal("Did not report adjusted split factor")
+	}
 }
 
 func TestSplittingRequestsDecreasingSplitDueToNoDupes(t *testing.T) {
@@ -2,6 +2,7 @@ package bitswap
 
 import (
 	"sort"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
 )
@@ -17,6 +18,16 @@ type Stat struct {
 	DupBlksReceived  uint64
 	DupDataReceived  uint64
 	MessagesReceived uint64
+	// messages waiting to be processed, and dropped because their peer
+	// had too many waiting
+	MessagesQueued  int
+	MessagesDropped uint64
+	// time block sends were held back by the upload limits, and how many
+	// sends held back the ones after them
+	UploadThrottled      time.Duration
+	UploadThrottledSends uint64
+	// blocks not sent again to a peer that recently got them
+	DupBlksSuppressed uint64
 }
 
 func (bs *Bitswap) Stat() (*Stat, error) {
@@ -34,6 +45,16 @@ func (bs *Bitswap) Stat() (*Stat, error) {
 	st.MessagesReceived = c.messagesRecvd
 	bs.counterLk.Unlock()
 
+	iqStats := bs.iq.Stats()
+	st.MessagesQueued = iqStats.Depth
+	st.MessagesDropped = iqStats.Dropped
+
+	ulStats := bs.uploadLimiter.Stats()
+	st.UploadThrottled = ulStats.Throttled
+	st.UploadThrottledSends = ulStats.ThrottledSends
+
+	st.DupBlksSuppressed = bs.engine.SuppressedSends()
+
 	peers := bs.engine.Peers()
 	st.Peers = make([]string, 0, len(peers))
 
@@ -0,0 +1,50 @@
+package bitswap
+
+import (
+	"sync"
+
+	bsnet "github.com/ipfs/go-bitswap/network"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	testutil "github.com/libp2p/go-testutil"
+)
+
+type tcpnet struct {
+	addrs     *bsnet.AddressBook
+	providers *bsnet.ProviderTable
+
+	lk    sync.Mutex
+	peers map[peer.ID]struct{}
+}
+
+// TCPNet returns a Network whose adapters talk to each other over plain TCP
+// on localhost, sharing an address book and provider table.
+func TCPNet() Network {
+	return &tcpnet{
+		addrs:     bsnet.NewAddressBook(),
+		providers: bsnet.NewProviderTable(),
+		peers:     make(map[peer.ID]struct{}),
+	}
+}
+
+func (tn *tcpnet) Adapter(p testutil.Identity) bsnet.BitSwapNetwork {
+	client, err := bsnet.NewTCPNetwork(p.ID(), "127.0.0.1:0", tn.addrs, tn.providers)
+	if err != nil {
+		panic(err.Error())
+	}
+	tn.addrs.Add(p.ID(), client.Addr().String())
+
+	tn.lk.Lock()
+	tn.peers[p.ID()] = struct{}{}
+	tn.lk.Unlock()
+	return client
+}
+
+func (tn *tcpnet) HasPeer(p peer.ID) bool {
+	tn.lk.Lock()
+	defer tn.lk.Unlock()
+	_, ok := tn.peers[p]
+	return ok
+}
+
+var _ Network = (*tcpnet)(nil)
@@ -18,22 +18,24 @@ import (
 
 // WARNING: this uses RandTestBogusIdentity DO NOT USE for NON TESTS!
 func NewTestSessionGenerator(
-	net tn.Network) SessionGenerator {
+	net tn.Network, bsOptions ...Option) SessionGenerator {
 	ctx, cancel := context.WithCancel(context.Background())
 	return SessionGenerator{
-		net:    net,
-		seq:    0,
-		ctx:    ctx, // TODO take ctx as param to Next, Instances
-		cancel: cancel,
+		net:       net,
+		seq:       0,
+		ctx:       ctx, // TODO take ctx as param to Next, Instances
+		cancel:    cancel,
+		bsOptions: bsOptions,
 	}
 }
 
 // TODO move this SessionGenerator to the core package and export it as the core generator
 type SessionGenerator struct {
-	seq    int
-	net    tn.Network
-	ctx    context.Context
-	cancel context.CancelFunc
+	seq       int
+	net       tn.Network
+	ctx       context.Context
+	cancel    context.CancelFunc
+	bsOptions []Option
 }
 
 func (g *SessionGenerator) Close() error {
@@ -47,7 +49,7 @@ func (g *SessionGenerator) Next() Instance {
 	if err != nil {
 		panic("FIXME") // TODO change signature
 	}
-	return MkSession(g.ctx, g.net, p)
+	return MkSession(g.ctx, g.net, p, g.bsOptions...)
 }
 
 func (g *SessionGenerator) Instances(n int) []Instance {
@@ -86,7 +88,7 @@ func (i *Instance) SetBlockstoreLatency(t time.Duration) time.Duration {
 // NB: It's easy make mistakes by providing the same peer ID to two different
 // sessions. To safeguard, use the SessionGenerator to generate sessions. It's
 // just a much better idea.
-func MkSession(ctx context.Context, net tn.Network, p testutil.Identity) Instance {
+func MkSession(ctx context.Context, net tn.Network, p testutil.Identity, bsOptions ...Option) Instance {
 	bsdelay := delay.Fixed(0)
 
 	adapter := net.Adapter(p)
@@ -99,7 +101,7 @@ func MkSession(ctx context.Context, net tn.Network, p testutil.Identity) Instanc
 		panic(err.Error()) // FIXME perhaps change signature and return error.
 	}
 
-	bs := New(ctx, adapter, bstore).(*Bitswap)
+	bs := New(ctx, adapter, bstore, bsOptions...).(*Bitswap)
 
 	return Instance{
 		Peer:            p.ID(),
@@ -0,0 +1,221 @@
+package uploadlimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Limit is a bandwidth limit. The zero Limit is unlimited.
+type Limit struct {
+	// Rate is the number of bytes that may be sent per second.
+	Rate int
+	// Burst is the number of bytes that may be sent at once after a quiet
+	// period. It defaults to Rate.
+	Burst int
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Rate)
+}
+
+// Stats is a snapshot of how much the limits slowed down sends.
+type Stats struct {
+	// Throttled is the total time sends held back the following sends,
+	// waiting for global bandwidth or for the peer's limit to allow them.
+	Throttled time.Duration
+	// ThrottledSends is the number of sends that held back sends.
+	ThrottledSends uint64
+}
+
+// bucket is a token bucket holding the bytes that may be sent right away.
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l Limit, now time.Time) *bucket {
+	return &bucket{limit: l, tokens: l.burst(), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.limit.Rate)
+	if burst := b.limit.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// take removes n bytes from the bucket, going into debt if it holds fewer,
+// and returns how long it takes to pay the debt back.
+func (b *bucket) take(now time.Time, n int) time.Duration {
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.limit.Rate) * float64(time.Second))
+}
+
+// UploadLimiter holds back sends so they stay within a global bandwidth limit
+// and a limit for each peer. Messages larger than a limit's burst are let
+// through once the bandwidth they use has been earned back.
+//
+// Sends wait for the global limit. The peer limits are meant to be checked
+// with Ready when choosing whom to send to next, and charged with Reserve as
+// soon as the bytes are chosen, so that peers over their limit don't hold up
+// the senders.
+type UploadLimiter struct {
+	global    *bucket
+	perPeer   Limit
+	overrides map[peer.ID]Limit
+
+	lk    sync.Mutex
+	peers map[peer.ID]*bucket
+	// disconnected peers whose buckets are kept until they refill, so
+	// reconnecting doesn't reset a peer's limit
+	gone  map[peer.ID]struct{}
+	stats Stats
+}
+
+// New creates an UploadLimiter with a global limit and a limit for each peer,
+// which overrides replace for specific peers.
+func New(global, perPeer Limit, overrides map[peer.ID]Limit) *UploadLimiter {
+	ul := &UploadLimiter{
+		perPeer:   perPeer,
+		overrides: overrides,
+		peers:     make(map[peer.ID]*bucket),
+		gone:      make(map[peer.ID]struct{}),
+	}
+	if global.Rate > 0 {
+		ul.global = newBucket(global, time.Now())
+	}
+	return ul
+}
+
+func (ul *UploadLimiter) peerLimit(p peer.ID) Limit {
+	if l, ok := ul.overrides[p]; ok {
+		return l
+	}
+	return ul.perPeer
+}
+
+// Ready reports whether p's limit lets bytes be sent to it right now, that
+// is whether the bytes already sent to it have been earned back.
+func (ul *UploadLimiter) Ready(p peer.ID) bool {
+	ul.lk.Lock()
+	defer ul.lk.Unlock()
+	pb, ok := ul.peers[p]
+	if !ok {
+		return true
+	}
+	pb.refill(time.Now())
+	return pb.tokens > 0
+}
+
+// Reserve counts n bytes about to be sent to p against p's limit, without
+// waiting for it. Ready reports whether p is over its limit, so reserving the
+// bytes when choosing to send them keeps sends chosen ahead of time from all
+// finding p ready.
+func (ul *UploadLimiter) Reserve(p peer.ID, n int) {
+	ul.lk.Lock()
+	defer ul.lk.Unlock()
+	now := time.Now()
+	pb, ok := ul.peers[p]
+	if !ok {
+		l := ul.peerLimit(p)
+		if l.Rate <= 0 {
+			return
+		}
+		pb = newBucket(l, now)
+		ul.peers[p] = pb
+	}
+	delete(ul.gone, p)
+	if held := pb.take(now, n); held > 0 {
+		ul.stats.Throttled += held
+		ul.stats.ThrottledSends++
+	}
+}
+
+// Refund gives back n bytes reserved for p that weren't sent after all.
+func (ul *UploadLimiter) Refund(p peer.ID, n int) {
+	ul.lk.Lock()
+	defer ul.lk.Unlock()
+	pb, ok := ul.peers[p]
+	if !ok {
+		return
+	}
+	pb.tokens += float64(n)
+	if burst := pb.limit.burst(); pb.tokens > burst {
+		pb.tokens = burst
+	}
+}
+
+// Wait blocks until the global limit lets n bytes be sent. The bytes are
+// counted against the peer limits by Reserve. If ctx is cancelled first it
+// returns the context's error and the bytes don't count against the global
+// limit.
+func (ul *UploadLimiter) Wait(ctx context.Context, n int) error {
+	if ul.global == nil {
+		return nil
+	}
+	ul.lk.Lock()
+	now := time.Now()
+	wait := ul.global.take(now, n)
+	if wait == 0 {
+		ul.lk.Unlock()
+		return nil
+	}
+	ul.lk.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		ul.lk.Lock()
+		ul.stats.Throttled += wait
+		ul.stats.ThrottledSends++
+		ul.lk.Unlock()
+		return nil
+	case <-ctx.Done():
+		ul.lk.Lock()
+		ul.stats.Throttled += time.Since(now)
+		ul.stats.ThrottledSends++
+		ul.global.tokens += float64(n)
+		ul.lk.Unlock()
+		return ctx.Err()
+	}
+}
+
+// PeerGone forgets the limit state of a disconnected peer once it has been
+// earned back.
+func (ul *UploadLimiter) PeerGone(p peer.ID) {
+	ul.lk.Lock()
+	defer ul.lk.Unlock()
+
+	if _, ok := ul.peers[p]; ok {
+		ul.gone[p] = struct{}{}
+	}
+	now := time.Now()
+	for gp := range ul.gone {
+		b := ul.peers[gp]
+		b.refill(now)
+		if b.tokens >= b.limit.burst() {
+			delete(ul.peers, gp)
+			delete(ul.gone, gp)
+		}
+	}
+}
+
+// Stats returns how much the limits slowed down sends so far.
+func (ul *UploadLimiter) Stats() Stats {
+	ul.lk.Lock()
+	defer ul.lk.Unlock()
+	return ul.stats
+}
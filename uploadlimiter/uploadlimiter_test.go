@@ -0,0 +1,153 @@
+package uploadlimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/go-testutil"
+)
+
+func TestUnlimited(t *testing.T) {
+	ul := New(Limit{}, Limit{}, nil)
+	p := testutil.RandPeerIDFatal(t)
+	for i := 0; i < 100; i++ {
+		ul.Reserve(p, 1<<20)
+		if err := ul.Wait(context.Background(), 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !ul.Ready(p) {
+		t.Fatal("unlimited peer should always be ready")
+	}
+	if st := ul.Stats(); st.ThrottledSends != 0 {
+		t.Fatal("unlimited sends should not be throttled")
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	ul := New(Limit{Rate: 10000, Burst: 1000}, Limit{}, nil)
+	ctx := context.Background()
+
+	start := time.Now()
+	// the burst goes through, the rest waits for 0.1s worth of bandwidth
+	for i := 0; i < 2; i++ {
+		if err := ul.Wait(ctx, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 90*time.Millisecond {
+		t.Fatal("expected sends to wait for the global limit, took", elapsed)
+	}
+	st := ul.Stats()
+	if st.ThrottledSends != 1 || st.Throttled < 90*time.Millisecond {
+		t.Fatalf("expected one throttled send, got %+v", st)
+	}
+}
+
+func TestPeerLimitsAndOverrides(t *testing.T) {
+	fast := testutil.RandPeerIDFatal(t)
+	ul := New(Limit{}, Limit{Rate: 10000, Burst: 1000}, map[peer.ID]Limit{fast: {}})
+	ctx := context.Background()
+	a := testutil.RandPeerIDFatal(t)
+	b := testutil.RandPeerIDFatal(t)
+
+	start := time.Now()
+	sends := []struct {
+		p peer.ID
+		n int
+	}{{a, 2000}, {b, 1500}, {fast, 1000}, {fast, 1000}, {fast, 1000}}
+	for _, s := range sends {
+		ul.Reserve(s.p, s.n)
+		if err := ul.Wait(ctx, s.n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("sends should not wait for peer limits")
+	}
+
+	if ul.Ready(a) || ul.Ready(b) {
+		t.Fatal("expected peers over their limit not to be ready")
+	}
+	if !ul.Ready(fast) {
+		t.Fatal("expected overrides to apply")
+	}
+	if st := ul.Stats(); st.ThrottledSends != 2 {
+		t.Fatalf("expected the sends over the peer limits to count, got %+v", st)
+	}
+
+	time.Sleep(70 * time.Millisecond)
+	if !ul.Ready(b) {
+		t.Fatal("expected peer to be ready once its limit is earned back")
+	}
+	if ul.Ready(a) {
+		t.Fatal("expected peer further over its limit not to be ready yet")
+	}
+}
+
+func TestCancelledWaitRefunds(t *testing.T) {
+	ul := New(Limit{Rate: 1000, Burst: 1000}, Limit{}, nil)
+	if err := ul.Wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ul.Wait(ctx, 100000); err != context.DeadlineExceeded {
+		t.Fatal("expected wait to be cancelled, got", err)
+	}
+
+	// only the first send counts, so about 100 bytes are available again
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := ul.Wait(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("cancelled send should not count against the global limit")
+	}
+}
+
+func TestRefund(t *testing.T) {
+	ul := New(Limit{}, Limit{Rate: 1000, Burst: 1000}, nil)
+	p := testutil.RandPeerIDFatal(t)
+	ul.Reserve(p, 1500)
+	if ul.Ready(p) {
+		t.Fatal("expected peer over its limit not to be ready")
+	}
+	ul.Refund(p, 1500)
+	if !ul.Ready(p) {
+		t.Fatal("refunded bytes should not count against the peer limit")
+	}
+	// refunds don't give the peer more than its burst
+	ul.Refund(p, 5000)
+	ul.Reserve(p, 1100)
+	if ul.Ready(p) {
+		t.Fatal("expected refunds to be capped at the burst")
+	}
+}
+
+func TestPeerGoneKeepsDebt(t *testing.T) {
+	ul := New(Limit{}, Limit{Rate: 10000, Burst: 1000}, nil)
+	p := testutil.RandPeerIDFatal(t)
+	ul.Reserve(p, 2000)
+
+	// reconnecting doesn't give the peer a fresh burst
+	ul.PeerGone(p)
+	if ul.Ready(p) {
+		t.Fatal("expected peer to stay over its limit after reconnecting")
+	}
+
+	time.Sleep(210 * time.Millisecond)
+	ul.PeerGone(p)
+	ul.lk.Lock()
+	defer ul.lk.Unlock()
+	if len(ul.peers) != 0 || len(ul.gone) != 0 {
+		t.Fatal("expected state of refilled disconnected peer to be dropped")
+	}
+}
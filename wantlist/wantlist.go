@@ -5,6 +5,8 @@ package wantlist
 import (
 	"sort"
 
+	pb "github.com/ipfs/go-bitswap/message/pb"
+
 	cid "github.com/ipfs/go-cid"
 )
 
@@ -19,6 +21,9 @@ type Wantlist struct {
 type Entry struct {
 	Cid      cid.Cid
 	Priority int
+	// WantType is whether the block itself or only its presence is wanted.
+	// The zero value wants the block.
+	WantType pb.Message_Wantlist_WantType
 }
 
 type sessionTrackedEntry struct {
@@ -61,24 +66,18 @@ func New() *Wantlist {
 // Add returns true if the cid did not exist in the wantlist before this call
 // (even if it was under a different session).
 func (w *SessionTrackedWantlist) Add(c cid.Cid, priority int, ses uint64) bool {
-
-	if e, ok := w.set[c]; ok {
-		e.sesTrk[ses] = struct{}{}
-		return false
-	}
-
-	w.set[c] = &sessionTrackedEntry{
-		Entry:  Entry{Cid: c, Priority: priority},
-		sesTrk: map[uint64]struct{}{ses: struct{}{}},
-	}
-
-	return true
+	return w.AddEntry(Entry{Cid: c, Priority: priority}, ses)
 }
 
-// AddEntry adds given Entry to the wantlist. For more information see Add method.
+// AddEntry adds given Entry to the wantlist. For more information see Add
+// method. A want-have entry already in the wantlist is upgraded if the given
+// entry is a want-block.
 func (w *SessionTrackedWantlist) AddEntry(e Entry, ses uint64) bool {
 	if ex, ok := w.set[e.Cid]; ok {
 		ex.sesTrk[ses] = struct{}{}
+		if e.WantType == pb.Message_Wantlist_Block {
+			ex.WantType = e.WantType
+		}
 		return false
 	}
 	w.set[e.Cid] = &sessionTrackedEntry{
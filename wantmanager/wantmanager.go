@@ -3,8 +3,10 @@ package wantmanager
 import (
 	"context"
 	"math"
+	"sync"
 
 	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	wantlist "github.com/ipfs/go-bitswap/wantlist"
 	logging "github.com/ipfs/go-log"
 
@@ -45,8 +47,9 @@ type WantManager struct {
 	wl   *wantlist.SessionTrackedWantlist
 	bcwl *wantlist.SessionTrackedWantlist
 
-	ctx    context.Context
-	cancel func()
+	ctx     context.Context
+	cancel  func()
+	running sync.WaitGroup
 
 	peerHandler   PeerHandler
 	wantlistGauge metrics.Gauge
@@ -75,12 +78,20 @@ func (wm *WantManager) SetDelegate(peerHandler PeerHandler) {
 // WantBlocks adds the given cids to the wantlist, tracked by the given session.
 func (wm *WantManager) WantBlocks(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64) {
 	log.Infof("want blocks: %s", ks)
-	wm.addEntries(ctx, ks, peers, false, ses)
+	wm.addEntries(ctx, ks, peers, false, pb.Message_Wantlist_Block, ses)
+}
+
+// WantHaves adds the given cids to the wantlist as want-haves, tracked by the
+// given session: peers are asked whether they have the blocks rather than
+// to send them. A cid already wanted as a block stays a want-block.
+func (wm *WantManager) WantHaves(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64) {
+	log.Infof("want haves: %s", ks)
+	wm.addEntries(ctx, ks, peers, false, pb.Message_Wantlist_Have, ses)
 }
 
 // CancelWants removes the given cids from the wantlist, tracked by the given session.
 func (wm *WantManager) CancelWants(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64) {
-	wm.addEntries(context.Background(), ks, peers, true, ses)
+	wm.addEntries(context.Background(), ks, peers, true, pb.Message_Wantlist_Block, ses)
 }
 
 // IsWanted returns whether a CID is currently wanted.
@@ -165,15 +176,20 @@ func (wm *WantManager) Disconnected(p peer.ID) {
 
 // Startup starts processing for the WantManager.
 func (wm *WantManager) Startup() {
+	wm.running.Add(1)
 	go wm.run()
 }
 
-// Shutdown ends processing for the want manager.
+// Shutdown ends processing for the want manager. Want changes queued before
+// the call, such as the cancels of sessions that just ended, are still
+// passed on to the peer handler. It returns once processing has stopped.
 func (wm *WantManager) Shutdown() {
 	wm.cancel()
+	wm.running.Wait()
 }
 
 func (wm *WantManager) run() {
+	defer wm.running.Done()
 	// NOTE: Do not open any streams or connections from anywhere in this
 	// event loop. Really, just don't do anything likely to block.
 	for {
@@ -181,17 +197,35 @@ func (wm *WantManager) run() {
 		case message := <-wm.wantMessages:
 			message.handle(wm)
 		case <-wm.ctx.Done():
+			wm.drain()
+			return
+		}
+	}
+}
+
+// drain handles the messages still queued when the want manager shuts down.
+func (wm *WantManager) drain() {
+	for {
+		select {
+		case message := <-wm.wantMessages:
+			message.handle(wm)
+		default:
 			return
 		}
 	}
 }
 
-func (wm *WantManager) addEntries(ctx context.Context, ks []cid.Cid, targets []peer.ID, cancel bool, ses uint64) {
+func (wm *WantManager) addEntries(ctx context.Context, ks []cid.Cid, targets []peer.ID, cancel bool, wantType pb.Message_Wantlist_WantType, ses uint64) {
 	entries := make([]bsmsg.Entry, 0, len(ks))
 	for i, k := range ks {
+		entry := wantlist.NewRefEntry(k, maxPriority-i)
+		entry.WantType = wantType
 		entries = append(entries, bsmsg.Entry{
 			Cancel: cancel,
-			Entry:  wantlist.NewRefEntry(k, maxPriority-i),
+			// only targeted peers are asked for a DONT_HAVE, broadcasts
+			// would flood us with them
+			SendDontHave: !cancel && len(targets) > 0,
+			Entry:        entry,
 		})
 	}
 	select {
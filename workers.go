@@ -2,27 +2,65 @@ package bitswap
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	engine "github.com/ipfs/go-bitswap/decision"
 	bsmsg "github.com/ipfs/go-bitswap/message"
+	bsnet "github.com/ipfs/go-bitswap/network"
 	cid "github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log"
 	process "github.com/jbenet/goprocess"
 	procctx "github.com/jbenet/goprocess/context"
+	peer "github.com/libp2p/go-libp2p-peer"
 )
 
+// TaskWorkerCount is the default number of workers sending blocks to other
+// peers.
 var TaskWorkerCount = 8
 
+// InboundWorkerCount is the default number of workers processing messages received
+// from peers.
+var InboundWorkerCount = 8
+
+// ReceiveBlockWorkerCount is the default number of workers handling blocks received
+// from peers.
+var ReceiveBlockWorkerCount = 8
+
 func (bs *Bitswap) startWorkers(px process.Process, ctx context.Context) {
 
+	// task workers waiting for upload bandwidth give up once bitswap closes
+	taskCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-px.Closing()
+		cancel()
+	}()
+
 	// Start up workers to handle requests from other nodes for the data on this node
-	for i := 0; i < TaskWorkerCount; i++ {
+	for i := 0; i < bs.taskWorkerCount; i++ {
 		i := i
 		px.Go(func(px process.Process) {
-			bs.taskWorker(ctx, i)
+			bs.taskWorker(taskCtx, i)
+		})
+	}
+
+	// Start up workers to handle blocks received from other nodes
+	for i := 0; i < bs.receiveBlockWorkerCount; i++ {
+		px.Go(func(px process.Process) {
+			bs.receiveBlockWorker(ctx)
+		})
+	}
+
+	if bs.receiptsEnabled {
+		px.Go(func(px process.Process) {
+			bs.receiptWorker(ctx)
 		})
 	}
 
+	if !bs.provideEnabled {
+		return
+	}
+
 	// Start up a worker to manage sending out provides messages
 	px.Go(func(px process.Process) {
 		bs.provideCollector(ctx)
@@ -46,7 +84,19 @@ func (bs *Bitswap) taskWorker(ctx context.Context, id int) {
 				if !ok {
 					continue
 				}
-				// update the BS ledger to reflect sent message
+				// only the global upload limit is waited for here, the
+				// engine charges the peer's own limit when picking the task
+				if err := bs.uploadLimiter.Wait(ctx, blocksSize(envelope.Message)); err != nil {
+					envelope.Sent()
+					return
+				}
+				if err := bs.sendBlocks(ctx, envelope); err != nil {
+					log.Infof("sendblock error: %s", err)
+					envelope.Sent()
+					continue
+				}
+				// update the BS ledger to reflect sent message, before the
+				// task completes so the blocks aren't queued again
 				// TODO: Should only track *useful* messages in ledger
 				outgoing := bsmsg.New(false)
 				for _, block := range envelope.Message.Blocks() {
@@ -59,28 +109,58 @@ func (bs *Bitswap) taskWorker(ctx context.Context, id int) {
 					}))
 					outgoing.AddBlock(block)
 				}
+				for _, c := range envelope.Message.Haves() {
+					outgoing.AddHave(c)
+				}
 				bs.engine.MessageSent(envelope.Peer, outgoing)
+				envelope.Sent()
 
-				bs.sendBlocks(ctx, envelope)
 				bs.counterLk.Lock()
 				for _, block := range envelope.Message.Blocks() {
 					bs.counters.blocksSent++
 					bs.counters.dataSent += uint64(len(block.RawData()))
 				}
 				bs.counterLk.Unlock()
+			case <-bs.process.Closing():
+				return
 			case <-ctx.Done():
 				return
 			}
+		case <-bs.process.Closing():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// blocksSize returns the number of bytes of block data in a message.
+func blocksSize(m bsmsg.BitSwapMessage) int {
+	size := 0
+	for _, block := range m.Blocks() {
+		size += len(block.RawData())
+	}
+	return size
+}
+
+func (bs *Bitswap) receiveBlockWorker(ctx context.Context) {
+	for {
+		select {
+		case rb := <-bs.receivedBlocks:
+			bs.handleReceivedBlock(rb.ctx, rb.from, rb.blk)
+			rb.wg.Done()
+		case <-bs.process.Closing():
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (bs *Bitswap) sendBlocks(ctx context.Context, env *engine.Envelope) {
+// sendBlocks sends the message of the envelope, which the caller completes.
+func (bs *Bitswap) sendBlocks(ctx context.Context, env *engine.Envelope) error {
 	// Blocks need to be sent synchronously to maintain proper backpressure
 	// throughout the network stack
-	defer env.Sent()
 
 	msgSize := 0
 	msg := bsmsg.New(false)
@@ -89,11 +169,44 @@ func (bs *Bitswap) sendBlocks(ctx context.Context, env *engine.Envelope) {
 		msg.AddBlock(block)
 		log.Infof("Sending block %s to %s", block, env.Peer)
 	}
+	for _, c := range env.Message.Haves() {
+		msg.AddHave(c)
+	}
+	for _, c := range env.Message.DontHaves() {
+		msg.AddDontHave(c)
+	}
+	for _, c := range env.Message.NotPermitted() {
+		msg.AddNotPermitted(c)
+	}
 
 	bs.sentHistogram.Observe(float64(msgSize))
-	err := bs.network.SendMessage(ctx, env.Peer, msg)
-	if err != nil {
-		log.Infof("sendblock error: %s", err)
+	return bs.network.SendMessage(ctx, env.Peer, msg)
+}
+
+// receiptWorker periodically sends receipts to the peers that sent us data
+// and speak a protocol version that carries them.
+func (bs *Bitswap) receiptWorker(ctx context.Context) {
+	var accept func(peer.ID) bool
+	if pr, ok := bs.network.(bsnet.ProtocolReporter); ok {
+		accept = pr.SupportsOneTwo
+	}
+	ticker := time.NewTicker(bs.receiptInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for p, r := range bs.engine.SignReceipts(accept) {
+				msg := bsmsg.New(false)
+				msg.SetReceipt(r)
+				if err := bs.network.SendMessage(ctx, p, msg); err != nil {
+					log.Infof("error sending receipt to %s: %s", p, err)
+				}
+			}
+		case <-bs.process.Closing():
+			return
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -108,9 +221,12 @@ func (bs *Bitswap) provideWorker(px process.Process) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	limit := make(chan struct{}, provideWorkerMax)
+	limit := make(chan struct{}, bs.provideWorkerMax)
+	var providing sync.WaitGroup
+	defer providing.Wait()
 
 	limitedGoProvide := func(k cid.Cid, wid int) {
+		defer providing.Done()
 		defer func() {
 			// replace token when done
 			<-limit
@@ -145,6 +261,7 @@ func (bs *Bitswap) provideWorker(px process.Process) {
 			case <-px.Closing():
 				return
 			case limit <- struct{}{}:
+				providing.Add(1)
 				go limitedGoProvide(k, wid)
 			}
 		}
@@ -178,6 +295,8 @@ func (bs *Bitswap) provideCollector(ctx context.Context) {
 			} else {
 				keysOut = nil
 			}
+		case <-bs.process.Closing():
+			return
 		case <-ctx.Done():
 			return
 		}